@@ -12,6 +12,7 @@ import (
 	"hash"
 	"io"
 	"math/big"
+	"strings"
 	"time"
 
 	"github.com/openbolt/openid/utils"
@@ -30,19 +31,48 @@ type AccessTokenPayload struct {
 	ClientID string
 	Scope    string
 	AuthTime time.Time
+	IssuedAt time.Time
 	Validity time.Time
+	// Hash of the code this token was issued from, empty for the implicit flow
+	CodeHash string `json:",omitempty"`
+	// Resource indicators the token is restricted to, Ref RFC 8707
+	Resources []string `json:",omitempty"`
+}
+
+// RevocationStore keeps track of revoked tokens
+type RevocationStore interface {
+	// Revoke invalidates all tokens of `clientID` issued before `t`
+	Revoke(clientID string, t time.Time) error
+	// RevokedBefore returns the time set by Revoke, zero if never revoked
+	RevokedBefore(clientID string) time.Time
+	// RevokeCode invalidates all tokens issued from the code with the hash
+	// `codeHash`. The revocation may be forgotten after `exp`.
+	RevokeCode(codeHash string, exp time.Time) error
+	// CodeRevoked returns true, if RevokeCode was called for `codeHash`
+	CodeRevoked(codeHash string) bool
 }
 
 func (t *AccessToken) Load(ses Session, signkey *ecdsa.PrivateKey) *AccessToken {
 	t.TokenType = "bearer"
-	t.ExpiresIn = 300 // TODO: Make this param
+	lifetime := ses.AccessTokenLifetime
+	if lifetime == 0 {
+		lifetime = DefaultAccessTokenLifetime
+	}
+	// Serialized as number of seconds
+	t.ExpiresIn = lifetime / time.Second
 
 	// Generate payload
+	now := time.Now()
 	payload := AccessTokenPayload{
-		ClientID: ses.ClientID,
-		Scope:    ses.Scope,
-		AuthTime: ses.AuthTime,
-		Validity: time.Now().Add(t.ExpiresIn * time.Second),
+		ClientID:  ses.ClientID,
+		Scope:     ses.Scope,
+		AuthTime:  ses.AuthTime,
+		IssuedAt:  now,
+		Validity:  now.Add(t.ExpiresIn * time.Second),
+		Resources: ses.Resources,
+	}
+	if ses.Code != "" {
+		payload.CodeHash = CodeHash(ses.Code)
 	}
 
 	data, _ := json.Marshal(payload)
@@ -62,14 +92,68 @@ func (t *AccessToken) Load(ses Session, signkey *ecdsa.PrivateKey) *AccessToken
 		return new(AccessToken)
 	}
 
-	signature := r.Bytes()
-	signature = append(signature, s.Bytes()...)
+	// r and s are padded, so the signature can be split on verification
+	size := (signkey.Curve.Params().BitSize + 7) / 8
+	signature := make([]byte, 2*size)
+	r.FillBytes(signature[:size])
+	s.FillBytes(signature[size:])
 	sigtext := base64.StdEncoding.EncodeToString(signature)
 	// BUG Need to sign ";ES256;" also. Security.
 	t.Token = t.Token + ";ES256;" + sigtext
 	return &AccessToken{}
 }
 
+// ValidateAccessToken verifies an access_token issued by this provider and
+// returns its payload. Expired tokens, tokens of unknown clients and revoked
+// tokens are rejected.
+func (op *OpenID) ValidateAccessToken(token string) (AccessTokenPayload, error) {
+	parts := strings.Split(token, ";")
+	if len(parts) != 3 || parts[1] != "ES256" {
+		return AccessTokenPayload{}, errors.New("Malformed access_token")
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(parts[2])
+	size := (op.accessTokenSignKey.Curve.Params().BitSize + 7) / 8
+	if err != nil || len(sig) != 2*size {
+		return AccessTokenPayload{}, errors.New("Malformed access_token signature")
+	}
+	h := sha256.Sum256([]byte(parts[0]))
+	r := new(big.Int).SetBytes(sig[:size])
+	s := new(big.Int).SetBytes(sig[size:])
+	if !ecdsa.Verify(&op.accessTokenSignKey.PublicKey, h[:], r, s) {
+		return AccessTokenPayload{}, errors.New("Invalid access_token signature")
+	}
+
+	data, err := base64.StdEncoding.DecodeString(parts[0])
+	if err != nil {
+		return AccessTokenPayload{}, err
+	}
+	payload := AccessTokenPayload{}
+	if err := json.Unmarshal(data, &payload); err != nil {
+		return AccessTokenPayload{}, err
+	}
+
+	if time.Now().After(payload.Validity) {
+		return AccessTokenPayload{}, errors.New("access_token expired")
+	}
+	if _, err := op.Clientsrc.GetClient(payload.ClientID); err != nil {
+		return AccessTokenPayload{}, errors.New("access_token of unknown client")
+	}
+	if op.Revocations != nil && payload.IssuedAt.Before(op.Revocations.RevokedBefore(payload.ClientID)) {
+		return AccessTokenPayload{}, errors.New("access_token revoked")
+	}
+	if op.Revocations != nil && payload.CodeHash != "" && op.Revocations.CodeRevoked(payload.CodeHash) {
+		return AccessTokenPayload{}, errors.New("access_token revoked")
+	}
+	return payload, nil
+}
+
+// CodeHash identifies the tokens issued from `code`, without revealing it
+func CodeHash(code string) string {
+	h := sha256.Sum256([]byte(code))
+	return base64.RawURLEncoding.EncodeToString(h[:])
+}
+
 // loadSigningKey reads the bytes of an PEM file to extract the ECDSA private key
 func loadSigningKey(keydat []byte) (*ecdsa.PrivateKey, error) {
 	var block *pem.Block
@@ -0,0 +1,56 @@
+package openid
+
+import "strings"
+
+// requestedAcr returns the requested Authentication Context Class References
+// in order of preference. An `acr` claims request takes precedence over
+// acr_values and can make them essential. Without a request, the client's
+// default_acr_values are used.
+// Ref 5.5.1.1.  Requesting the "acr" Claim
+func requestedAcr(ar *AuthenticationRequest, clt Client) (values []string, essential bool) {
+	if c, ok := ar.Claims.IDToken["acr"]; ok && !c.Default {
+		values = c.Values
+		if c.Value != "" {
+			values = []string{c.Value}
+		}
+		if len(values) != 0 {
+			return values, c.Essential
+		}
+	}
+	if values = strings.Fields(ar.AcrValues); len(values) != 0 {
+		return values, false
+	}
+	return clt.DefaultAcrValues, false
+}
+
+// acrSatisfies returns true, if `acr` meets one of the requested `values`.
+// If OpenID.AcrValuesSupported is set, it's ordered from weakest to
+// strongest and a stronger acr satisfies a weaker request.
+func (op *OpenID) acrSatisfies(acr string, values []string) bool {
+	if len(values) == 0 {
+		return true
+	}
+	if containsAll(values, []string{acr}) {
+		return true
+	}
+
+	level := acrLevel(op.AcrValuesSupported, acr)
+	if level < 0 {
+		return false
+	}
+	for _, v := range values {
+		if l := acrLevel(op.AcrValuesSupported, v); l >= 0 && l <= level {
+			return true
+		}
+	}
+	return false
+}
+
+func acrLevel(levels []string, acr string) int {
+	for i, l := range levels {
+		if l == acr {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,79 @@
+package openid
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestRequestedAcr(t *testing.T) {
+	tests := []struct {
+		acrValues string
+		claims    string
+		values    []string
+		essential bool
+	}{
+		{"", "", []string{"default"}, false},
+		{"1 2", "", []string{"1", "2"}, false},
+		{"1", `{"id_token":{"acr":null}}`, []string{"1"}, false},
+		{"1", `{"id_token":{"acr":{"essential":true,"values":["2","3"]}}}`, []string{"2", "3"}, true},
+		{"", `{"id_token":{"acr":{"value":"2"}}}`, []string{"2"}, false},
+	}
+
+	clt := Client{DefaultAcrValues: []string{"default"}}
+	for _, test := range tests {
+		ar := &AuthenticationRequest{AcrValues: test.acrValues}
+		if test.claims != "" {
+			ar.Claims, _ = ReadClaimsRequest(test.claims)
+		}
+		values, essential := requestedAcr(ar, clt)
+		if !reflect.DeepEqual(values, test.values) || essential != test.essential {
+			t.Errorf("%q %q: expected %v %v, got %v %v", test.acrValues, test.claims, test.values, test.essential, values, essential)
+		}
+	}
+}
+
+func TestAcrSatisfies(t *testing.T) {
+	op := NewProvider()
+	if !op.acrSatisfies("0", nil) || !op.acrSatisfies("1", []string{"1"}) || op.acrSatisfies("2", []string{"1"}) {
+		t.Error("unexpected exact match")
+	}
+
+	op.AcrValuesSupported = []string{"0", "1", "2"}
+	if !op.acrSatisfies("2", []string{"1"}) || op.acrSatisfies("0", []string{"1"}) || op.acrSatisfies("x", []string{"1"}) {
+		t.Error("unexpected ordered match")
+	}
+}
+
+func TestAcrStepUp(t *testing.T) {
+	src := newTestSource()
+	op := newTestProvider(t, src)
+	op.AcrValuesSupported = []string{"0", "1"}
+
+	_, w := authorize(op, "_login=1", nil)
+	cookies := w.Result().Cookies()
+
+	// The session is too weak, so the End-User must log in again
+	vals, w := authorize(op, "acr_values=1", cookies)
+	if vals != nil || w.Body.String() != "login form" {
+		t.Fatalf("expected login form, got %v", vals)
+	}
+
+	// Without a stronger login, essential acr requests fail
+	essential := "claims=" + url.QueryEscape(`{"id_token":{"acr":{"essential":true,"value":"1"}}}`)
+	vals, w = authorize(op, "_login=1&"+essential, cookies)
+	if vals.Get("error") != "unmet_authentication_requirements" {
+		t.Fatalf("expected unmet_authentication_requirements, got %v", vals)
+	}
+	cookies = w.Result().Cookies()
+	vals, _ = authorize(op, "prompt=none&"+essential, cookies)
+	if vals.Get("error") != "unmet_authentication_requirements" {
+		t.Fatalf("expected unmet_authentication_requirements, got %v", vals)
+	}
+
+	src.acr = "1"
+	vals, _ = authorize(op, "_login=1&"+essential, cookies)
+	if ses := src.codes[vals.Get("code")]; ses.Acr != "1" {
+		t.Fatalf("expected acr 1, got %v", vals)
+	}
+}
@@ -0,0 +1,256 @@
+package openid
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/openbolt/openid/utils"
+)
+
+// AuthenticationRequest holds the parameters of an Authentication Request.
+// It is parsed and validated once and then passed to the validators, flows and
+// the EnduserIf. It can be serialized to JSON, e.g. to store it between
+// requests.
+// Ref 3.1.2.1. Authentication Request
+type AuthenticationRequest struct {
+	Scope        string `json:"scope"`
+	ResponseType string `json:"response_type"`
+	ClientID     string `json:"client_id"`
+	RedirectURI  string `json:"redirect_uri"`
+	State        string `json:"state,omitempty"`
+	ResponseMode string `json:"response_mode,omitempty"`
+	Nonce        string `json:"nonce,omitempty"`
+	Display      string `json:"display,omitempty"`
+	Prompt       Prompt `json:"prompt"`
+
+	// Only valid if MaxAgeSet, as max_age=0 is allowed. Serialized as
+	// `max_age` in seconds, see MarshalJSON.
+	MaxAge    time.Duration `json:"-"`
+	MaxAgeSet bool          `json:"-"`
+
+	UILocales     string        `json:"ui_locales,omitempty"`
+	ClaimsLocales string        `json:"claims_locales,omitempty"`
+	IDTokenHint   string        `json:"id_token_hint,omitempty"`
+	LoginHint     string        `json:"login_hint,omitempty"`
+	AcrValues     string        `json:"acr_values,omitempty"`
+	Claims        ClaimsRequest `json:"claims"`
+
+	// Ref RFC 7636, 4.3.  Client Sends the Code Challenge with the
+	// Authorization Request. The method defaults to "plain".
+	CodeChallenge       string `json:"code_challenge,omitempty"`
+	CodeChallengeMethod string `json:"code_challenge_method,omitempty"`
+
+	// Ref RFC 8707, 2.  Resource Parameter
+	Resources []string `json:"resource,omitempty"`
+}
+
+// ParseAuthenticationRequest reads the parameters of an Authentication Request
+// from r and validates their syntax (Rule 1). The returned request is filled
+// as far as possible, even if an error is returned.
+func ParseAuthenticationRequest(r *http.Request) (*AuthenticationRequest, AuthErrResp) {
+	vals := readParams(r)
+
+	ar := &AuthenticationRequest{
+		Scope:         vals.Get("scope"),
+		ResponseType:  vals.Get("response_type"),
+		ClientID:      vals.Get("client_id"),
+		RedirectURI:   vals.Get("redirect_uri"),
+		State:         vals.Get("state"),
+		ResponseMode:  vals.Get("response_mode"),
+		Nonce:         vals.Get("nonce"),
+		Display:       vals.Get("display"),
+		UILocales:     vals.Get("ui_locales"),
+		ClaimsLocales: vals.Get("claims_locales"),
+		IDTokenHint:   vals.Get("id_token_hint"),
+		LoginHint:     vals.Get("login_hint"),
+		AcrValues:     vals.Get("acr_values"),
+		CodeChallenge: vals.Get("code_challenge"),
+		Resources:     vals["resource"],
+	}
+
+	// ref 3.1.2.2 Rule 1
+	if err := validateOAuthParams(r, vals); len(err.Error) != 0 {
+		utils.EDebug(errors.New("Failed Rule 1"), r)
+		return ar, err
+	}
+
+	resp := AuthErrResp{}
+	resp.Error = "invalid_request"
+	resp.State = ar.State
+
+	var err error
+	if ar.Prompt, err = parsePrompt(vals.Get("prompt")); err != nil {
+		resp.ErrorDescription = err.Error()
+		utils.EDebug(errors.New("returning invalid_request"), r)
+		return ar, resp
+	}
+	if ar.MaxAge, ar.MaxAgeSet, err = parseMaxAge(vals.Get("max_age")); err != nil {
+		resp.ErrorDescription = err.Error()
+		utils.EDebug(errors.New("returning invalid_request"), r)
+		return ar, resp
+	}
+	if ar.Claims, err = ReadClaimsRequest(vals.Get("claims")); err != nil {
+		resp.ErrorDescription = "Malformed claims parameter"
+		utils.EDebug(errors.New("returning invalid_request"), r)
+		return ar, resp
+	}
+	if ar.CodeChallengeMethod, err = parseCodeChallenge(ar.CodeChallenge, vals.Get("code_challenge_method")); err != nil {
+		resp.ErrorDescription = err.Error()
+		utils.EDebug(errors.New("returning invalid_request"), r)
+		return ar, resp
+	}
+	if err = validateResources(ar.Resources); err != nil {
+		resp.Error = "invalid_target"
+		resp.ErrorDescription = err.Error()
+		utils.EDebug(errors.New("returning invalid_target"), r)
+		return ar, resp
+	}
+
+	utils.EDebug(errors.New("returning ok"), r)
+	return ar, AuthErrResp{}
+}
+
+// MarshalJSON serializes max_age as number of seconds, like the parameter. It
+// is omitted, if not set.
+func (ar AuthenticationRequest) MarshalJSON() ([]byte, error) {
+	type plain AuthenticationRequest
+	v := struct {
+		plain
+		MaxAge *int64 `json:"max_age,omitempty"`
+	}{plain: plain(ar)}
+	if ar.MaxAgeSet {
+		secs := int64(ar.MaxAge / time.Second)
+		v.MaxAge = &secs
+	}
+	return json.Marshal(v)
+}
+
+// UnmarshalJSON is the counterpart of MarshalJSON
+func (ar *AuthenticationRequest) UnmarshalJSON(data []byte) error {
+	type plain AuthenticationRequest
+	v := struct {
+		*plain
+		MaxAge *int64 `json:"max_age"`
+	}{plain: (*plain)(ar)}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	ar.MaxAge, ar.MaxAgeSet = 0, v.MaxAge != nil
+	if v.MaxAge != nil {
+		ar.MaxAge = time.Duration(*v.MaxAge) * time.Second
+	}
+	return nil
+}
+
+// parsePrompt parses the prompt parameter
+// If prompt contains none with any other value, an error is returned.
+// Unknown values are ignored.
+func parsePrompt(val string) (Prompt, error) {
+	p := Prompt{}
+	vals := strings.Fields(val)
+	for _, v := range vals {
+		switch v {
+		case "none":
+			p.None = true
+		case "login":
+			p.Login = true
+		case "consent":
+			p.Consent = true
+		case "select_account":
+			p.SelectAccount = true
+		default:
+			utils.EDebug(errors.New("Ignoring unknown prompt value "+v), nil)
+		}
+	}
+
+	if p.None && len(vals) > 1 {
+		return Prompt{}, errors.New("prompt=none must not be combined with other values")
+	}
+	return p, nil
+}
+
+// parseCodeChallenge checks the PKCE parameters and returns the method
+// Ref RFC 7636, 4.3.  Client Sends the Code Challenge with the Authorization
+// Request: Defaults to "plain" if not present in the request.
+func parseCodeChallenge(challenge, method string) (string, error) {
+	if challenge == "" {
+		if method != "" {
+			return "", errors.New("code_challenge_method without code_challenge")
+		}
+		return "", nil
+	}
+	if !reCodeVerifier.MatchString(challenge) {
+		return "", errors.New("Malformed code_challenge")
+	}
+	switch method {
+	case "":
+		return "plain", nil
+	case "plain", "S256":
+		return method, nil
+	default:
+		return "", errors.New("Unsupported code_challenge_method")
+	}
+}
+
+// validateResources checks the resource indicators
+// Ref RFC 8707, 2.  Resource Parameter: The value of the resource parameter
+// MUST be an absolute URI [...] It MUST NOT include a fragment component.
+func validateResources(resources []string) error {
+	for _, res := range resources {
+		u, err := url.Parse(res)
+		if err != nil || !u.IsAbs() || u.Fragment != "" || strings.Contains(res, "#") {
+			return errors.New("Invalid resource " + res)
+		}
+	}
+	return nil
+}
+
+// String returns the space delimited prompt values
+func (p Prompt) String() string {
+	var vals []string
+	if p.None {
+		vals = append(vals, "none")
+	}
+	if p.Login {
+		vals = append(vals, "login")
+	}
+	if p.Consent {
+		vals = append(vals, "consent")
+	}
+	if p.SelectAccount {
+		vals = append(vals, "select_account")
+	}
+	return strings.Join(vals, " ")
+}
+
+// MarshalText is used to serialize Prompt like the prompt parameter
+func (p Prompt) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+// UnmarshalText is used to deserialize Prompt from the prompt parameter
+func (p *Prompt) UnmarshalText(text []byte) error {
+	var err error
+	*p, err = parsePrompt(string(text))
+	return err
+}
+
+// readParams returns the OAuth parameters of an http.Request according to the
+// OIDC spec
+func readParams(r *http.Request) url.Values {
+	if r.Method == "GET" {
+		// MUST URI Query String Serialization
+		return r.URL.Query()
+
+	} else if r.Method == "POST" {
+		// MUST Form Serialization
+		r.ParseForm()
+		return r.PostForm
+	} else {
+		return url.Values{}
+	}
+}
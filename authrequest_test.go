@@ -0,0 +1,103 @@
+package openid
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testAuthRequest = "/authorize?scope=openid&response_type=code&client_id=clt1" +
+	"&redirect_uri=https%3A%2F%2Flocalhost%3A8443%2F&state=xyz&prompt=login+consent&max_age=0" +
+	"&claims=%7B%22id_token%22%3A%7B%22sub%22%3A%7B%22value%22%3A%22djboris%22%7D%7D%7D"
+
+func TestAuthenticationRequestSerialization(t *testing.T) {
+	r, _ := http.NewRequest("GET", testAuthRequest, nil)
+	ar, err := ParseAuthenticationRequest(r)
+	if err.Error != "" {
+		t.Fatal(err.ErrorDescription)
+	}
+	if !ar.Prompt.Login || !ar.Prompt.Consent || !ar.MaxAgeSet || ar.MaxAge != 0 {
+		t.Errorf("unexpected request %+v", ar)
+	}
+
+	data, _ := json.Marshal(ar)
+	if !strings.Contains(string(data), `"max_age":0`) {
+		t.Errorf("expected max_age in seconds, got %s", data)
+	}
+	back := new(AuthenticationRequest)
+	if err := json.Unmarshal(data, back); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ar, back) {
+		t.Errorf("round trip failed:\n%+v\n%+v", ar, back)
+	}
+}
+
+func TestAuthenticationRequestMaxAgeJSON(t *testing.T) {
+	for _, ar := range []AuthenticationRequest{
+		{},
+		{MaxAge: 300 * time.Second, MaxAgeSet: true},
+	} {
+		data, _ := json.Marshal(ar)
+		back := AuthenticationRequest{}
+		if err := json.Unmarshal(data, &back); err != nil {
+			t.Fatal(err)
+		}
+		if back.MaxAge != ar.MaxAge || back.MaxAgeSet != ar.MaxAgeSet {
+			t.Errorf("%s: expected %v %v, got %v %v", data, ar.MaxAge, ar.MaxAgeSet, back.MaxAge, back.MaxAgeSet)
+		}
+	}
+
+	data, _ := json.Marshal(AuthenticationRequest{MaxAge: 300 * time.Second, MaxAgeSet: true})
+	if !strings.Contains(string(data), `"max_age":300`) {
+		t.Errorf("expected max_age in seconds, got %s", data)
+	}
+}
+
+func TestParseCodeChallenge(t *testing.T) {
+	const challenge = "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+	tests := []struct {
+		challenge, method, want string
+		ok                      bool
+	}{
+		{"", "", "", true},
+		{challenge, "", "plain", true},
+		{challenge, "plain", "plain", true},
+		{challenge, "S256", "S256", true},
+		{challenge, "S512", "", false},
+		{"", "S256", "", false},
+		{"short", "S256", "", false},
+		{challenge + "!", "S256", "", false},
+	}
+	for _, tt := range tests {
+		method, err := parseCodeChallenge(tt.challenge, tt.method)
+		if (err == nil) != tt.ok || method != tt.want {
+			t.Errorf("parseCodeChallenge(%q, %q) = %q, %v", tt.challenge, tt.method, method, err)
+		}
+	}
+}
+
+func TestValidateResources(t *testing.T) {
+	for res, ok := range map[string]bool{
+		"https://api.example.com":        true,
+		"https://api.example.com/v1?x=1": true,
+		"api.example.com":                false,
+		"/relative":                      false,
+		"https://api.example.com/#fragm": false,
+		"https://api.example.com/#":      false,
+	} {
+		if err := validateResources([]string{res}); (err == nil) != ok {
+			t.Errorf("validateResources(%q) = %v", res, err)
+		}
+	}
+}
+
+func BenchmarkParseAuthenticationRequest(b *testing.B) {
+	r, _ := http.NewRequest("GET", testAuthRequest, nil)
+	for i := 0; i < b.N; i++ {
+		ParseAuthenticationRequest(r)
+	}
+}
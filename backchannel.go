@@ -0,0 +1,206 @@
+package openid
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/openbolt/openid/utils"
+	"github.com/pborman/uuid"
+)
+
+const (
+	// DefaultBackchannelQueueSize is the number of pending logout notifications,
+	// further notifications are dropped
+	DefaultBackchannelQueueSize = 1024
+	// DefaultBackchannelWorkers is the number of concurrent deliveries
+	DefaultBackchannelWorkers = 4
+	// DefaultBackchannelRetries is the number of retries after a failed delivery
+	DefaultBackchannelRetries = 3
+	// DefaultBackchannelRetryDelay is doubled after each failed delivery
+	DefaultBackchannelRetryDelay = time.Second
+	// DefaultBackchannelTimeout is the timeout for a single delivery
+	DefaultBackchannelTimeout = 10 * time.Second
+
+	// Ref OpenID Connect Back-Channel Logout 1.0, 2.4.  Logout Token
+	backchannelLogoutEvent = "http://schemas.openid.net/event/backchannel-logout"
+	logoutTokenLifetime    = 2 * time.Minute
+)
+
+// logoutNotification is a pending back-channel logout request
+type logoutNotification struct {
+	ClientID string
+	URI      string
+	Token    string
+}
+
+// startBackchannel starts the workers delivering logout tokens
+func (op *OpenID) startBackchannel() {
+	if op.BackchannelClient == nil {
+		op.BackchannelClient = newHTTPClient(DefaultBackchannelTimeout)
+		op.BackchannelClient.CheckRedirect = func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+	}
+	op.backchannel = make(chan logoutNotification, op.BackchannelQueueSize)
+	op.backchannelCtx, op.backchannelCancel = context.WithCancel(context.Background())
+	queue := op.backchannel
+	for i := 0; i < op.BackchannelWorkers; i++ {
+		op.backchannelWorkers.Add(1)
+		go func() {
+			defer op.backchannelWorkers.Done()
+			for n := range queue {
+				if op.backchannelCtx.Err() != nil {
+					utils.ELog(errors.New("Back-channel logout stopped, dropping notification for "+n.ClientID), nil)
+					continue
+				}
+				op.deliverLogout(n)
+			}
+		}()
+	}
+}
+
+// stopBackchannel closes the queue and waits for the workers. If `ctx` is
+// done first, running deliveries are cancelled.
+func (op *OpenID) stopBackchannel(ctx context.Context) error {
+	op.backchannelMu.Lock()
+	if op.backchannel == nil {
+		op.backchannelMu.Unlock()
+		return nil
+	}
+	close(op.backchannel)
+	op.backchannel = nil
+	op.backchannelMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		op.backchannelWorkers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		op.backchannelCancel()
+		return nil
+	case <-ctx.Done():
+		op.backchannelCancel()
+		<-done
+		return ctx.Err()
+	}
+}
+
+// backchannelLogout notifies all clients of the ended SSO session, which
+// registered a backchannel_logout_uri. Delivery is asynchronous.
+// Ref OpenID Connect Back-Channel Logout 1.0, 2.5.  Back-Channel Logout Request
+func (op *OpenID) backchannelLogout(r *http.Request, ses SSOSession) {
+	op.backchannelMu.RLock()
+	defer op.backchannelMu.RUnlock()
+	if op.backchannel == nil {
+		utils.ELog(errors.New("Back-channel logout stopped, dropping notifications"), r)
+		return
+	}
+
+	for _, clientID := range ses.Clients {
+		clt, err := op.Clientsrc.GetClient(clientID)
+		if err != nil || clt.BackchannelLogoutURI == "" {
+			continue
+		}
+		uri := clt.BackchannelLogoutURI
+		// Statically configured clients aren't checked on registration
+		if !strings.HasPrefix(uri, "https://") {
+			utils.ELog(errors.New("backchannel_logout_uri of "+clientID+" doesn't use https"), r)
+			continue
+		}
+
+		tok, err := op.newLogoutToken(ses, clt)
+		if err != nil {
+			utils.ELog(err, r)
+			continue
+		}
+
+		select {
+		case op.backchannel <- logoutNotification{clientID, uri, tok}:
+		default:
+			utils.ELog(errors.New("Back-channel logout queue full, dropping notification for "+clientID), r)
+		}
+	}
+}
+
+// newLogoutToken returns a signed logout_token for `clt`
+// Ref OpenID Connect Back-Channel Logout 1.0, 2.4.  Logout Token
+func (op *OpenID) newLogoutToken(ses SSOSession, clt Client) (string, error) {
+	sub, err := op.subjectFor(clt, ses.Sub)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	tok := jwt.New(jwt.SigningMethodES256)
+	tok.Header["typ"] = "logout+jwt"
+	tok.Claims["iss"] = op.Issuer
+	tok.Claims["sub"] = sub
+	tok.Claims["aud"] = clt.ClientID
+	tok.Claims["iat"] = now.Unix()
+	tok.Claims["exp"] = now.Add(logoutTokenLifetime).Unix()
+	tok.Claims["jti"] = uuid.New()
+	tok.Claims["sid"] = ses.Sid
+	tok.Claims["events"] = map[string]interface{}{backchannelLogoutEvent: map[string]interface{}{}}
+	return tok.SignedString(op.accessTokenSignKey)
+}
+
+// deliverLogout POSTs the logout_token, failed deliveries are retried with
+// an increasing delay
+func (op *OpenID) deliverLogout(n logoutNotification) {
+	delay := op.BackchannelRetryDelay
+	for try := 0; ; try++ {
+		retry, err := op.postLogoutToken(n)
+		if err == nil {
+			utils.EDebug(errors.New("Back-channel logout delivered to "+n.ClientID), nil)
+			return
+		}
+		if !retry || try >= op.BackchannelRetries {
+			utils.ELog(fmt.Errorf("Back-channel logout to %s failed: %v", n.ClientID, err), nil)
+			return
+		}
+		utils.EInfo(fmt.Errorf("Back-channel logout to %s failed, retrying: %v", n.ClientID, err), nil)
+		select {
+		case <-time.After(delay):
+		case <-op.backchannelCtx.Done():
+			utils.ELog(fmt.Errorf("Back-channel logout to %s stopped: %v", n.ClientID, err), nil)
+			return
+		}
+		delay *= 2
+	}
+}
+
+// postLogoutToken sends a single logout request, returns true if a failed
+// request may be retried
+func (op *OpenID) postLogoutToken(n logoutNotification) (bool, error) {
+	body := url.Values{"logout_token": {n.Token}}.Encode()
+	req, err := http.NewRequestWithContext(op.backchannelCtx, "POST", n.URI, strings.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := op.BackchannelClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+
+	// Ref 2.8.  Back-Channel Logout Response
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode >= 500:
+		return true, errors.New(resp.Status)
+	default:
+		// The RP rejected the token, sending it again won't help
+		return false, errors.New(resp.Status)
+	}
+}
@@ -0,0 +1,161 @@
+package openid
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+func TestBackchannelLogout(t *testing.T) {
+	tokens := make(chan string, 2)
+	calls := 0
+	rp := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		tokens <- r.PostFormValue("logout_token")
+		// Fail once, to test retries
+		if calls == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer rp.Close()
+
+	src := newTestSource()
+	clt := src.clients["clt1"]
+	clt.BackchannelLogoutURI = rp.URL
+	src.clients["clt1"] = clt
+	op := newTestProvider(t, src)
+	op.BackchannelClient = rp.Client()
+	op.BackchannelRetryDelay = time.Millisecond
+
+	_, w := authorize(op, "_login=1", nil)
+	cookies := w.Result().Cookies()
+	var sid string
+	for _, ses := range src.sessions {
+		sid = ses.Sid
+	}
+
+	endSession(op, "id_token_hint="+idTokenHint(t, op, "alice", "clt1", time.Hour), cookies)
+
+	var raw string
+	for i := 0; i < 2; i++ {
+		select {
+		case raw = <-tokens:
+		case <-time.After(5 * time.Second):
+			t.Fatal("logout_token not delivered")
+		}
+	}
+
+	tok, err := jwt.Parse(raw, func(*jwt.Token) (interface{}, error) {
+		return &op.accessTokenSignKey.PublicKey, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok.Header["typ"] != "logout+jwt" {
+		t.Errorf("expected typ logout+jwt, got %v", tok.Header["typ"])
+	}
+	if tok.Claims["sid"] != sid || sid == "" || tok.Claims["sub"] != "alice" || tok.Claims["aud"] != "clt1" {
+		t.Errorf("unexpected claims %v", tok.Claims)
+	}
+	if _, ok := tok.Claims["nonce"]; ok {
+		t.Error("logout_token must not contain a nonce")
+	}
+	events, _ := tok.Claims["events"].(map[string]interface{})
+	if _, ok := events[backchannelLogoutEvent]; !ok {
+		t.Errorf("missing logout event, got %v", tok.Claims["events"])
+	}
+}
+
+func TestBackchannelShutdown(t *testing.T) {
+	block := make(chan struct{})
+	rp := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-block:
+		case <-r.Context().Done():
+		}
+	}))
+	defer rp.Close()
+	defer close(block)
+
+	src := newTestSource()
+	clt := src.clients["clt1"]
+	clt.BackchannelLogoutURI = rp.URL
+	src.clients["clt1"] = clt
+	op := newTestProvider(t, src)
+	op.BackchannelClient = rp.Client()
+
+	_, w := authorize(op, "_login=1", nil)
+	endSession(op, "id_token_hint="+idTokenHint(t, op, "alice", "clt1", time.Hour), w.Result().Cookies())
+
+	// The hanging delivery is cancelled
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := op.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected DeadlineExceeded, got %v", err)
+	}
+
+	// Later logouts don't deliver anything
+	_, w = authorize(op, "_login=1", nil)
+	endSession(op, "id_token_hint="+idTokenHint(t, op, "alice", "clt1", time.Hour), w.Result().Cookies())
+	if err := op.Shutdown(context.Background()); err != nil {
+		t.Errorf("expected second Shutdown to succeed, got %v", err)
+	}
+}
+
+// Statically configured clients may not use http
+func TestBackchannelHTTPS(t *testing.T) {
+	calls := make(chan struct{}, 1)
+	rp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls <- struct{}{}
+	}))
+	defer rp.Close()
+
+	src := newTestSource()
+	clt := src.clients["clt1"]
+	clt.BackchannelLogoutURI = rp.URL
+	src.clients["clt1"] = clt
+	op := newTestProvider(t, src)
+
+	_, w := authorize(op, "_login=1", nil)
+	endSession(op, "id_token_hint="+idTokenHint(t, op, "alice", "clt1", time.Hour), w.Result().Cookies())
+	op.Shutdown(context.Background())
+
+	select {
+	case <-calls:
+		t.Error("logout_token sent over http")
+	default:
+	}
+}
+
+// The default client doesn't connect to internal addresses
+func TestBackchannelInternalAddress(t *testing.T) {
+	calls := make(chan struct{}, 1)
+	rp := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls <- struct{}{}
+	}))
+	defer rp.Close()
+
+	src := newTestSource()
+	clt := src.clients["clt1"]
+	clt.BackchannelLogoutURI = rp.URL
+	src.clients["clt1"] = clt
+	op := newTestProvider(t, src)
+	op.BackchannelRetries = 0
+
+	_, w := authorize(op, "_login=1", nil)
+	endSession(op, "id_token_hint="+idTokenHint(t, op, "alice", "clt1", time.Hour), w.Result().Cookies())
+	op.Shutdown(context.Background())
+
+	select {
+	case <-calls:
+		t.Error("logout_token sent to an internal address")
+	default:
+	}
+	if op.BackchannelClient.CheckRedirect(nil, nil) != http.ErrUseLastResponse {
+		t.Error("default client follows redirects")
+	}
+}
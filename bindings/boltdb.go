@@ -0,0 +1,573 @@
+package bindings
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/openbolt/openid"
+	"github.com/openbolt/openid/utils"
+	bolt "go.etcd.io/bbolt"
+)
+
+// After Config, call Init(), on exit call Close()
+
+const (
+	// DefaultBoltTimeout is used, if BoltDB.Timeout isn't set
+	DefaultBoltTimeout = time.Second
+	// DefaultGCInterval is used, if BoltDB.GCInterval isn't set
+	DefaultGCInterval = time.Minute
+)
+
+var (
+	boltCodes       = []byte("codes")
+	boltClients     = []byte("clients")
+	boltUsers       = []byte("users")
+	boltGrants      = []byte("grants")
+	boltSessions    = []byte("sessions")
+	boltRevocations = []byte("revocations")
+	// Revoked code hashes
+	boltCodeRevocations = []byte("code_revocations")
+	// RecordStore tables, keyed by table and key
+	boltRecords = []byte("records")
+	// Used one-time identifiers and their expiry
+	boltJTIs = []byte("jtis")
+)
+
+// BoltDB is an embedded binding on top of a bbolt file, so the provider runs
+// without an external database. It implements Cacher, Claimsource,
+// ClientStore, ConsentStore, SessionStore, RevocationStore, ReplayCache and
+// RecordStore.
+//
+// Values are stored as JSON. Expired codes, SSO sessions, records and
+// one-time identifiers are removed by a background garbage collector.
+type BoltDB struct {
+	Path string
+
+	// Timeout for acquiring the file lock on Init()
+	Timeout time.Duration
+	// Codes are kept this long, should be at least OpenID.CodeLifetime
+	CodeLifetime time.Duration
+	// SSO sessions are removed after this time, should match
+	// OpenID.SessionMaxAge
+	SessionMaxAge time.Duration
+	// How often expired entries are removed
+	GCInterval time.Duration
+
+	db   *bolt.DB
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// boltCode is a pending code. Redeemed codes are kept until they expire, so a
+// second redemption can be detected.
+type boltCode struct {
+	Session   openid.Session
+	ExpiresAt time.Time
+	Retired   bool
+}
+
+type boltSSOSession struct {
+	Session   openid.SSOSession
+	ExpiresAt time.Time
+}
+
+// boltRecord is a record of a RecordStore table. Taken records are kept until
+// they expire, like redeemed codes.
+type boltRecord struct {
+	Record Record
+	Taken  bool
+}
+
+func (r boltRecord) expired(now time.Time) bool {
+	return !r.Record.Expires.IsZero() && now.After(r.Record.Expires)
+}
+
+func (b *BoltDB) Init() (err error) {
+	if b.Timeout == 0 {
+		b.Timeout = DefaultBoltTimeout
+	}
+	if b.CodeLifetime == 0 {
+		b.CodeLifetime = DefaultCodeRetention
+	}
+	if b.SessionMaxAge == 0 {
+		b.SessionMaxAge = openid.DefaultSessionMaxAge
+	}
+	if b.GCInterval == 0 {
+		b.GCInterval = DefaultGCInterval
+	}
+
+	b.db, err = bolt.Open(b.Path, 0600, &bolt.Options{Timeout: b.Timeout})
+	if err != nil {
+		return err
+	}
+	err = b.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltCodes, boltClients, boltUsers, boltGrants, boltSessions, boltRevocations, boltCodeRevocations, boltRecords, boltJTIs} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		b.db.Close()
+		return err
+	}
+
+	b.stop = make(chan struct{})
+	b.wg.Add(1)
+	go b.gcLoop()
+	return nil
+}
+
+func (b *BoltDB) Close() {
+	close(b.stop)
+	b.wg.Wait()
+	b.db.Close()
+}
+
+// Backup writes a consistent copy of the database to w, while the provider
+// keeps serving
+func (b *BoltDB) Backup(w io.Writer) (int64, error) {
+	var n int64
+	err := b.db.View(func(tx *bolt.Tx) (err error) {
+		n, err = tx.WriteTo(w)
+		return err
+	})
+	return n, err
+}
+
+func (b *BoltDB) gcLoop() {
+	defer b.wg.Done()
+	t := time.NewTicker(b.GCInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if err := b.GC(); err != nil {
+				utils.ELog(err, nil)
+			}
+		case <-b.stop:
+			return
+		}
+	}
+}
+
+// GC removes expired codes, SSO sessions, code revocations, records and
+// one-time identifiers. It is called periodically after Init().
+func (b *BoltDB) GC() error {
+	now := time.Now()
+	return b.db.Update(func(tx *bolt.Tx) error {
+		if err := deleteExpired(tx.Bucket(boltCodes), func(v []byte) bool {
+			var c boltCode
+			return json.Unmarshal(v, &c) != nil || now.After(c.ExpiresAt)
+		}); err != nil {
+			return err
+		}
+		if err := deleteExpired(tx.Bucket(boltSessions), func(v []byte) bool {
+			var s boltSSOSession
+			return json.Unmarshal(v, &s) != nil || now.After(s.ExpiresAt)
+		}); err != nil {
+			return err
+		}
+		if err := deleteExpired(tx.Bucket(boltCodeRevocations), func(v []byte) bool {
+			var exp time.Time
+			return json.Unmarshal(v, &exp) != nil || now.After(exp)
+		}); err != nil {
+			return err
+		}
+		if err := deleteExpired(tx.Bucket(boltRecords), func(v []byte) bool {
+			var r boltRecord
+			return json.Unmarshal(v, &r) != nil || r.expired(now)
+		}); err != nil {
+			return err
+		}
+		return deleteExpired(tx.Bucket(boltJTIs), func(v []byte) bool {
+			var exp time.Time
+			return json.Unmarshal(v, &exp) != nil || now.After(exp)
+		})
+	})
+}
+
+func deleteExpired(bkt *bolt.Bucket, expired func(v []byte) bool) error {
+	var keys [][]byte
+	bkt.ForEach(func(k, v []byte) error {
+		if expired(v) {
+			keys = append(keys, k)
+		}
+		return nil
+	})
+	for _, k := range keys {
+		if err := bkt.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *BoltDB) put(bucket []byte, key string, val interface{}) error {
+	data, err := json.Marshal(val)
+	if err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).Put([]byte(key), data)
+	})
+}
+
+// get returns false, if there is no such key
+func (b *BoltDB) get(bucket []byte, key string, val interface{}) (bool, error) {
+	var found bool
+	err := b.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(bucket).Get([]byte(key))
+		if data == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(data, val)
+	})
+	return found, err
+}
+
+func (b *BoltDB) delete(bucket []byte, key string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).Delete([]byte(key))
+	})
+}
+
+/*
+ * Cacher
+ */
+func (b *BoltDB) Cache(val openid.Session) error {
+	data, err := json.Marshal(boltCode{Session: val, ExpiresAt: time.Now().Add(b.CodeLifetime)})
+	if err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket(boltCodes)
+		if bkt.Get([]byte(val.Code)) != nil {
+			return errors.New("Code already cached")
+		}
+		return bkt.Put([]byte(val.Code), data)
+	})
+}
+
+// Redeem retires the code in one transaction
+func (b *BoltDB) Redeem(code string) (openid.Session, error) {
+	var c boltCode
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket(boltCodes)
+		data := bkt.Get([]byte(code))
+		if data == nil {
+			return errors.New("Invalid code")
+		}
+		if err := json.Unmarshal(data, &c); err != nil {
+			return err
+		}
+		if c.Retired {
+			return openid.ErrCodeRedeemed
+		}
+		if time.Now().After(c.ExpiresAt) {
+			return errors.New("Code expired")
+		}
+
+		c.Retired = true
+		data, err := json.Marshal(c)
+		if err != nil {
+			return err
+		}
+		return bkt.Put([]byte(code), data)
+	})
+	if err == openid.ErrCodeRedeemed {
+		return c.Session, err
+	}
+	if err != nil {
+		return openid.Session{}, err
+	}
+	return c.Session, nil
+}
+
+/*
+ * Claimsource
+ */
+func (b *BoltDB) Get(id, claim, def string) (string, bool) {
+	claims := map[string]string{}
+	if found, err := b.get(boltUsers, id, &claims); !found || err != nil {
+		return def, false
+	}
+	val, ok := claims[claim]
+	if !ok {
+		return def, false
+	}
+	return val, true
+}
+
+// SaveUser stores the claims of a subject
+func (b *BoltDB) SaveUser(sub string, claims map[string]string) error {
+	return b.put(boltUsers, sub, claims)
+}
+
+/*
+ * ClientStore
+ */
+func (b *BoltDB) GetClient(id string) (openid.Client, error) {
+	var clt openid.Client
+	found, err := b.get(boltClients, id, &clt)
+	if err != nil {
+		return openid.Client{}, err
+	}
+	if !found {
+		return openid.Client{}, errors.New("No such client")
+	}
+	return clt, nil
+}
+
+func (b *BoltDB) SaveClient(clt openid.Client) error {
+	return b.put(boltClients, clt.ClientID, clt)
+}
+
+func (b *BoltDB) DeleteClient(id string) error {
+	return b.delete(boltClients, id)
+}
+
+/*
+ * ConsentStore
+ */
+
+// Grants are keyed by client first, so DeleteGrants is a prefix scan
+func grantKey(sub, clientID string) string {
+	return clientID + "\x00" + sub
+}
+
+func (b *BoltDB) GetGrant(sub, clientID string) (openid.Grant, error) {
+	var g openid.Grant
+	found, err := b.get(boltGrants, grantKey(sub, clientID), &g)
+	if err != nil {
+		return openid.Grant{}, err
+	}
+	if !found {
+		return openid.Grant{}, errors.New("Nothing granted")
+	}
+	return g, nil
+}
+
+func (b *BoltDB) SaveGrant(g openid.Grant) error {
+	return b.put(boltGrants, grantKey(g.Sub, g.ClientID), g)
+}
+
+func (b *BoltDB) DeleteGrants(clientID string) error {
+	prefix := []byte(clientID + "\x00")
+	return b.db.Update(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltGrants).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Seek(prefix) {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+/*
+ * SessionStore
+ */
+func (b *BoltDB) SaveSSOSession(s openid.SSOSession) error {
+	return b.put(boltSessions, s.ID, boltSSOSession{s, s.Created.Add(b.SessionMaxAge)})
+}
+
+func (b *BoltDB) GetSSOSession(id string) (openid.SSOSession, error) {
+	var s boltSSOSession
+	found, err := b.get(boltSessions, id, &s)
+	if err != nil {
+		return openid.SSOSession{}, err
+	}
+	if !found || time.Now().After(s.ExpiresAt) {
+		return openid.SSOSession{}, errors.New("No such session")
+	}
+	return s.Session, nil
+}
+
+func (b *BoltDB) DeleteSSOSession(id string) error {
+	return b.delete(boltSessions, id)
+}
+
+/*
+ * RevocationStore
+ */
+func (b *BoltDB) Revoke(clientID string, t time.Time) error {
+	return b.put(boltRevocations, clientID, t)
+}
+
+func (b *BoltDB) RevokedBefore(clientID string) time.Time {
+	var t time.Time
+	if found, err := b.get(boltRevocations, clientID, &t); !found || err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+func (b *BoltDB) RevokeCode(codeHash string, exp time.Time) error {
+	return b.put(boltCodeRevocations, codeHash, exp)
+}
+
+func (b *BoltDB) CodeRevoked(codeHash string) bool {
+	var exp time.Time
+	if found, err := b.get(boltCodeRevocations, codeHash, &exp); !found || err != nil {
+		return false
+	}
+	return time.Now().Before(exp)
+}
+
+/*
+ * ReplayCache
+ */
+
+// Use checks and stores the identifier in one transaction
+func (b *BoltDB) Use(id string, exp time.Time) (bool, error) {
+	now := time.Now()
+	if !exp.After(now) {
+		// Expired identifiers must be rejected by the caller anyway
+		return true, nil
+	}
+	data, err := json.Marshal(exp)
+	if err != nil {
+		return false, err
+	}
+
+	ok := false
+	err = b.db.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket(boltJTIs)
+		if old := bkt.Get([]byte(id)); old != nil {
+			var oldExp time.Time
+			if json.Unmarshal(old, &oldExp) == nil && now.Before(oldExp) {
+				return nil
+			}
+		}
+		ok = true
+		return bkt.Put([]byte(id), data)
+	})
+	return ok && err == nil, err
+}
+
+/*
+ * RecordStore
+ */
+func (b *BoltDB) AddRecord(table string, rec Record) error {
+	data, err := json.Marshal(boltRecord{Record: rec})
+	if err != nil {
+		return err
+	}
+	key := []byte(table + "\x00" + rec.Key)
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket(boltRecords)
+		if old := bkt.Get(key); old != nil {
+			var r boltRecord
+			if json.Unmarshal(old, &r) != nil || !r.expired(time.Now()) {
+				return errors.New("Record already exists")
+			}
+		}
+		return bkt.Put(key, data)
+	})
+}
+
+func (b *BoltDB) PutRecord(table string, rec Record) error {
+	return b.put(boltRecords, table+"\x00"+rec.Key, boltRecord{Record: rec})
+}
+
+// ReplaceRecord compares and sets the data in one transaction
+func (b *BoltDB) ReplaceRecord(table, key, old, data string) error {
+	k := []byte(table + "\x00" + key)
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket(boltRecords)
+		var r boltRecord
+		if v := bkt.Get(k); v == nil || json.Unmarshal(v, &r) != nil || r.Taken || r.expired(time.Now()) || r.Record.Data != old {
+			return errors.New("Record changed")
+		}
+		r.Record.Data = data
+		v, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		return bkt.Put(k, v)
+	})
+}
+
+func (b *BoltDB) GetRecord(table, key string) (Record, error) {
+	var r boltRecord
+	found, err := b.get(boltRecords, table+"\x00"+key, &r)
+	if err != nil {
+		return Record{}, err
+	}
+	if !found || r.Taken || r.expired(time.Now()) {
+		return Record{}, errors.New("No such record")
+	}
+	return r.Record, nil
+}
+
+// TakeRecord marks the record as taken in one transaction
+func (b *BoltDB) TakeRecord(table, key string) (Record, error) {
+	var r boltRecord
+	k := []byte(table + "\x00" + key)
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket(boltRecords)
+		data := bkt.Get(k)
+		if data == nil {
+			return errors.New("No such record")
+		}
+		if err := json.Unmarshal(data, &r); err != nil {
+			return err
+		}
+		if r.expired(time.Now()) {
+			return errors.New("No such record")
+		}
+		if r.Taken {
+			return openid.ErrCodeRedeemed
+		}
+
+		r.Taken = true
+		data, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		return bkt.Put(k, data)
+	})
+	if err == openid.ErrCodeRedeemed {
+		return r.Record, err
+	}
+	if err != nil {
+		return Record{}, err
+	}
+	return r.Record, nil
+}
+
+func (b *BoltDB) DeleteRecord(table, key string) error {
+	return b.delete(boltRecords, table+"\x00"+key)
+}
+
+// DeleteGroup scans the records of `table`
+func (b *BoltDB) DeleteGroup(table, group string) error {
+	if group == "" {
+		return nil
+	}
+	prefix := []byte(table + "\x00")
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket(boltRecords)
+		var keys [][]byte
+		c := bkt.Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			var r boltRecord
+			if json.Unmarshal(v, &r) == nil && r.Record.Group == group {
+				keys = append(keys, k)
+			}
+		}
+		for _, k := range keys {
+			if err := bkt.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,155 @@
+package bindings
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/openbolt/openid"
+	"github.com/openbolt/openid/bindings/storetest"
+)
+
+func newTestBoltDB(t *testing.T) (*BoltDB, func()) {
+	dir, err := ioutil.TempDir("", "openid-bolt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &BoltDB{Path: filepath.Join(dir, "openid.db")}
+	if err := b.Init(); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return b, func() {
+		b.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestBoltDB(t *testing.T) {
+	b, done := newTestBoltDB(t)
+	defer done()
+
+	var (
+		_ openid.Cacher          = b
+		_ openid.Claimsource     = b
+		_ openid.ClientStore     = b
+		_ openid.ConsentStore    = b
+		_ openid.SessionStore    = b
+		_ openid.RevocationStore = b
+		_ openid.ReplayCache     = b
+	)
+
+	t.Run("GC", func(t *testing.T) {
+		short := &BoltDB{db: b.db, CodeLifetime: time.Millisecond}
+		if err := short.Cache(openid.Session{Code: "code3"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Cache(openid.Session{Code: "code4"}); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(5 * time.Millisecond)
+		if _, err := b.Redeem("code3"); err == nil {
+			t.Error("expired code valid")
+		}
+		if err := b.GC(); err != nil {
+			t.Fatal(err)
+		}
+		var c boltCode
+		if found, _ := b.get(boltCodes, "code3", &c); found {
+			t.Error("expired code not removed")
+		}
+		if _, err := b.Redeem("code4"); err != nil {
+			t.Error("valid code removed")
+		}
+	})
+
+	t.Run("GCJTIs", func(t *testing.T) {
+		if ok, err := b.Use("jti1", time.Now().Add(5*time.Millisecond)); !ok || err != nil {
+			t.Fatalf("first use: %v, %v", ok, err)
+		}
+		if ok, err := b.Use("jti2", time.Now().Add(time.Hour)); !ok || err != nil {
+			t.Fatalf("first use: %v, %v", ok, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+		if err := b.GC(); err != nil {
+			t.Fatal(err)
+		}
+		var exp time.Time
+		if found, _ := b.get(boltJTIs, "jti1", &exp); found {
+			t.Error("expired identifier not removed")
+		}
+		if ok, _ := b.Use("jti2", time.Now().Add(time.Hour)); ok {
+			t.Error("valid identifier removed")
+		}
+	})
+
+	t.Run("Backup", func(t *testing.T) {
+		if err := b.SaveUser("alice", map[string]string{"email": "alice@example.com"}); err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if _, err := b.Backup(&buf); err != nil {
+			t.Fatal(err)
+		}
+
+		path := filepath.Join(filepath.Dir(b.Path), "backup.db")
+		if err := ioutil.WriteFile(path, buf.Bytes(), 0600); err != nil {
+			t.Fatal(err)
+		}
+		restored := &BoltDB{Path: path}
+		if err := restored.Init(); err != nil {
+			t.Fatal(err)
+		}
+		defer restored.Close()
+		if v, ok := restored.Get("alice", "email", ""); !ok || v != "alice@example.com" {
+			t.Error("backup incomplete")
+		}
+	})
+}
+
+func TestBoltDBConformance(t *testing.T) {
+	storetest.RunCacherTests(t, func(t *testing.T, lifetime time.Duration) storetest.CacherSetup {
+		b, done := newTestBoltDB(t)
+		b.CodeLifetime = lifetime
+		return storetest.CacherSetup{Cacher: b, Close: done}
+	})
+	storetest.RunClientsourceTests(t, func(t *testing.T, clients []openid.Client) (openid.Clientsource, func()) {
+		b, done := newTestBoltDB(t)
+		for _, c := range clients {
+			if err := b.SaveClient(c); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return b, done
+	})
+	storetest.RunClaimsourceTests(t, func(t *testing.T, users map[string]map[string]string) (openid.Claimsource, func()) {
+		b, done := newTestBoltDB(t)
+		for sub, claims := range users {
+			if err := b.SaveUser(sub, claims); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return b, done
+	})
+	storetest.RunSessionStoreTests(t, func(t *testing.T, maxAge time.Duration) (openid.SessionStore, func()) {
+		b, done := newTestBoltDB(t)
+		b.SessionMaxAge = maxAge
+		return b, done
+	})
+	storetest.RunConsentStoreTests(t, func(t *testing.T) (openid.ConsentStore, func()) {
+		return newTestBoltDB(t)
+	})
+	storetest.RunRevocationStoreTests(t, func(t *testing.T) (openid.RevocationStore, func()) {
+		return newTestBoltDB(t)
+	})
+	storetest.RunReplayCacheTests(t, func(t *testing.T) storetest.ReplayCacheSetup {
+		b, done := newTestBoltDB(t)
+		return storetest.ReplayCacheSetup{Cache: b, Close: done}
+	})
+	runRecordStoreTests(t, func(t *testing.T) (RecordStore, func()) {
+		return newTestBoltDB(t)
+	})
+}
@@ -1,8 +1,10 @@
 package bindings
 
 import (
-	"net/url"
-	"strings"
+	"errors"
+	"time"
+
+	"github.com/openbolt/openid"
 )
 
 //go:generate go-bindata -o bindata.go -pkg bindings assets/
@@ -13,6 +15,9 @@ import (
 type DummySource struct {
 }
 
+// dummyStore holds the data of all DummySources
+var dummyStore = &MemoryStore{}
+
 /*
  * Claimsource
  */
@@ -24,22 +29,92 @@ func (ds DummySource) Get(id, claim, def string) (string, bool) {
 
 /*
  * Clientsource
- */
-// IsClient returns true if id begins with `clt`
-func (ds DummySource) IsClient(id string) bool {
-	return strings.HasPrefix(id, "clt")
+ */
+// GetClient returns registered clients, and the demo clients
+// `cltlocalhost:8443` and `cltlocalhost:8080` with the redirect_uri
+// https://localhost:8443/ or http://localhost:8080/. Other hosts are refused,
+// so the demo isn't an open redirector.
+func (ds DummySource) GetClient(id string) (openid.Client, error) {
+	if c, err := dummyStore.GetClient(id); err == nil {
+		return c, nil
+	}
+
+	var uri string
+	switch id {
+	case "cltlocalhost:8443":
+		uri = "https://localhost:8443/"
+	case "cltlocalhost:8080":
+		uri = "http://localhost:8080/"
+	default:
+		return openid.Client{}, errors.New("No such client")
+	}
+	return openid.Client{
+		ClientID:                id,
+		RedirectURIs:            []string{uri},
+		PostLogoutRedirectURIs:  []string{uri},
+		ResponseTypes:           []string{"code", "id_token", "id_token token", "code id_token", "code token", "code id_token token"},
+		GrantTypes:              []string{"authorization_code", "implicit"},
+		ApplicationType:         "web",
+		TokenEndpointAuthMethod: "none",
+	}, nil
 }
-func (ds DummySource) GetClientType(id string) string {
-	// BUG(djboris) Implement
-	return "confidential"
+
+/*
+ * ConsentStore
+ */
+func (ds DummySource) GetGrant(sub, clientID string) (openid.Grant, error) {
+	return dummyStore.GetGrant(sub, clientID)
 }
-func (ds DummySource) GetApplType(id string) string {
-	// BUG(djboris) Implement
-	return "web"
+
+func (ds DummySource) SaveGrant(g openid.Grant) error {
+	return dummyStore.SaveGrant(g)
+}
+
+func (ds DummySource) DeleteGrants(clientID string) error {
+	return dummyStore.DeleteGrants(clientID)
+}
+
+/*
+ * SessionStore
+ */
+func (ds DummySource) SaveSSOSession(s openid.SSOSession) error {
+	return dummyStore.SaveSSOSession(s)
+}
+
+func (ds DummySource) GetSSOSession(id string) (openid.SSOSession, error) {
+	return dummyStore.GetSSOSession(id)
+}
+
+func (ds DummySource) DeleteSSOSession(id string) error {
+	return dummyStore.DeleteSSOSession(id)
+}
+
+/*
+ * ClientStore
+ */
+func (ds DummySource) SaveClient(c openid.Client) error {
+	return dummyStore.SaveClient(c)
+}
+
+func (ds DummySource) DeleteClient(id string) error {
+	return dummyStore.DeleteClient(id)
+}
+
+/*
+ * RevocationStore
+ */
+func (ds DummySource) Revoke(clientID string, t time.Time) error {
+	return dummyStore.Revoke(clientID, t)
+}
+
+func (ds DummySource) RevokedBefore(clientID string) time.Time {
+	return dummyStore.RevokedBefore(clientID)
+}
+
+func (ds DummySource) RevokeCode(codeHash string, exp time.Time) error {
+	return dummyStore.RevokeCode(codeHash, exp)
 }
 
-// Returns true if host == localhost
-func (ds DummySource) ValidateRedirectURI(id, uri string) bool {
-	u, _ := url.Parse(uri)
-	return u.Host == "localhost:8443" || u.Host == "localhost:8080"
+func (ds DummySource) CodeRevoked(codeHash string) bool {
+	return dummyStore.CodeRevoked(codeHash)
 }
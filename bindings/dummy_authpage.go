@@ -1,7 +1,6 @@
 package bindings
 
 import (
-	"errors"
 	"html/template"
 	"net/http"
 	"net/url"
@@ -11,10 +10,16 @@ import (
 	"github.com/openbolt/openid"
 )
 
-// BUG Implement 5.5.1.1.  Requesting the "acr" Claim
-func (ds *DummySource) Authpage(w http.ResponseWriter, r *http.Request) openid.AuthState {
+// Authpage only supports password logins, which have the acr "0". The
+// provider rejects requests which require a stronger acr.
+func (ds *DummySource) Authpage(w http.ResponseWriter, r *http.Request, hints openid.AuthHints) openid.AuthState {
 	var warn string
 
+	// No sessions here, so the End-User is never logged in
+	if hints.Prompt.None {
+		return openid.AuthState{}
+	}
+
 	// Was submit button pressed
 	if openid.GetParam(r, "_login") != "" {
 		sub, iss := dummyAuth(openid.GetParam(r, "_username"), openid.GetParam(r, "_password"))
@@ -96,26 +101,10 @@ func dummyAuth(user, pw string) (sub, iss string) {
 /*
  * Cacher
  */
-// BUG TODO: Locking
-var sessions map[string]openid.Session
-
 func (ds *DummySource) Cache(c openid.Session) error {
-	if sessions == nil {
-		sessions = make(map[string]openid.Session)
-	}
-	sessions[c.Code] = c
-	return nil
-}
-
-func (ds *DummySource) GetSession(code string) (openid.Session, error) {
-	s, ok := sessions[code]
-	if !ok {
-		return openid.Session{}, errors.New("Invalid code")
-	} else {
-		return s, nil
-	}
+	return dummyStore.Cache(c)
 }
 
-func (ds *DummySource) Retire(code string) {
-	// BUG Implement!
+func (ds *DummySource) Redeem(code string) (openid.Session, error) {
+	return dummyStore.Redeem(code)
 }
@@ -0,0 +1,324 @@
+package bindings
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/openbolt/openid"
+	"github.com/openbolt/openid/utils"
+)
+
+// After Config, call Init()
+
+// MinLookupKeySize is the minimum length of EncryptedStore.LookupKeys
+const MinLookupKeySize = 16
+
+// EncryptedStore is a decorator, which encrypts codes, SSO sessions, grants
+// and clients before they reach a RecordStore. It implements Cacher,
+// SessionStore, ConsentStore and ClientStore.
+//
+// The RecordStores only see envelopes: the HMAC of the id as lookup key, the
+// expiry and the sealed payload. A payload is bound to its lookup key, so
+// payloads can't be swapped between records.
+//
+// Keys can be rotated: new values are sealed with the newest key of Keys and
+// hashed with the first of LookupKeys. Older keys are only used for reading,
+// SSO sessions, grants and clients are re-encrypted with the newest keys when
+// read. Codes are short-lived, so old keys can be dropped after CodeLifetime,
+// or once all other records have been read.
+type EncryptedStore struct {
+	Keys *openid.Keyring
+	// HMAC keys for lookup keys, newest first
+	LookupKeys [][]byte
+
+	// Codes are kept this long, should be at least OpenID.CodeLifetime
+	CodeLifetime time.Duration
+	// SSO sessions are removed after this time, should match
+	// OpenID.SessionMaxAge
+	SessionMaxAge time.Duration
+
+	// Backing stores, each may be nil if not used. They may be the same
+	// store, each uses its own table.
+	Codes    RecordStore
+	Sessions RecordStore
+	Grants   RecordStore
+	Clients  RecordStore
+}
+
+// Init checks the configuration and applies the defaults
+func (e *EncryptedStore) Init() error {
+	if e.Keys == nil {
+		return errors.New("No Keys defined")
+	}
+	if len(e.LookupKeys) == 0 {
+		return errors.New("No LookupKeys defined")
+	}
+	for _, key := range e.LookupKeys {
+		if len(key) < MinLookupKeySize {
+			return errors.New("LookupKeys too short")
+		}
+	}
+	if e.CodeLifetime == 0 {
+		e.CodeLifetime = DefaultCodeRetention
+	}
+	if e.SessionMaxAge == 0 {
+		e.SessionMaxAge = openid.DefaultSessionMaxAge
+	}
+	return nil
+}
+
+// LookupKey returns the HMAC of `id` with the newest lookup key. `kind`
+// separates the key spaces, e.g. "code" or "sso".
+func (e *EncryptedStore) LookupKey(kind, id string) string {
+	return e.lookupKey(0, kind, id)
+}
+
+func (e *EncryptedStore) lookupKey(version int, kind, id string) string {
+	h := hmac.New(sha256.New, e.LookupKeys[version])
+	io.WriteString(h, kind+"\x00"+id)
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+// Seal returns `v` as JSON, sealed with the newest key and bound to `lookup`.
+// Together with Open and LookupKey, other stores can be encrypted the same
+// way.
+func (e *EncryptedStore) Seal(lookup string, v interface{}) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return e.Keys.Seal(data, []byte(lookup))
+}
+
+// Open reverses Seal. Returns true, if `sealed` should be re-encrypted, as it
+// isn't sealed with the newest key.
+func (e *EncryptedStore) Open(lookup, sealed string, v interface{}) (bool, error) {
+	data, err := e.Keys.Open(sealed, []byte(lookup))
+	if err != nil {
+		return false, err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return false, err
+	}
+	return !strings.HasPrefix(sealed, e.Keys.KeyID()+"."), nil
+}
+
+// record returns `v` sealed in a Record for `id` with the newest keys
+func (e *EncryptedStore) record(kind, id string, v interface{}, exp time.Time) (Record, error) {
+	lookup := e.LookupKey(kind, id)
+	sealed, err := e.Seal(lookup, v)
+	if err != nil {
+		return Record{}, err
+	}
+	return Record{Key: lookup, Data: sealed, Expires: exp}, nil
+}
+
+// get tries the lookup keys from newest to oldest and opens the record of
+// `id` into `v`. Records of older keys are re-encrypted with the record
+// returned by `seal`.
+func (e *EncryptedStore) get(rs RecordStore, kind, id string, v interface{}, seal func() (Record, error)) error {
+	var first error
+	for i := range e.LookupKeys {
+		lookup := e.lookupKey(i, kind, id)
+		rec, err := rs.GetRecord(kind, lookup)
+		if err != nil {
+			if i == 0 {
+				first = err
+			}
+			continue
+		}
+
+		stale, err := e.Open(lookup, rec.Data, v)
+		if err != nil {
+			return err
+		}
+		if stale || i > 0 {
+			e.reencrypt(rs, kind, rec, i > 0, seal)
+		}
+		return nil
+	}
+	return first
+}
+
+// reencrypt stores the record `old` with the newest keys. It never writes
+// over a record, which was saved or deleted meanwhile:
+//   - With the same lookup key, the data is only replaced, if it is unchanged.
+//   - With a new lookup key, the copy is added, so a newer record is kept.
+//     Deletes remove the old record before the new one, see deleteAll. If the
+//     old record is gone after adding the copy, a delete ran meanwhile and
+//     the copy is removed again. Otherwise the old record is removed.
+//
+// Failures are only logged, the old record stays readable.
+func (e *EncryptedStore) reencrypt(rs RecordStore, kind string, old Record, moved bool, seal func() (Record, error)) {
+	rec, err := seal()
+	if err == nil && !moved {
+		err = rs.ReplaceRecord(kind, rec.Key, old.Data, rec.Data)
+	} else if err == nil {
+		err = rs.AddRecord(kind, rec)
+	}
+	if err != nil {
+		utils.ELog(errors.New("Re-encrypting "+kind+" record: "+err.Error()), nil)
+		return
+	}
+	if !moved {
+		return
+	}
+
+	if _, err := rs.GetRecord(kind, old.Key); err != nil {
+		err = rs.DeleteRecord(kind, rec.Key)
+	} else {
+		err = rs.DeleteRecord(kind, old.Key)
+	}
+	if err != nil {
+		utils.ELog(errors.New("Removing re-encrypted "+kind+" record: "+err.Error()), nil)
+	}
+}
+
+// deleteAll removes the records of `id` of all lookup keys, from oldest to
+// newest, see reencrypt
+func (e *EncryptedStore) deleteAll(rs RecordStore, kind, id string) error {
+	var first error
+	for i := len(e.LookupKeys) - 1; i >= 0; i-- {
+		if err := rs.DeleteRecord(kind, e.lookupKey(i, kind, id)); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+/*
+ * Cacher
+ */
+func (e *EncryptedStore) Cache(val openid.Session) error {
+	rec, err := e.record("code", val.Code, val, time.Now().Add(e.CodeLifetime))
+	if err != nil {
+		return err
+	}
+	return e.Codes.AddRecord("code", rec)
+}
+
+// Redeem tries the lookup keys from newest to oldest, as codes are
+// redeemed once, they aren't re-encrypted. On reuse, the session is returned
+// with openid.ErrCodeRedeemed, if the RecordStore still has it.
+func (e *EncryptedStore) Redeem(code string) (openid.Session, error) {
+	var first error
+	for i := range e.LookupKeys {
+		lookup := e.lookupKey(i, "code", code)
+		rec, err := e.Codes.TakeRecord("code", lookup)
+		if err != nil && err != openid.ErrCodeRedeemed {
+			if i == 0 {
+				first = err
+			}
+			continue
+		}
+
+		// Reuse is reported, even if the session can't be opened
+		var ses openid.Session
+		if _, oerr := e.Open(lookup, rec.Data, &ses); oerr != nil {
+			if err == nil {
+				err = oerr
+			}
+			return openid.Session{}, err
+		}
+		return ses, err
+	}
+	return openid.Session{}, first
+}
+
+/*
+ * SessionStore
+ */
+func (e *EncryptedStore) SaveSSOSession(s openid.SSOSession) error {
+	rec, err := e.ssoRecord(s)
+	if err != nil {
+		return err
+	}
+	return e.Sessions.PutRecord("sso", rec)
+}
+
+func (e *EncryptedStore) ssoRecord(s openid.SSOSession) (Record, error) {
+	return e.record("sso", s.ID, s, s.Created.Add(e.SessionMaxAge))
+}
+
+func (e *EncryptedStore) GetSSOSession(id string) (openid.SSOSession, error) {
+	var s openid.SSOSession
+	err := e.get(e.Sessions, "sso", id, &s, func() (Record, error) {
+		return e.ssoRecord(s)
+	})
+	return s, err
+}
+
+func (e *EncryptedStore) DeleteSSOSession(id string) error {
+	return e.deleteAll(e.Sessions, "sso", id)
+}
+
+/*
+ * ConsentStore
+ */
+
+// Grants are grouped by the HMAC of the client, so DeleteGrants doesn't need
+// the subjects
+func (e *EncryptedStore) SaveGrant(g openid.Grant) error {
+	rec, err := e.grantRecord(g)
+	if err != nil {
+		return err
+	}
+	return e.Grants.PutRecord("grant", rec)
+}
+
+func (e *EncryptedStore) grantRecord(g openid.Grant) (Record, error) {
+	rec, err := e.record("grant", grantKey(g.Sub, g.ClientID), g, time.Time{})
+	rec.Group = e.LookupKey("grant-client", g.ClientID)
+	return rec, err
+}
+
+func (e *EncryptedStore) GetGrant(sub, clientID string) (openid.Grant, error) {
+	var g openid.Grant
+	err := e.get(e.Grants, "grant", grantKey(sub, clientID), &g, func() (Record, error) {
+		return e.grantRecord(g)
+	})
+	return g, err
+}
+
+// DeleteGrants removes the groups from oldest to newest, like deleteAll
+func (e *EncryptedStore) DeleteGrants(clientID string) error {
+	var first error
+	for i := len(e.LookupKeys) - 1; i >= 0; i-- {
+		if err := e.Grants.DeleteGroup("grant", e.lookupKey(i, "grant-client", clientID)); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+/*
+ * ClientStore
+ */
+
+// Clients are sealed as a whole, including SecretHash and
+// RegistrationTokenHash
+func (e *EncryptedStore) SaveClient(clt openid.Client) error {
+	rec, err := e.record("client", clt.ClientID, clt, time.Time{})
+	if err != nil {
+		return err
+	}
+	return e.Clients.PutRecord("client", rec)
+}
+
+func (e *EncryptedStore) GetClient(id string) (openid.Client, error) {
+	var clt openid.Client
+	err := e.get(e.Clients, "client", id, &clt, func() (Record, error) {
+		return e.record("client", clt.ClientID, clt, time.Time{})
+	})
+	return clt, err
+}
+
+func (e *EncryptedStore) DeleteClient(id string) error {
+	return e.deleteAll(e.Clients, "client", id)
+}
@@ -0,0 +1,342 @@
+package bindings
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/openbolt/openid"
+	"github.com/openbolt/openid/bindings/storetest"
+)
+
+func newTestEncryptedStore(t *testing.T, rs RecordStore) *EncryptedStore {
+	key, _ := openid.NewKey()
+	keys, err := openid.NewKeyring(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := &EncryptedStore{
+		Keys:       keys,
+		LookupKeys: [][]byte{[]byte("lookup key version 1")},
+		Codes:      rs,
+		Sessions:   rs,
+		Grants:     rs,
+		Clients:    rs,
+	}
+	if err := e.Init(); err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+// A dump of the database must not contain any of the stored values
+func TestEncryptedStoreDump(t *testing.T) {
+	s, done := newTestSQLite(t, time.Minute)
+	defer done()
+	e := newTestEncryptedStore(t, s)
+
+	ses := openid.Session{
+		Code:      "secret-code",
+		ClientID:  "secret-client",
+		Sub:       "secret-sub",
+		Nonce:     "secret-nonce",
+		Scope:     "openid secret-scope",
+		ExpiresAt: time.Now().Add(time.Minute),
+	}
+	if err := e.Cache(ses); err != nil {
+		t.Fatal(err)
+	}
+	sso := openid.SSOSession{ID: "secret-id", Sid: "secret-sid", Sub: "secret-sub", Created: time.Now()}
+	if err := e.SaveSSOSession(sso); err != nil {
+		t.Fatal(err)
+	}
+	grant := openid.Grant{Sub: "secret-sub", ClientID: "secret-client", Scopes: []string{"secret-scope"}}
+	if err := e.SaveGrant(grant); err != nil {
+		t.Fatal(err)
+	}
+	clt := openid.Client{ClientID: "secret-client", SecretHash: "secret-hash", RegistrationTokenHash: "secret-token"}
+	if err := e.SaveClient(clt); err != nil {
+		t.Fatal(err)
+	}
+
+	var dump []string
+	rows, err := s.db.Query("SELECT * FROM openid_records")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cols, _ := rows.Columns()
+	for rows.Next() {
+		vals := make([]interface{}, len(cols))
+		ptrs := make([]interface{}, len(cols))
+		for i := range vals {
+			ptrs[i] = &vals[i]
+		}
+		rows.Scan(ptrs...)
+		dump = append(dump, fmt.Sprintf("%s", vals))
+	}
+	rows.Close()
+	if len(dump) != 4 {
+		t.Fatalf("expected 4 rows, got %v", dump)
+	}
+	if all := strings.Join(dump, "\n"); strings.Contains(all, "secret") {
+		t.Errorf("plaintext in dump:\n%s", all)
+	}
+
+	// Values are still usable through the decorator
+	if got, err := e.Redeem("secret-code"); err != nil || got.Nonce != ses.Nonce {
+		t.Errorf("expected session, got %+v %v", got, err)
+	}
+	if got, err := e.Redeem("secret-code"); err != openid.ErrCodeRedeemed || got.Nonce != ses.Nonce {
+		t.Errorf("expected ErrCodeRedeemed with the session, got %+v %v", got, err)
+	}
+	if got, err := e.GetSSOSession("secret-id"); err != nil || got.Sid != sso.Sid {
+		t.Errorf("expected SSO session, got %+v %v", got, err)
+	}
+	if got, err := e.GetGrant("secret-sub", "secret-client"); err != nil || !got.Covers(grant.Scopes, nil) {
+		t.Errorf("expected grant, got %+v %v", got, err)
+	}
+	if got, err := e.GetClient("secret-client"); err != nil || got.SecretHash != clt.SecretHash {
+		t.Errorf("expected client, got %+v %v", got, err)
+	}
+}
+
+func TestEncryptedStoreRotation(t *testing.T) {
+	m := &MemoryStore{}
+	defer m.Close()
+	e := newTestEncryptedStore(t, m)
+	oldKey := e.Keys.KeyID()
+	oldLookup := e.LookupKey("sso", "sid1")
+
+	e.Cache(openid.Session{Code: "code1", Nonce: "n1"})
+	e.SaveSSOSession(openid.SSOSession{ID: "sid1", Sub: "alice", Created: time.Now()})
+	e.SaveGrant(openid.Grant{Sub: "alice", ClientID: "clt1", Scopes: []string{"openid"}})
+	e.SaveClient(openid.Client{ClientID: "clt1", SecretHash: "hash"})
+
+	// Rotate both keys
+	next, _ := openid.NewKey()
+	e.Keys.Rotate(next)
+	e.LookupKeys = append([][]byte{[]byte("lookup key version 2")}, e.LookupKeys...)
+
+	if ses, err := e.Redeem("code1"); err != nil || ses.Nonce != "n1" {
+		t.Errorf("code of old keys: %+v %v", ses, err)
+	}
+
+	// Records are moved to the new keys on read
+	if s, err := e.GetSSOSession("sid1"); err != nil || s.Sub != "alice" {
+		t.Fatalf("session of old keys: %+v %v", s, err)
+	}
+	if _, err := m.GetRecord("sso", oldLookup); err == nil {
+		t.Error("old record not removed")
+	}
+	rec, err := m.GetRecord("sso", e.LookupKey("sso", "sid1"))
+	if err != nil || !strings.HasPrefix(rec.Data, next.ID+".") {
+		t.Errorf("expected record sealed with %s, got %+v %v", next.ID, rec, err)
+	}
+	if g, err := e.GetGrant("alice", "clt1"); err != nil || len(g.Scopes) != 1 {
+		t.Errorf("grant of old keys: %+v %v", g, err)
+	}
+	if clt, err := e.GetClient("clt1"); err != nil || clt.SecretHash != "hash" {
+		t.Errorf("client of old keys: %+v %v", clt, err)
+	}
+
+	// So the old keys can be dropped
+	e.Keys.Retire(oldKey)
+	e.LookupKeys = e.LookupKeys[:1]
+	if s, err := e.GetSSOSession("sid1"); err != nil || s.Sub != "alice" {
+		t.Errorf("session after retiring old keys: %+v %v", s, err)
+	}
+	if _, err := e.GetGrant("alice", "clt1"); err != nil {
+		t.Errorf("grant after retiring old keys: %v", err)
+	}
+	if _, err := e.GetClient("clt1"); err != nil {
+		t.Errorf("client after retiring old keys: %v", err)
+	}
+
+	if err := e.DeleteSSOSession("sid1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.GetSSOSession("sid1"); err == nil {
+		t.Error("session not deleted")
+	}
+	if err := e.DeleteGrants("clt1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.GetGrant("alice", "clt1"); err == nil {
+		t.Error("grant not deleted")
+	}
+}
+
+// hookStore runs `hook` before and after each write of a re-encryption
+type hookStore struct {
+	RecordStore
+	hook func(after bool)
+}
+
+func (h *hookStore) AddRecord(table string, rec Record) error {
+	h.hook(false)
+	defer h.hook(true)
+	return h.RecordStore.AddRecord(table, rec)
+}
+
+func (h *hookStore) PutRecord(table string, rec Record) error {
+	h.hook(false)
+	defer h.hook(true)
+	return h.RecordStore.PutRecord(table, rec)
+}
+
+func (h *hookStore) ReplaceRecord(table, key, old, data string) error {
+	h.hook(false)
+	defer h.hook(true)
+	return h.RecordStore.ReplaceRecord(table, key, old, data)
+}
+
+// Re-encryption on read never brings back a record, which is deleted
+// meanwhile
+func TestEncryptedStoreRotationDelete(t *testing.T) {
+	for _, moveLookup := range []bool{false, true} {
+		for _, after := range []bool{false, true} {
+			m := &MemoryStore{}
+			h := &hookStore{RecordStore: m, hook: func(bool) {}}
+			e := newTestEncryptedStore(t, h)
+			e.SaveSSOSession(openid.SSOSession{ID: "sid1", Sub: "alice", Created: time.Now()})
+			e.SaveGrant(openid.Grant{Sub: "alice", ClientID: "clt1", Scopes: []string{"openid"}})
+
+			next, _ := openid.NewKey()
+			e.Keys.Rotate(next)
+			if moveLookup {
+				e.LookupKeys = append([][]byte{[]byte("lookup key version 2")}, e.LookupKeys...)
+			}
+
+			// Delete while the record is re-encrypted
+			var del func() error
+			h.hook = func(a bool) {
+				if a == after && del != nil {
+					del()
+					del = nil
+				}
+			}
+			del = func() error { return e.DeleteSSOSession("sid1") }
+			e.GetSSOSession("sid1")
+			del = func() error { return e.DeleteGrants("clt1") }
+			e.GetGrant("alice", "clt1")
+
+			h.hook = func(bool) {}
+			if s, err := e.GetSSOSession("sid1"); err == nil {
+				t.Errorf("moved lookup %v, delete after write %v: deleted session came back: %+v", moveLookup, after, s)
+			}
+			if g, err := e.GetGrant("alice", "clt1"); err == nil {
+				t.Errorf("moved lookup %v, delete after write %v: deleted grant came back: %+v", moveLookup, after, g)
+			}
+			m.Close()
+		}
+	}
+}
+
+// Concurrent reads and deletes after a rotation
+func TestEncryptedStoreRotationDeleteConcurrent(t *testing.T) {
+	for _, moveLookup := range []bool{false, true} {
+		m := &MemoryStore{}
+		e := newTestEncryptedStore(t, m)
+		const n = 200
+		for i := 0; i < n; i++ {
+			id := fmt.Sprint("sid", i)
+			e.SaveSSOSession(openid.SSOSession{ID: id, Sub: "alice", Created: time.Now()})
+			e.SaveGrant(openid.Grant{Sub: "alice", ClientID: fmt.Sprint("clt", i), Scopes: []string{"openid"}})
+		}
+
+		next, _ := openid.NewKey()
+		e.Keys.Rotate(next)
+		if moveLookup {
+			e.LookupKeys = append([][]byte{[]byte("lookup key version 2")}, e.LookupKeys...)
+		}
+
+		var wg sync.WaitGroup
+		for i := 0; i < n; i++ {
+			id, clientID := fmt.Sprint("sid", i), fmt.Sprint("clt", i)
+			wg.Add(4)
+			go func() {
+				defer wg.Done()
+				e.GetSSOSession(id)
+			}()
+			go func() {
+				defer wg.Done()
+				e.DeleteSSOSession(id)
+			}()
+			go func() {
+				defer wg.Done()
+				e.GetGrant("alice", clientID)
+			}()
+			go func() {
+				defer wg.Done()
+				e.DeleteGrants(clientID)
+			}()
+		}
+		wg.Wait()
+
+		for i := 0; i < n; i++ {
+			if s, err := e.GetSSOSession(fmt.Sprint("sid", i)); err == nil {
+				t.Errorf("moved lookup %v: deleted session came back: %+v", moveLookup, s)
+			}
+			if g, err := e.GetGrant("alice", fmt.Sprint("clt", i)); err == nil {
+				t.Errorf("moved lookup %v: deleted grant came back: %+v", moveLookup, g)
+			}
+		}
+		m.Close()
+	}
+}
+
+// Payloads are bound to their record
+func TestEncryptedStoreSwap(t *testing.T) {
+	m := &MemoryStore{}
+	defer m.Close()
+	e := newTestEncryptedStore(t, m)
+
+	e.SaveSSOSession(openid.SSOSession{ID: "victim", Sub: "alice", Created: time.Now()})
+	e.SaveSSOSession(openid.SSOSession{ID: "attacker", Sub: "mallory", Created: time.Now()})
+	victim, _ := m.GetRecord("sso", e.LookupKey("sso", "victim"))
+	attacker, _ := m.GetRecord("sso", e.LookupKey("sso", "attacker"))
+	attacker.Data = victim.Data
+	m.PutRecord("sso", attacker)
+
+	if s, err := e.GetSSOSession("attacker"); err == nil {
+		t.Errorf("swapped payload accepted: %+v", s)
+	}
+}
+
+func TestEncryptedStoreConformance(t *testing.T) {
+	var (
+		_ openid.Cacher       = (*EncryptedStore)(nil)
+		_ openid.SessionStore = (*EncryptedStore)(nil)
+		_ openid.ConsentStore = (*EncryptedStore)(nil)
+		_ openid.ClientStore  = (*EncryptedStore)(nil)
+	)
+
+	storetest.RunCacherTests(t, func(t *testing.T, lifetime time.Duration) storetest.CacherSetup {
+		m := &MemoryStore{}
+		e := newTestEncryptedStore(t, m)
+		e.CodeLifetime = lifetime
+		return storetest.CacherSetup{Cacher: e, Close: m.Close}
+	})
+	storetest.RunSessionStoreTests(t, func(t *testing.T, maxAge time.Duration) (openid.SessionStore, func()) {
+		m := &MemoryStore{}
+		e := newTestEncryptedStore(t, m)
+		e.SessionMaxAge = maxAge
+		return e, m.Close
+	})
+	storetest.RunConsentStoreTests(t, func(t *testing.T) (openid.ConsentStore, func()) {
+		m := &MemoryStore{}
+		return newTestEncryptedStore(t, m), m.Close
+	})
+	storetest.RunClientsourceTests(t, func(t *testing.T, clients []openid.Client) (openid.Clientsource, func()) {
+		m := &MemoryStore{}
+		e := newTestEncryptedStore(t, m)
+		for _, c := range clients {
+			if err := e.SaveClient(c); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return e, m.Close
+	})
+}
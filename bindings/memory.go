@@ -0,0 +1,507 @@
+package bindings
+
+import (
+	"errors"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/openbolt/openid"
+)
+
+const (
+	// DefaultMemoryShards is used, if MemoryStore.Shards isn't set
+	DefaultMemoryShards = 32
+	// DefaultJanitorInterval is used, if MemoryStore.JanitorInterval isn't set
+	DefaultJanitorInterval = time.Minute
+)
+
+// MemoryStore keeps all data in RAM and is safe for concurrent use. It
+// implements Cacher, Claimsource, ClientStore, ConsentStore, SessionStore,
+// RevocationStore, ReplayCache and RecordStore.
+//
+// Entries are spread over shards, each with its own lock. Expired entries are
+// invisible at once and removed by a background janitor. The zero value is
+// ready to use, call Close() to stop the janitor.
+type MemoryStore struct {
+	// Number of shards per table
+	Shards int
+	// Codes are kept this long, should be at least OpenID.CodeLifetime
+	CodeLifetime time.Duration
+	// SSO sessions are removed after this time, should match
+	// OpenID.SessionMaxAge
+	SessionMaxAge time.Duration
+	// How often expired entries are removed
+	JanitorInterval time.Duration
+
+	once        sync.Once
+	stop        chan struct{}
+	wg          sync.WaitGroup
+	codes       *memTable
+	clients     *memTable
+	users       *memTable
+	grants      *memTable
+	sessions    *memTable
+	revocations *memTable
+	// Revoked code hashes
+	codeRevocations *memTable
+	jtis            *memTable
+	// Records of all tables, keyed by table and key
+	records *memTable
+}
+
+// memCode is a pending code. Redeemed codes are kept until they expire, so a
+// second redemption can be detected.
+type memCode struct {
+	session openid.Session
+	retired bool
+}
+
+// memRecord is a record of a RecordStore table. Taken records are kept until
+// they expire, like redeemed codes.
+type memRecord struct {
+	table string
+	rec   Record
+	taken bool
+}
+
+// Init applies the defaults and starts the janitor. It is called on first use,
+// if not called explicitly.
+func (m *MemoryStore) Init() error {
+	m.once.Do(func() {
+		if m.Shards <= 0 {
+			m.Shards = DefaultMemoryShards
+		}
+		if m.CodeLifetime == 0 {
+			m.CodeLifetime = DefaultCodeRetention
+		}
+		if m.SessionMaxAge == 0 {
+			m.SessionMaxAge = openid.DefaultSessionMaxAge
+		}
+		if m.JanitorInterval == 0 {
+			m.JanitorInterval = DefaultJanitorInterval
+		}
+
+		m.codes = newMemTable(m.Shards)
+		m.clients = newMemTable(m.Shards)
+		m.users = newMemTable(m.Shards)
+		m.grants = newMemTable(m.Shards)
+		m.sessions = newMemTable(m.Shards)
+		m.revocations = newMemTable(m.Shards)
+		m.codeRevocations = newMemTable(m.Shards)
+		m.jtis = newMemTable(m.Shards)
+		m.records = newMemTable(m.Shards)
+
+		m.stop = make(chan struct{})
+		m.wg.Add(1)
+		go m.janitor()
+	})
+	return nil
+}
+
+// Close stops the janitor
+func (m *MemoryStore) Close() {
+	m.Init()
+	select {
+	case <-m.stop:
+	default:
+		close(m.stop)
+	}
+	m.wg.Wait()
+}
+
+func (m *MemoryStore) janitor() {
+	defer m.wg.Done()
+	t := time.NewTicker(m.JanitorInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			m.Evict()
+		case <-m.stop:
+			return
+		}
+	}
+}
+
+// Evict removes all expired entries and returns their number. It is called
+// periodically by the janitor.
+func (m *MemoryStore) Evict() int {
+	m.Init()
+	now := time.Now()
+	n := 0
+	for _, t := range []*memTable{m.codes, m.sessions, m.codeRevocations, m.jtis, m.records} {
+		n += t.evict(now)
+	}
+	return n
+}
+
+/*
+ * Cacher
+ */
+func (m *MemoryStore) Cache(val openid.Session) error {
+	m.Init()
+	if !m.codes.setNX(val.Code, memCode{session: val}, time.Now().Add(m.CodeLifetime)) {
+		return errors.New("Code already cached")
+	}
+	return nil
+}
+
+func (m *MemoryStore) Redeem(code string) (openid.Session, error) {
+	m.Init()
+	var ses openid.Session
+	var err error
+	m.codes.update(code, func(v interface{}, ok bool) (interface{}, bool) {
+		if !ok {
+			err = errors.New("Invalid code")
+			return nil, false
+		}
+		c := v.(memCode)
+		ses = c.session
+		if c.retired {
+			err = openid.ErrCodeRedeemed
+			return nil, false
+		}
+		c.retired = true
+		return c, true
+	})
+	return ses, err
+}
+
+/*
+ * Claimsource
+ */
+func (m *MemoryStore) Get(id, claim, def string) (string, bool) {
+	m.Init()
+	v, ok := m.users.get(id)
+	if !ok {
+		return def, false
+	}
+	val, ok := v.(map[string]string)[claim]
+	if !ok {
+		return def, false
+	}
+	return val, true
+}
+
+// SaveUser stores the claims of a subject
+func (m *MemoryStore) SaveUser(sub string, claims map[string]string) error {
+	m.Init()
+	cp := make(map[string]string, len(claims))
+	for k, v := range claims {
+		cp[k] = v
+	}
+	m.users.set(sub, cp, time.Time{})
+	return nil
+}
+
+/*
+ * ClientStore
+ */
+func (m *MemoryStore) GetClient(id string) (openid.Client, error) {
+	m.Init()
+	v, ok := m.clients.get(id)
+	if !ok {
+		return openid.Client{}, errors.New("No such client")
+	}
+	return v.(openid.Client), nil
+}
+
+func (m *MemoryStore) SaveClient(clt openid.Client) error {
+	m.Init()
+	m.clients.set(clt.ClientID, clt, time.Time{})
+	return nil
+}
+
+func (m *MemoryStore) DeleteClient(id string) error {
+	m.Init()
+	m.clients.del(id)
+	return nil
+}
+
+/*
+ * ConsentStore
+ */
+func (m *MemoryStore) GetGrant(sub, clientID string) (openid.Grant, error) {
+	m.Init()
+	v, ok := m.grants.get(grantKey(sub, clientID))
+	if !ok {
+		return openid.Grant{}, errors.New("Nothing granted")
+	}
+	return v.(openid.Grant), nil
+}
+
+func (m *MemoryStore) SaveGrant(g openid.Grant) error {
+	m.Init()
+	m.grants.set(grantKey(g.Sub, g.ClientID), g, time.Time{})
+	return nil
+}
+
+func (m *MemoryStore) DeleteGrants(clientID string) error {
+	m.Init()
+	m.grants.deleteIf(func(v interface{}) bool {
+		return v.(openid.Grant).ClientID == clientID
+	})
+	return nil
+}
+
+/*
+ * SessionStore
+ */
+func (m *MemoryStore) SaveSSOSession(s openid.SSOSession) error {
+	m.Init()
+	m.sessions.set(s.ID, s, s.Created.Add(m.SessionMaxAge))
+	return nil
+}
+
+func (m *MemoryStore) GetSSOSession(id string) (openid.SSOSession, error) {
+	m.Init()
+	v, ok := m.sessions.get(id)
+	if !ok {
+		return openid.SSOSession{}, errors.New("No such session")
+	}
+	return v.(openid.SSOSession), nil
+}
+
+func (m *MemoryStore) DeleteSSOSession(id string) error {
+	m.Init()
+	m.sessions.del(id)
+	return nil
+}
+
+/*
+ * RevocationStore
+ */
+func (m *MemoryStore) Revoke(clientID string, t time.Time) error {
+	m.Init()
+	m.revocations.set(clientID, t, time.Time{})
+	return nil
+}
+
+func (m *MemoryStore) RevokedBefore(clientID string) time.Time {
+	m.Init()
+	v, ok := m.revocations.get(clientID)
+	if !ok {
+		return time.Time{}
+	}
+	return v.(time.Time)
+}
+
+func (m *MemoryStore) RevokeCode(codeHash string, exp time.Time) error {
+	m.Init()
+	m.codeRevocations.set(codeHash, struct{}{}, exp)
+	return nil
+}
+
+func (m *MemoryStore) CodeRevoked(codeHash string) bool {
+	m.Init()
+	_, ok := m.codeRevocations.get(codeHash)
+	return ok
+}
+
+/*
+ * ReplayCache
+ */
+func (m *MemoryStore) Use(id string, exp time.Time) (bool, error) {
+	m.Init()
+	return m.jtis.setNX(id, struct{}{}, exp), nil
+}
+
+/*
+ * RecordStore
+ */
+func (m *MemoryStore) AddRecord(table string, rec Record) error {
+	m.Init()
+	if !m.records.setNX(table+"\x00"+rec.Key, memRecord{table: table, rec: rec}, rec.Expires) {
+		return errors.New("Record already exists")
+	}
+	return nil
+}
+
+func (m *MemoryStore) PutRecord(table string, rec Record) error {
+	m.Init()
+	m.records.set(table+"\x00"+rec.Key, memRecord{table: table, rec: rec}, rec.Expires)
+	return nil
+}
+
+func (m *MemoryStore) ReplaceRecord(table, key, old, data string) error {
+	m.Init()
+	replaced := false
+	m.records.update(table+"\x00"+key, func(v interface{}, ok bool) (interface{}, bool) {
+		if !ok || v.(memRecord).taken || v.(memRecord).rec.Data != old {
+			return nil, false
+		}
+		r := v.(memRecord)
+		r.rec.Data = data
+		replaced = true
+		return r, true
+	})
+	if !replaced {
+		return errors.New("Record changed")
+	}
+	return nil
+}
+
+func (m *MemoryStore) GetRecord(table, key string) (Record, error) {
+	m.Init()
+	v, ok := m.records.get(table + "\x00" + key)
+	if !ok || v.(memRecord).taken {
+		return Record{}, errors.New("No such record")
+	}
+	return v.(memRecord).rec, nil
+}
+
+func (m *MemoryStore) TakeRecord(table, key string) (Record, error) {
+	m.Init()
+	var rec Record
+	var err error
+	m.records.update(table+"\x00"+key, func(v interface{}, ok bool) (interface{}, bool) {
+		if !ok {
+			err = errors.New("No such record")
+			return nil, false
+		}
+		r := v.(memRecord)
+		rec = r.rec
+		if r.taken {
+			err = openid.ErrCodeRedeemed
+			return nil, false
+		}
+		r.taken = true
+		return r, true
+	})
+	return rec, err
+}
+
+func (m *MemoryStore) DeleteRecord(table, key string) error {
+	m.Init()
+	m.records.del(table + "\x00" + key)
+	return nil
+}
+
+func (m *MemoryStore) DeleteGroup(table, group string) error {
+	m.Init()
+	if group == "" {
+		return nil
+	}
+	m.records.deleteIf(func(v interface{}) bool {
+		r := v.(memRecord)
+		return r.table == table && r.rec.Group == group
+	})
+	return nil
+}
+
+/*
+ * Sharded map with expiry
+ */
+type memTable struct {
+	shards []*memShard
+}
+
+type memShard struct {
+	sync.RWMutex
+	items map[string]memItem
+}
+
+type memItem struct {
+	val interface{}
+	// Zero means never
+	expires time.Time
+}
+
+func (i memItem) expired(now time.Time) bool {
+	return !i.expires.IsZero() && !now.Before(i.expires)
+}
+
+func newMemTable(n int) *memTable {
+	t := &memTable{shards: make([]*memShard, n)}
+	for i := range t.shards {
+		t.shards[i] = &memShard{items: make(map[string]memItem)}
+	}
+	return t
+}
+
+func (t *memTable) shard(key string) *memShard {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return t.shards[h.Sum32()%uint32(len(t.shards))]
+}
+
+func (t *memTable) get(key string) (interface{}, bool) {
+	s := t.shard(key)
+	s.RLock()
+	i, ok := s.items[key]
+	s.RUnlock()
+	if !ok || i.expired(time.Now()) {
+		return nil, false
+	}
+	return i.val, true
+}
+
+func (t *memTable) set(key string, val interface{}, expires time.Time) {
+	s := t.shard(key)
+	s.Lock()
+	s.items[key] = memItem{val, expires}
+	s.Unlock()
+}
+
+// setNX sets `key` only, if it doesn't exist or has expired
+func (t *memTable) setNX(key string, val interface{}, expires time.Time) bool {
+	s := t.shard(key)
+	s.Lock()
+	defer s.Unlock()
+	if i, ok := s.items[key]; ok && !i.expired(time.Now()) {
+		return false
+	}
+	s.items[key] = memItem{val, expires}
+	return true
+}
+
+// update replaces the value of `key` with the result of `fn`, while holding
+// the lock. The expiry is kept. Nothing is changed, if `fn` returns false.
+func (t *memTable) update(key string, fn func(val interface{}, ok bool) (interface{}, bool)) {
+	s := t.shard(key)
+	s.Lock()
+	defer s.Unlock()
+	i, ok := s.items[key]
+	if ok && i.expired(time.Now()) {
+		ok = false
+	}
+	if val, change := fn(i.val, ok); change {
+		s.items[key] = memItem{val, i.expires}
+	}
+}
+
+func (t *memTable) del(key string) {
+	s := t.shard(key)
+	s.Lock()
+	delete(s.items, key)
+	s.Unlock()
+}
+
+func (t *memTable) deleteIf(fn func(val interface{}) bool) {
+	for _, s := range t.shards {
+		s.Lock()
+		for k, i := range s.items {
+			if fn(i.val) {
+				delete(s.items, k)
+			}
+		}
+		s.Unlock()
+	}
+}
+
+// evict removes expired items, one shard at a time
+func (t *memTable) evict(now time.Time) int {
+	n := 0
+	for _, s := range t.shards {
+		s.Lock()
+		for k, i := range s.items {
+			if i.expired(now) {
+				delete(s.items, k)
+				n++
+			}
+		}
+		s.Unlock()
+	}
+	return n
+}
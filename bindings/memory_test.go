@@ -0,0 +1,131 @@
+package bindings
+
+import (
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/openbolt/openid"
+	"github.com/openbolt/openid/bindings/storetest"
+)
+
+func TestMemoryStoreJanitor(t *testing.T) {
+	m := &MemoryStore{CodeLifetime: time.Millisecond, JanitorInterval: 5 * time.Millisecond}
+	defer m.Close()
+
+	for i := 0; i < 100; i++ {
+		m.Cache(openid.Session{Code: strconv.Itoa(i)})
+	}
+	if _, err := m.Redeem("0"); err != nil {
+		// Might have expired already on slow machines
+		t.Log(err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		n := 0
+		for _, s := range m.codes.shards {
+			s.RLock()
+			n += len(s.items)
+			s.RUnlock()
+		}
+		if n == 0 {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Error("expired codes not evicted")
+}
+
+// Compare a single lock with the default sharding
+func BenchmarkMemoryStore(b *testing.B) {
+	for _, shards := range []int{1, DefaultMemoryShards} {
+		b.Run(fmt.Sprintf("Redeem/shards=%d", shards), func(b *testing.B) {
+			m := &MemoryStore{Shards: shards}
+			defer m.Close()
+			var n int64
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					code := strconv.FormatInt(atomic.AddInt64(&n, 1), 10)
+					m.Cache(openid.Session{Code: code})
+					m.Redeem(code)
+					// Replay
+					m.Redeem(code)
+				}
+			})
+		})
+
+		b.Run(fmt.Sprintf("GetClient/shards=%d", shards), func(b *testing.B) {
+			m := &MemoryStore{Shards: shards}
+			defer m.Close()
+			for i := 0; i < 1000; i++ {
+				m.SaveClient(openid.Client{ClientID: "clt" + strconv.Itoa(i)})
+			}
+			var n int64
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					i := atomic.AddInt64(&n, 1)
+					if i%10 == 0 {
+						m.SaveClient(openid.Client{ClientID: "clt" + strconv.FormatInt(i%1000, 10)})
+					} else {
+						m.GetClient("clt" + strconv.FormatInt(i%1000, 10))
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestMemoryStoreConformance(t *testing.T) {
+	var (
+		_ openid.Cacher          = (*MemoryStore)(nil)
+		_ openid.Claimsource     = (*MemoryStore)(nil)
+		_ openid.ClientStore     = (*MemoryStore)(nil)
+		_ openid.ConsentStore    = (*MemoryStore)(nil)
+		_ openid.SessionStore    = (*MemoryStore)(nil)
+		_ openid.RevocationStore = (*MemoryStore)(nil)
+		_ openid.ReplayCache     = (*MemoryStore)(nil)
+		_ RecordStore            = (*MemoryStore)(nil)
+	)
+
+	storetest.RunCacherTests(t, func(t *testing.T, lifetime time.Duration) storetest.CacherSetup {
+		m := &MemoryStore{CodeLifetime: lifetime}
+		return storetest.CacherSetup{Cacher: m, Close: m.Close}
+	})
+	storetest.RunClientsourceTests(t, func(t *testing.T, clients []openid.Client) (openid.Clientsource, func()) {
+		m := &MemoryStore{}
+		for _, c := range clients {
+			m.SaveClient(c)
+		}
+		return m, m.Close
+	})
+	storetest.RunClaimsourceTests(t, func(t *testing.T, users map[string]map[string]string) (openid.Claimsource, func()) {
+		m := &MemoryStore{}
+		for sub, claims := range users {
+			m.SaveUser(sub, claims)
+		}
+		return m, m.Close
+	})
+	storetest.RunSessionStoreTests(t, func(t *testing.T, maxAge time.Duration) (openid.SessionStore, func()) {
+		m := &MemoryStore{SessionMaxAge: maxAge}
+		return m, m.Close
+	})
+	storetest.RunConsentStoreTests(t, func(t *testing.T) (openid.ConsentStore, func()) {
+		m := &MemoryStore{}
+		return m, m.Close
+	})
+	storetest.RunRevocationStoreTests(t, func(t *testing.T) (openid.RevocationStore, func()) {
+		m := &MemoryStore{}
+		return m, m.Close
+	})
+	storetest.RunReplayCacheTests(t, func(t *testing.T) storetest.ReplayCacheSetup {
+		m := &MemoryStore{}
+		return storetest.ReplayCacheSetup{Cache: m, Close: m.Close}
+	})
+	runRecordStoreTests(t, func(t *testing.T) (RecordStore, func()) {
+		m := &MemoryStore{}
+		return m, m.Close
+	})
+}
@@ -1,6 +1,9 @@
 package bindings
 
 import (
+	"errors"
+	"time"
+
 	"github.com/openbolt/openid"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
@@ -8,35 +11,524 @@ import (
 
 // After Config, call Init(), on exit call Close()
 
-// MongoDB is in MongoDB binding
+const (
+	// DefaultMongoTimeout is used for dialing and each operation, if
+	// MongoDB.Timeout isn't set
+	DefaultMongoTimeout = 10 * time.Second
+	// DefaultCodeRetention is how long bindings keep codes, if their
+	// CodeLifetime isn't set. It's the maximum code lifetime recommended by
+	// RFC 6749, so codes are kept at least as long as OpenID.CodeLifetime,
+	// which is checked by the provider.
+	DefaultCodeRetention = 10 * time.Minute
+)
+
+// MongoDB is in MongoDB binding. It implements Cacher, Claimsource,
+// ClientStore, ConsentStore, SessionStore, RevocationStore, ReplayCache and
+// RecordStore.
+//
+// Collections:
+//   - cache:           pending codes, removed by a TTL index after CodeLifetime
+//   - clients:         registered clients
+//   - users:           claims per subject, {_id: sub, claims: {name: value}}
+//   - grants:          consent per subject and client
+//   - sessions:        SSO sessions, removed by a TTL index after SessionMaxAge
+//   - revocations:     revoked clients
+//   - codeRevocations: revoked code hashes, removed by a TTL index
+//   - records:         records of all tables, removed by a TTL index
+//   - jti:             used one-time identifiers, removed by a TTL index
+//
+// mgo predates context.Context, so operations can't be cancelled per request.
+// Each operation is bounded by Timeout instead, which is used as dial, sync
+// and socket timeout.
 type MongoDB struct {
-	Host            string
-	DBName          string
-	CacheCollection string
-	db              *mgo.Session
+	Host   string
+	DBName string
+
+	// Collection names, defaults are set on Init()
+	CacheCollection           string
+	ClientsCollection         string
+	UsersCollection           string
+	GrantsCollection          string
+	SessionsCollection        string
+	RevocationsCollection     string
+	CodeRevocationsCollection string
+	RecordsCollection         string
+	JTIsCollection            string
+
+	// Timeout for dialing and each operation
+	Timeout time.Duration
+	// Codes are kept this long, should be at least OpenID.CodeLifetime
+	CodeLifetime time.Duration
+	// SSO sessions are removed after this time, should match
+	// OpenID.SessionMaxAge
+	SessionMaxAge time.Duration
+
+	db *mgo.Session
 }
 
 func (m *MongoDB) Init() (err error) {
-	m.db, err = mgo.Dial(m.Host)
+	if m.Timeout == 0 {
+		m.Timeout = DefaultMongoTimeout
+	}
+	if m.CodeLifetime == 0 {
+		m.CodeLifetime = DefaultCodeRetention
+	}
+	if m.SessionMaxAge == 0 {
+		m.SessionMaxAge = openid.DefaultSessionMaxAge
+	}
+	setDefault(&m.CacheCollection, "cache")
+	setDefault(&m.ClientsCollection, "clients")
+	setDefault(&m.UsersCollection, "users")
+	setDefault(&m.GrantsCollection, "grants")
+	setDefault(&m.SessionsCollection, "sessions")
+	setDefault(&m.RevocationsCollection, "revocations")
+	setDefault(&m.CodeRevocationsCollection, "codeRevocations")
+	setDefault(&m.RecordsCollection, "records")
+	setDefault(&m.JTIsCollection, "jti")
+
+	m.db, err = mgo.DialWithTimeout(m.Host, m.Timeout)
 	if err != nil {
 		return err
 	}
 
 	m.db.SetMode(mgo.Monotonic, true)
-	return err
+	m.db.SetSyncTimeout(m.Timeout)
+	m.db.SetSocketTimeout(m.Timeout)
+	return m.ensureIndexes()
 }
 
 func (m *MongoDB) Close() {
 	m.db.Close()
 }
 
+// ensureIndexes creates the TTL and lookup indexes
+func (m *MongoDB) ensureIndexes() error {
+	s := m.db.Copy()
+	defer s.Close()
+	db := s.DB(m.DBName)
+
+	// Documents are removed once `expireAt` has passed. The TTL monitor
+	// runs periodically, so expiry is checked on reads as well.
+	ttl := mgo.Index{Key: []string{"expireAt"}, ExpireAfter: time.Second}
+	if err := db.C(m.CacheCollection).EnsureIndex(ttl); err != nil {
+		return err
+	}
+	if err := db.C(m.SessionsCollection).EnsureIndex(ttl); err != nil {
+		return err
+	}
+	if err := db.C(m.CodeRevocationsCollection).EnsureIndex(ttl); err != nil {
+		return err
+	}
+	if err := db.C(m.RecordsCollection).EnsureIndex(ttl); err != nil {
+		return err
+	}
+	if err := db.C(m.JTIsCollection).EnsureIndex(ttl); err != nil {
+		return err
+	}
+	if err := db.C(m.RecordsCollection).EnsureIndexKey("table", "group"); err != nil {
+		return err
+	}
+	return db.C(m.GrantsCollection).EnsureIndexKey("clientId")
+}
+
+// c returns a collection on a copied session, which must be closed after use
+func (m *MongoDB) c(name string) (*mgo.Collection, func()) {
+	s := m.db.Copy()
+	return s.DB(m.DBName).C(name), s.Close
+}
+
+func setDefault(s *string, def string) {
+	if *s == "" {
+		*s = def
+	}
+}
+
 /*
- * Cacher
+ * Cacher
  */
+type mongoCode struct {
+	Code     string         `bson:"_id"`
+	Session  openid.Session `bson:"session"`
+	ExpireAt time.Time      `bson:"expireAt"`
+	Retired  bool           `bson:"retired"`
+}
+
 func (m *MongoDB) Cache(val openid.Session) error {
-	return m.db.DB(m.DBName).C(m.CacheCollection).Insert(val)
+	c, done := m.c(m.CacheCollection)
+	defer done()
+	return c.Insert(mongoCode{val.Code, val, time.Now().Add(m.CodeLifetime), false})
 }
 
-func (m *MongoDB) Retire(code string) {
-	m.db.DB(m.DBName).C(m.CacheCollection).RemoveAll(bson.M{"Code": code})
+// Redeem retires the code with findAndModify. Redeemed codes are kept until
+// they expire, so a replay can be detected.
+func (m *MongoDB) Redeem(code string) (openid.Session, error) {
+	c, done := m.c(m.CacheCollection)
+	defer done()
+
+	var doc mongoCode
+	query := bson.M{"_id": code, "retired": false, "expireAt": bson.M{"$gt": time.Now()}}
+	_, err := c.Find(query).Apply(mgo.Change{Update: bson.M{"$set": bson.M{"retired": true}}}, &doc)
+	if err == nil {
+		return doc.Session, nil
+	}
+	if err != mgo.ErrNotFound {
+		return openid.Session{}, err
+	}
+
+	// Tell apart why
+	if err := c.FindId(code).One(&doc); err != nil {
+		return openid.Session{}, errors.New("Invalid code")
+	}
+	if doc.Retired {
+		return doc.Session, openid.ErrCodeRedeemed
+	}
+	return openid.Session{}, errors.New("Code expired")
+}
+
+/*
+ * Claimsource
+ */
+type mongoUser struct {
+	Sub    string            `bson:"_id"`
+	Claims map[string]string `bson:"claims"`
+}
+
+func (m *MongoDB) Get(id, claim, def string) (string, bool) {
+	c, done := m.c(m.UsersCollection)
+	defer done()
+
+	var doc mongoUser
+	if err := c.FindId(id).One(&doc); err != nil {
+		return def, false
+	}
+	val, ok := doc.Claims[claim]
+	if !ok {
+		return def, false
+	}
+	return val, true
+}
+
+// SaveUser stores the claims of a subject
+func (m *MongoDB) SaveUser(sub string, claims map[string]string) error {
+	c, done := m.c(m.UsersCollection)
+	defer done()
+	_, err := c.UpsertId(sub, mongoUser{sub, claims})
+	return err
+}
+
+/*
+ * ClientStore
+ */
+type mongoClient struct {
+	ClientID string        `bson:"_id"`
+	Client   openid.Client `bson:"client"`
+}
+
+func (m *MongoDB) GetClient(id string) (openid.Client, error) {
+	c, done := m.c(m.ClientsCollection)
+	defer done()
+
+	var doc mongoClient
+	if err := c.FindId(id).One(&doc); err != nil {
+		return openid.Client{}, errors.New("No such client")
+	}
+	return doc.Client, nil
+}
+
+func (m *MongoDB) SaveClient(clt openid.Client) error {
+	c, done := m.c(m.ClientsCollection)
+	defer done()
+	_, err := c.UpsertId(clt.ClientID, mongoClient{clt.ClientID, clt})
+	return err
+}
+
+func (m *MongoDB) DeleteClient(id string) error {
+	c, done := m.c(m.ClientsCollection)
+	defer done()
+	if err := c.RemoveId(id); err != nil && err != mgo.ErrNotFound {
+		return err
+	}
+	return nil
+}
+
+/*
+ * ConsentStore
+ */
+type mongoGrant struct {
+	ID       string       `bson:"_id"`
+	ClientID string       `bson:"clientId"`
+	Grant    openid.Grant `bson:"grant"`
+}
+
+func (m *MongoDB) GetGrant(sub, clientID string) (openid.Grant, error) {
+	c, done := m.c(m.GrantsCollection)
+	defer done()
+
+	var doc mongoGrant
+	if err := c.FindId(sub + " " + clientID).One(&doc); err != nil {
+		return openid.Grant{}, errors.New("Nothing granted")
+	}
+	return doc.Grant, nil
+}
+
+func (m *MongoDB) SaveGrant(g openid.Grant) error {
+	c, done := m.c(m.GrantsCollection)
+	defer done()
+	id := g.Sub + " " + g.ClientID
+	_, err := c.UpsertId(id, mongoGrant{id, g.ClientID, g})
+	return err
+}
+
+func (m *MongoDB) DeleteGrants(clientID string) error {
+	c, done := m.c(m.GrantsCollection)
+	defer done()
+	_, err := c.RemoveAll(bson.M{"clientId": clientID})
+	return err
+}
+
+/*
+ * SessionStore
+ */
+type mongoSSOSession struct {
+	ID       string            `bson:"_id"`
+	Session  openid.SSOSession `bson:"session"`
+	ExpireAt time.Time         `bson:"expireAt"`
+}
+
+func (m *MongoDB) SaveSSOSession(s openid.SSOSession) error {
+	c, done := m.c(m.SessionsCollection)
+	defer done()
+	_, err := c.UpsertId(s.ID, mongoSSOSession{s.ID, s, s.Created.Add(m.SessionMaxAge)})
+	return err
+}
+
+func (m *MongoDB) GetSSOSession(id string) (openid.SSOSession, error) {
+	c, done := m.c(m.SessionsCollection)
+	defer done()
+
+	// The TTL monitor runs only once a minute
+	var doc mongoSSOSession
+	if err := c.FindId(id).One(&doc); err != nil || time.Now().After(doc.ExpireAt) {
+		return openid.SSOSession{}, errors.New("No such session")
+	}
+	return doc.Session, nil
+}
+
+func (m *MongoDB) DeleteSSOSession(id string) error {
+	c, done := m.c(m.SessionsCollection)
+	defer done()
+	if err := c.RemoveId(id); err != nil && err != mgo.ErrNotFound {
+		return err
+	}
+	return nil
+}
+
+/*
+ * RevocationStore
+ */
+type mongoRevocation struct {
+	ClientID string    `bson:"_id"`
+	Before   time.Time `bson:"before"`
+}
+
+func (m *MongoDB) Revoke(clientID string, t time.Time) error {
+	c, done := m.c(m.RevocationsCollection)
+	defer done()
+	_, err := c.UpsertId(clientID, mongoRevocation{clientID, t})
+	return err
+}
+
+func (m *MongoDB) RevokedBefore(clientID string) time.Time {
+	c, done := m.c(m.RevocationsCollection)
+	defer done()
+
+	var doc mongoRevocation
+	if err := c.FindId(clientID).One(&doc); err != nil {
+		return time.Time{}
+	}
+	return doc.Before
+}
+
+type mongoCodeRevocation struct {
+	CodeHash string    `bson:"_id"`
+	ExpireAt time.Time `bson:"expireAt"`
+}
+
+func (m *MongoDB) RevokeCode(codeHash string, exp time.Time) error {
+	c, done := m.c(m.CodeRevocationsCollection)
+	defer done()
+	_, err := c.UpsertId(codeHash, mongoCodeRevocation{codeHash, exp})
+	return err
+}
+
+func (m *MongoDB) CodeRevoked(codeHash string) bool {
+	c, done := m.c(m.CodeRevocationsCollection)
+	defer done()
+
+	var doc mongoCodeRevocation
+	if err := c.FindId(codeHash).One(&doc); err != nil {
+		return false
+	}
+	return time.Now().Before(doc.ExpireAt)
+}
+
+/*
+ * ReplayCache
+ */
+type mongoJTI struct {
+	ID       string    `bson:"_id"`
+	ExpireAt time.Time `bson:"expireAt"`
+}
+
+// Use inserts the identifier, a duplicate key means it was used before. An
+// expired identifier is removed first, the TTL monitor runs only once a
+// minute.
+func (m *MongoDB) Use(id string, exp time.Time) (bool, error) {
+	now := time.Now()
+	if !exp.After(now) {
+		// Expired identifiers must be rejected by the caller anyway
+		return true, nil
+	}
+
+	c, done := m.c(m.JTIsCollection)
+	defer done()
+	if _, err := c.RemoveAll(bson.M{"_id": id, "expireAt": bson.M{"$lte": now}}); err != nil {
+		return false, err
+	}
+	err := c.Insert(mongoJTI{id, exp})
+	if mgo.IsDup(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+/*
+ * RecordStore
+ */
+
+// mongoRecord is a record of a RecordStore table. Records without expiry have
+// no `expireAt`, so the TTL index ignores them.
+type mongoRecord struct {
+	ID       string    `bson:"_id"`
+	Table    string    `bson:"table"`
+	Key      string    `bson:"key"`
+	Group    string    `bson:"group"`
+	Data     string    `bson:"data"`
+	ExpireAt time.Time `bson:"expireAt,omitempty"`
+	Taken    bool      `bson:"taken"`
+}
+
+func newMongoRecord(table string, rec Record) mongoRecord {
+	return mongoRecord{table + ":" + rec.Key, table, rec.Key, rec.Group, rec.Data, rec.Expires, false}
+}
+
+func (r mongoRecord) expired(now time.Time) bool {
+	return !r.ExpireAt.IsZero() && now.After(r.ExpireAt)
+}
+
+func (r mongoRecord) record() Record {
+	return Record{Key: r.Key, Group: r.Group, Data: r.Data, Expires: r.ExpireAt}
+}
+
+// notExpired matches records without expiry or with expiry in the future
+func notExpired(now time.Time) bson.M {
+	return bson.M{"$or": []bson.M{{"expireAt": bson.M{"$exists": false}}, {"expireAt": bson.M{"$gt": now}}}}
+}
+
+// AddRecord removes an expired record first, the TTL monitor runs only once
+// a minute
+func (m *MongoDB) AddRecord(table string, rec Record) error {
+	c, done := m.c(m.RecordsCollection)
+	defer done()
+
+	doc := newMongoRecord(table, rec)
+	if _, err := c.RemoveAll(bson.M{"_id": doc.ID, "expireAt": bson.M{"$lte": time.Now()}}); err != nil {
+		return err
+	}
+	err := c.Insert(doc)
+	if mgo.IsDup(err) {
+		return errors.New("Record already exists")
+	}
+	return err
+}
+
+func (m *MongoDB) PutRecord(table string, rec Record) error {
+	c, done := m.c(m.RecordsCollection)
+	defer done()
+	doc := newMongoRecord(table, rec)
+	_, err := c.UpsertId(doc.ID, doc)
+	return err
+}
+
+func (m *MongoDB) ReplaceRecord(table, key, old, data string) error {
+	c, done := m.c(m.RecordsCollection)
+	defer done()
+
+	query := notExpired(time.Now())
+	query["_id"] = table + ":" + key
+	query["data"] = old
+	query["taken"] = false
+	err := c.Update(query, bson.M{"$set": bson.M{"data": data}})
+	if err == mgo.ErrNotFound {
+		return errors.New("Record changed")
+	}
+	return err
+}
+
+func (m *MongoDB) GetRecord(table, key string) (Record, error) {
+	c, done := m.c(m.RecordsCollection)
+	defer done()
+
+	var doc mongoRecord
+	if err := c.FindId(table + ":" + key).One(&doc); err != nil || doc.Taken || doc.expired(time.Now()) {
+		return Record{}, errors.New("No such record")
+	}
+	return doc.record(), nil
+}
+
+// TakeRecord marks the record as taken with findAndModify
+func (m *MongoDB) TakeRecord(table, key string) (Record, error) {
+	c, done := m.c(m.RecordsCollection)
+	defer done()
+
+	var doc mongoRecord
+	now := time.Now()
+	query := notExpired(now)
+	query["_id"] = table + ":" + key
+	query["taken"] = false
+	_, err := c.Find(query).Apply(mgo.Change{Update: bson.M{"$set": bson.M{"taken": true}}}, &doc)
+	if err == nil {
+		return doc.record(), nil
+	}
+	if err != mgo.ErrNotFound {
+		return Record{}, err
+	}
+
+	// Tell apart why
+	if err := c.FindId(table + ":" + key).One(&doc); err != nil || doc.expired(now) {
+		return Record{}, errors.New("No such record")
+	}
+	if doc.Taken {
+		return doc.record(), openid.ErrCodeRedeemed
+	}
+	return Record{}, errors.New("No such record")
+}
+
+func (m *MongoDB) DeleteRecord(table, key string) error {
+	c, done := m.c(m.RecordsCollection)
+	defer done()
+	if err := c.RemoveId(table + ":" + key); err != nil && err != mgo.ErrNotFound {
+		return err
+	}
+	return nil
+}
+
+func (m *MongoDB) DeleteGroup(table, group string) error {
+	if group == "" {
+		return nil
+	}
+	c, done := m.c(m.RecordsCollection)
+	defer done()
+	_, err := c.RemoveAll(bson.M{"table": table, "group": group})
+	return err
 }
@@ -0,0 +1,162 @@
+package bindings
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/openbolt/openid"
+	"github.com/openbolt/openid/bindings/storetest"
+)
+
+// startMongod runs a throwaway mongod from PATH. The test is skipped, if there
+// is none.
+func startMongod(t *testing.T) (string, func()) {
+	bin, err := exec.LookPath("mongod")
+	if err != nil {
+		t.Skip("mongod not found in PATH")
+	}
+
+	dir, err := ioutil.TempDir("", "openid-mongod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	cmd := exec.Command(bin, "--dbpath", dir, "--bind_ip", "127.0.0.1",
+		"--port", fmt.Sprint(port), "--setParameter", "ttlMonitorSleepSecs=1")
+	if err := cmd.Start(); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	stop := func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+		os.RemoveAll(dir)
+	}
+
+	addr := fmt.Sprintf("127.0.0.1:%d", port)
+	for i := 0; i < 100; i++ {
+		if c, err := net.Dial("tcp", addr); err == nil {
+			c.Close()
+			return addr, stop
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	stop()
+	t.Fatal("mongod did not start")
+	return "", nil
+}
+
+func newTestMongoDB(t *testing.T) (*MongoDB, func()) {
+	addr, stop := startMongod(t)
+	m := &MongoDB{Host: addr, DBName: "openid_test", Timeout: 5 * time.Second}
+	if err := m.Init(); err != nil {
+		stop()
+		t.Fatal(err)
+	}
+	return m, func() {
+		m.Close()
+		stop()
+	}
+}
+
+// The TTL monitor of mongod removes expired codes
+func TestMongoDBTTL(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for the TTL monitor")
+	}
+	m, done := newTestMongoDB(t)
+	defer done()
+
+	m.CodeLifetime = time.Millisecond
+	if err := m.Cache(openid.Session{Code: "code1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	c, close := m.c(m.CacheCollection)
+	defer close()
+	for i := 0; i < 100; i++ {
+		if n, _ := c.FindId("code1").Count(); n == 0 {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Error("expired code not removed")
+}
+
+func TestMongoDBConformance(t *testing.T) {
+	var (
+		_ openid.Cacher          = (*MongoDB)(nil)
+		_ openid.Claimsource     = (*MongoDB)(nil)
+		_ openid.ClientStore     = (*MongoDB)(nil)
+		_ openid.ConsentStore    = (*MongoDB)(nil)
+		_ openid.SessionStore    = (*MongoDB)(nil)
+		_ openid.RevocationStore = (*MongoDB)(nil)
+		_ openid.ReplayCache     = (*MongoDB)(nil)
+		_ RecordStore            = (*MongoDB)(nil)
+	)
+
+	addr, stop := startMongod(t)
+	defer stop()
+
+	n := 0
+	newDB := func(t *testing.T, lifetime time.Duration) (*MongoDB, func()) {
+		n++
+		m := &MongoDB{Host: addr, DBName: fmt.Sprintf("openid_test%d", n), CodeLifetime: lifetime}
+		if err := m.Init(); err != nil {
+			t.Fatal(err)
+		}
+		return m, m.Close
+	}
+
+	storetest.RunCacherTests(t, func(t *testing.T, lifetime time.Duration) storetest.CacherSetup {
+		m, done := newDB(t, lifetime)
+		return storetest.CacherSetup{Cacher: m, Close: done}
+	})
+	storetest.RunClientsourceTests(t, func(t *testing.T, clients []openid.Client) (openid.Clientsource, func()) {
+		m, done := newDB(t, 0)
+		for _, c := range clients {
+			if err := m.SaveClient(c); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return m, done
+	})
+	storetest.RunClaimsourceTests(t, func(t *testing.T, users map[string]map[string]string) (openid.Claimsource, func()) {
+		m, done := newDB(t, 0)
+		for sub, claims := range users {
+			if err := m.SaveUser(sub, claims); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return m, done
+	})
+	storetest.RunSessionStoreTests(t, func(t *testing.T, maxAge time.Duration) (openid.SessionStore, func()) {
+		m, done := newDB(t, 0)
+		m.SessionMaxAge = maxAge
+		return m, done
+	})
+	storetest.RunConsentStoreTests(t, func(t *testing.T) (openid.ConsentStore, func()) {
+		return newDB(t, 0)
+	})
+	storetest.RunRevocationStoreTests(t, func(t *testing.T) (openid.RevocationStore, func()) {
+		return newDB(t, 0)
+	})
+	storetest.RunReplayCacheTests(t, func(t *testing.T) storetest.ReplayCacheSetup {
+		m, done := newDB(t, 0)
+		return storetest.ReplayCacheSetup{Cache: m, Close: done}
+	})
+	runRecordStoreTests(t, func(t *testing.T) (RecordStore, func()) {
+		return newDB(t, 0)
+	})
+}
@@ -0,0 +1,39 @@
+package bindings
+
+import "time"
+
+// Record is an opaque envelope in a RecordStore, e.g. a sealed payload of
+// EncryptedStore
+type Record struct {
+	// Lookup key, e.g. the HMAC of an id
+	Key string
+	// Records of a group can be deleted at once, empty if not needed
+	Group string
+	// Opaque payload
+	Data string
+	// The record may be removed after this time, zero means never
+	Expires time.Time
+}
+
+// RecordStore is a byte-oriented store, so decorators like EncryptedStore
+// don't need fields for their envelopes in the core types. Tables are separate
+// key spaces. Expired records must be invisible, even before they are removed.
+type RecordStore interface {
+	// AddRecord fails, if the key is in use, even by a taken record
+	AddRecord(table string, rec Record) error
+	// PutRecord replaces a record with the same key
+	PutRecord(table string, rec Record) error
+	// ReplaceRecord sets the data of a record to `data`, only if it is still
+	// `old`. Group and expiry are kept. Fails, if the record was changed,
+	// deleted or taken.
+	ReplaceRecord(table, key, old, data string) error
+	// Returns an error, if there is no such record or it was taken
+	GetRecord(table, key string) (Record, error)
+	// TakeRecord returns the record and marks it as taken in one atomic step.
+	// Taken records are kept until they expire, TakeRecord returns
+	// openid.ErrCodeRedeemed for them, with the record if it is still known.
+	TakeRecord(table, key string) (Record, error)
+	DeleteRecord(table, key string) error
+	// DeleteGroup removes all records of a non-empty `group`
+	DeleteGroup(table, group string) error
+}
@@ -0,0 +1,191 @@
+package bindings
+
+import (
+	"testing"
+	"time"
+
+	"github.com/openbolt/openid"
+)
+
+// runRecordStoreTests checks the RecordStore of a binding. `factory` returns
+// an empty store, it is called once per test.
+func runRecordStoreTests(t *testing.T, factory func(t *testing.T) (RecordStore, func())) {
+	setup := func(t *testing.T) RecordStore {
+		rs, done := factory(t)
+		if done != nil {
+			t.Cleanup(done)
+		}
+		return rs
+	}
+	exp := time.Now().Add(time.Hour).Truncate(time.Millisecond)
+
+	t.Run("RecordRoundTrip", func(t *testing.T) {
+		rs := setup(t)
+		want := Record{Key: "k1", Group: "g1", Data: "data1", Expires: exp}
+		if err := rs.PutRecord("t1", want); err != nil {
+			t.Fatal(err)
+		}
+		got, err := rs.GetRecord("t1", "k1")
+		if err != nil || got.Key != want.Key || got.Group != want.Group || got.Data != want.Data || !got.Expires.Equal(want.Expires) {
+			t.Errorf("got %+v %v, want %+v", got, err, want)
+		}
+
+		want = Record{Key: "k1", Data: "data2"}
+		if err := rs.PutRecord("t1", want); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := rs.GetRecord("t1", "k1"); err != nil || got.Data != "data2" || !got.Expires.IsZero() {
+			t.Errorf("record not replaced: %+v %v", got, err)
+		}
+	})
+
+	t.Run("RecordTables", func(t *testing.T) {
+		rs := setup(t)
+		if err := rs.PutRecord("t1", Record{Key: "k1", Group: "g1", Data: "data1"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := rs.PutRecord("t2", Record{Key: "k1", Group: "g1", Data: "data2"}); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := rs.GetRecord("t1", "k1"); err != nil || got.Data != "data1" {
+			t.Errorf("got %+v %v", got, err)
+		}
+		for _, key := range []string{"", "k", "k10"} {
+			if got, err := rs.GetRecord("t1", key); err == nil {
+				t.Errorf("%q returned %+v", key, got)
+			}
+		}
+
+		if err := rs.DeleteRecord("t2", "k1"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := rs.GetRecord("t1", "k1"); err != nil {
+			t.Error("deleting a record deleted the record of another table")
+		}
+		if err := rs.DeleteGroup("t2", "g1"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := rs.GetRecord("t1", "k1"); err != nil {
+			t.Error("deleting a group deleted the group of another table")
+		}
+		if err := rs.DeleteRecord("t1", "unknown"); err != nil {
+			t.Error("deleting an unknown record:", err)
+		}
+	})
+
+	t.Run("RecordAdd", func(t *testing.T) {
+		rs := setup(t)
+		if err := rs.AddRecord("t1", Record{Key: "k1", Data: "data1", Expires: exp}); err != nil {
+			t.Fatal(err)
+		}
+		if err := rs.AddRecord("t1", Record{Key: "k1", Data: "data2", Expires: exp}); err == nil {
+			t.Error("record overwritten")
+		}
+		if _, err := rs.TakeRecord("t1", "k1"); err != nil {
+			t.Fatal(err)
+		}
+		if err := rs.AddRecord("t1", Record{Key: "k1", Data: "data2", Expires: exp}); err == nil {
+			t.Error("taken record overwritten")
+		}
+	})
+
+	t.Run("RecordReplace", func(t *testing.T) {
+		rs := setup(t)
+		if err := rs.PutRecord("t1", Record{Key: "k1", Group: "g1", Data: "data1", Expires: exp}); err != nil {
+			t.Fatal(err)
+		}
+		if err := rs.ReplaceRecord("t1", "k1", "data1", "data2"); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := rs.GetRecord("t1", "k1"); err != nil || got.Data != "data2" || got.Group != "g1" || !got.Expires.Equal(exp) {
+			t.Errorf("got %+v %v", got, err)
+		}
+		if err := rs.ReplaceRecord("t1", "k1", "data1", "data3"); err == nil {
+			t.Error("changed record replaced")
+		}
+
+		// Deleted and taken records stay gone
+		rs.DeleteRecord("t1", "k1")
+		if err := rs.ReplaceRecord("t1", "k1", "data2", "data3"); err == nil {
+			t.Error("deleted record replaced")
+		}
+		if _, err := rs.GetRecord("t1", "k1"); err == nil {
+			t.Error("deleted record came back")
+		}
+		rs.AddRecord("t1", Record{Key: "k2", Data: "data1", Expires: exp})
+		rs.TakeRecord("t1", "k2")
+		if err := rs.ReplaceRecord("t1", "k2", "data1", "data2"); err == nil {
+			t.Error("taken record replaced")
+		}
+	})
+
+	t.Run("RecordTake", func(t *testing.T) {
+		rs := setup(t)
+		if err := rs.AddRecord("t1", Record{Key: "k1", Data: "data1", Expires: exp}); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := rs.TakeRecord("t1", "k1"); err != nil || got.Data != "data1" {
+			t.Fatalf("got %+v %v", got, err)
+		}
+		// The record is kept, so the provider can revoke its tokens
+		if got, err := rs.TakeRecord("t1", "k1"); err != openid.ErrCodeRedeemed || got.Data != "data1" {
+			t.Errorf("expected ErrCodeRedeemed with the record, got %+v %v", got, err)
+		}
+		if _, err := rs.GetRecord("t1", "k1"); err == nil {
+			t.Error("taken record found")
+		}
+		if _, err := rs.TakeRecord("t1", "unknown"); err == nil || err == openid.ErrCodeRedeemed {
+			t.Errorf("expected unknown record, got %v", err)
+		}
+	})
+
+	t.Run("RecordExpiry", func(t *testing.T) {
+		rs := setup(t)
+		old := Record{Key: "k1", Data: "data1", Expires: time.Now().Add(-time.Second)}
+		if err := rs.PutRecord("t1", old); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := rs.GetRecord("t1", "k1"); err == nil {
+			t.Error("expired record found")
+		}
+		if _, err := rs.TakeRecord("t1", "k1"); err == nil || err == openid.ErrCodeRedeemed {
+			t.Errorf("expected unknown record, got %v", err)
+		}
+		if err := rs.AddRecord("t1", Record{Key: "k1", Data: "data2", Expires: exp}); err != nil {
+			t.Error("expired record not replaced:", err)
+		}
+	})
+
+	t.Run("DeleteGroup", func(t *testing.T) {
+		rs := setup(t)
+		for _, rec := range []Record{
+			{Key: "k1", Group: "g1", Data: "data"},
+			{Key: "k2", Group: "g1", Data: "data"},
+			{Key: "k3", Group: "g10", Data: "data"},
+			{Key: "k4", Data: "data"},
+		} {
+			if err := rs.PutRecord("t1", rec); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := rs.DeleteGroup("t1", "g1"); err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range []string{"k1", "k2"} {
+			if _, err := rs.GetRecord("t1", key); err == nil {
+				t.Errorf("%s: record of deleted group found", key)
+			}
+		}
+		for _, key := range []string{"k3", "k4"} {
+			if _, err := rs.GetRecord("t1", key); err != nil {
+				t.Errorf("%s: record of other group deleted", key)
+			}
+		}
+		if err := rs.DeleteGroup("t1", ""); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := rs.GetRecord("t1", "k4"); err != nil {
+			t.Error("deleting the empty group deleted records without group")
+		}
+	})
+}
@@ -0,0 +1,456 @@
+package bindings
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/openbolt/openid"
+	"github.com/redis/go-redis/v9"
+)
+
+// After Config, call Init(), on exit call Close()
+
+// DefaultRedisTimeout is used for each command, if Redis.Timeout isn't set
+const DefaultRedisTimeout = time.Second
+
+// Redis is a binding for short-lived data with native TTLs. It implements
+// Cacher, ReplayCache, SessionStore and RecordStore.
+//
+// Keys:
+//   - <Prefix>code:{<code>}:           pending codes, JSON
+//   - <Prefix>retired:{<code>}:        redeemed codes, JSON, until the code would expire
+//   - <Prefix>sso:<id>:                SSO sessions, JSON
+//   - <Prefix>jti:<id>:                used one-time identifiers
+//   - <Prefix>record:{<table>:<key>}:  records, JSON
+//   - <Prefix>taken:{<table>:<key>}:   taken records, JSON, until they would expire
+//   - <Prefix>group:<table>:<group>:   keys of the records of a group, expires
+//     with its longest-lived record
+//
+// The keys of a script share a hash tag in braces, so they are in the same
+// slot of a Redis Cluster. Group sets are in their own slot and are updated
+// separately, so they may list keys of removed records. DeleteGroup checks
+// the group of each record before removing it.
+type Redis struct {
+	Addr string
+	// Nodes of a Redis Cluster, Addr and DB are ignored if set
+	ClusterAddrs []string
+	Password     string
+	DB           int
+	// Prepended to all keys
+	Prefix string
+
+	// Timeout for each command
+	Timeout time.Duration
+	// Codes are kept this long, should be at least OpenID.CodeLifetime
+	CodeLifetime time.Duration
+	// SSO sessions are removed after this time, should match
+	// OpenID.SessionMaxAge
+	SessionMaxAge time.Duration
+
+	client redis.UniversalClient
+}
+
+func (rd *Redis) Init() error {
+	if rd.Timeout == 0 {
+		rd.Timeout = DefaultRedisTimeout
+	}
+	if rd.CodeLifetime == 0 {
+		rd.CodeLifetime = DefaultCodeRetention
+	}
+	if rd.SessionMaxAge == 0 {
+		rd.SessionMaxAge = openid.DefaultSessionMaxAge
+	}
+
+	if len(rd.ClusterAddrs) > 0 {
+		rd.client = redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:        rd.ClusterAddrs,
+			Password:     rd.Password,
+			DialTimeout:  rd.Timeout,
+			ReadTimeout:  rd.Timeout,
+			WriteTimeout: rd.Timeout,
+		})
+	} else {
+		rd.client = redis.NewClient(&redis.Options{
+			Addr:         rd.Addr,
+			Password:     rd.Password,
+			DB:           rd.DB,
+			DialTimeout:  rd.Timeout,
+			ReadTimeout:  rd.Timeout,
+			WriteTimeout: rd.Timeout,
+		})
+	}
+
+	ctx, cancel := rd.ctx()
+	defer cancel()
+	if err := rd.client.Ping(ctx).Err(); err != nil {
+		rd.client.Close()
+		return err
+	}
+	return nil
+}
+
+func (rd *Redis) Close() {
+	rd.client.Close()
+}
+
+func (rd *Redis) ctx() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), rd.Timeout)
+}
+
+/*
+ * Cacher
+ */
+func (rd *Redis) Cache(val openid.Session) error {
+	data, err := json.Marshal(val)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := rd.ctx()
+	defer cancel()
+	ok, err := rd.client.SetNX(ctx, rd.codeKeys(val.Code)[0], data, rd.CodeLifetime).Result()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("Code already cached")
+	}
+	return nil
+}
+
+// redeemScript takes the pending code KEYS[1] and marks it as redeemed in
+// KEYS[2] for ARGV[1] milliseconds. The marker keeps the session, so the
+// tokens of a reused code can be revoked. Scripts run atomically, so
+// concurrent redemptions can't both succeed. The marker is set first: if that
+// fails, the script aborts and the code stays pending.
+var redeemScript = redis.NewScript(`
+local data = redis.call("GET", KEYS[1])
+if not data then
+	return false
+end
+redis.call("SET", KEYS[2], data, "PX", ARGV[1])
+redis.call("DEL", KEYS[1])
+return data
+`)
+
+// codeKeys returns the key of the pending code and of its retired marker
+func (rd *Redis) codeKeys(code string) []string {
+	return []string{rd.Prefix + "code:{" + code + "}", rd.Prefix + "retired:{" + code + "}"}
+}
+
+// Redeem takes the code and remembers the redemption in one step, so a
+// replay can be told apart from an unknown code
+func (rd *Redis) Redeem(code string) (openid.Session, error) {
+	ctx, cancel := rd.ctx()
+	defer cancel()
+	data, err := redeemScript.Run(ctx, rd.client, rd.codeKeys(code), rd.CodeLifetime.Milliseconds()).Text()
+	if err == redis.Nil {
+		return rd.missingCode(ctx, code)
+	}
+	if err != nil {
+		return openid.Session{}, err
+	}
+
+	var ses openid.Session
+	err = json.Unmarshal([]byte(data), &ses)
+	return ses, err
+}
+
+// missingCode returns why there is no pending `code`, along with the session
+// of a redeemed code
+func (rd *Redis) missingCode(ctx context.Context, code string) (openid.Session, error) {
+	data, err := rd.client.Get(ctx, rd.codeKeys(code)[1]).Bytes()
+	switch {
+	case err == redis.Nil:
+		return openid.Session{}, errors.New("Invalid code")
+	case err != nil:
+		return openid.Session{}, err
+	}
+	var ses openid.Session
+	json.Unmarshal(data, &ses)
+	return ses, openid.ErrCodeRedeemed
+}
+
+/*
+ * ReplayCache
+ */
+func (rd *Redis) Use(id string, exp time.Time) (bool, error) {
+	ttl := time.Until(exp)
+	if ttl <= 0 {
+		// Expired identifiers must be rejected by the caller anyway
+		return true, nil
+	}
+
+	ctx, cancel := rd.ctx()
+	defer cancel()
+	return rd.client.SetNX(ctx, rd.Prefix+"jti:"+id, 1, ttl).Result()
+}
+
+/*
+ * SessionStore
+ */
+func (rd *Redis) SaveSSOSession(s openid.SSOSession) error {
+	ttl := time.Until(s.Created.Add(rd.SessionMaxAge))
+	if ttl <= 0 {
+		return rd.DeleteSSOSession(s.ID)
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := rd.ctx()
+	defer cancel()
+	return rd.client.Set(ctx, rd.Prefix+"sso:"+s.ID, data, ttl).Err()
+}
+
+func (rd *Redis) GetSSOSession(id string) (openid.SSOSession, error) {
+	ctx, cancel := rd.ctx()
+	defer cancel()
+	data, err := rd.client.Get(ctx, rd.Prefix+"sso:"+id).Bytes()
+	if err == redis.Nil {
+		return openid.SSOSession{}, errors.New("No such session")
+	}
+	if err != nil {
+		return openid.SSOSession{}, err
+	}
+
+	var s openid.SSOSession
+	err = json.Unmarshal(data, &s)
+	return s, err
+}
+
+func (rd *Redis) DeleteSSOSession(id string) error {
+	ctx, cancel := rd.ctx()
+	defer cancel()
+	return rd.client.Del(ctx, rd.Prefix+"sso:"+id).Err()
+}
+
+/*
+ * RecordStore
+ */
+
+// putRecordScript stores the record KEYS[1] with ARGV[1] as value and a TTL
+// of ARGV[2] milliseconds, 0 means none. The taken marker KEYS[2] is removed.
+// With ARGV[3] set to "nx", nothing is changed if the record or its taken
+// marker exist.
+var putRecordScript = redis.NewScript(`
+if ARGV[3] == "nx" and redis.call("EXISTS", KEYS[1], KEYS[2]) > 0 then
+	return 0
+end
+if tonumber(ARGV[2]) > 0 then
+	redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[2])
+else
+	redis.call("SET", KEYS[1], ARGV[1])
+end
+redis.call("DEL", KEYS[2])
+return 1
+`)
+
+// replaceRecordScript sets the data of the record KEYS[1] to ARGV[2], if it
+// is still ARGV[1]. The TTL is kept.
+var replaceRecordScript = redis.NewScript(`
+local data = redis.call("GET", KEYS[1])
+if not data then
+	return 0
+end
+local rec = cjson.decode(data)
+if rec["Data"] ~= ARGV[1] then
+	return 0
+end
+rec["Data"] = ARGV[2]
+redis.call("SET", KEYS[1], cjson.encode(rec), "KEEPTTL")
+return 1
+`)
+
+// addMemberScript adds the key ARGV[1] to the group set KEYS[1]. The set
+// expires with its longest-lived member, a member without TTL (ARGV[2] is 0)
+// keeps it forever.
+var addMemberScript = redis.NewScript(`
+local existed = redis.call("EXISTS", KEYS[1])
+redis.call("SADD", KEYS[1], ARGV[1])
+local ttl = tonumber(ARGV[2])
+if ttl == 0 then
+	redis.call("PERSIST", KEYS[1])
+	return 1
+end
+local left = redis.call("PTTL", KEYS[1])
+if existed == 0 or (left >= 0 and left < ttl) then
+	redis.call("PEXPIRE", KEYS[1], ttl)
+end
+return 1
+`)
+
+// deleteMemberScript removes the record KEYS[1] and its taken marker KEYS[2],
+// unless the record was replaced by one of another group than ARGV[1]
+var deleteMemberScript = redis.NewScript(`
+local data = redis.call("GET", KEYS[1])
+if data and cjson.decode(data)["Group"] ~= ARGV[1] then
+	return 0
+end
+redis.call("DEL", KEYS[1], KEYS[2])
+return 1
+`)
+
+// takeRecordScript takes the record KEYS[1] and moves it to the taken marker
+// KEYS[2] with the remaining TTL of the record, like redeemScript
+var takeRecordScript = redis.NewScript(`
+local data = redis.call("GET", KEYS[1])
+if not data then
+	return false
+end
+local ttl = redis.call("PTTL", KEYS[1])
+if ttl > 0 then
+	redis.call("SET", KEYS[2], data, "PX", ttl)
+else
+	redis.call("SET", KEYS[2], data)
+end
+redis.call("DEL", KEYS[1])
+return data
+`)
+
+func (rd *Redis) recordKeys(table, key string) []string {
+	tag := "{" + table + ":" + key + "}"
+	return []string{rd.Prefix + "record:" + tag, rd.Prefix + "taken:" + tag}
+}
+
+func (rd *Redis) groupKey(table, group string) string {
+	return rd.Prefix + "group:" + table + ":" + group
+}
+
+// putRecord runs putRecordScript, returns false if the record exists and
+// `nx` is set. The key is added to the group set first, so a stored record
+// can always be found by DeleteGroup.
+func (rd *Redis) putRecord(table string, rec Record, nx bool) (bool, error) {
+	var ttl int64
+	if !rec.Expires.IsZero() {
+		if ttl = time.Until(rec.Expires).Milliseconds(); ttl <= 0 {
+			return true, rd.DeleteRecord(table, rec.Key)
+		}
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return false, err
+	}
+	var flag string
+	if nx {
+		flag = "nx"
+	}
+
+	ctx, cancel := rd.ctx()
+	defer cancel()
+	if rec.Group != "" {
+		if err := addMemberScript.Run(ctx, rd.client, []string{rd.groupKey(table, rec.Group)}, rec.Key, ttl).Err(); err != nil {
+			return false, err
+		}
+	}
+	n, err := putRecordScript.Run(ctx, rd.client, rd.recordKeys(table, rec.Key), data, ttl, flag).Int()
+	return n == 1, err
+}
+
+func (rd *Redis) AddRecord(table string, rec Record) error {
+	ok, err := rd.putRecord(table, rec, true)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("Record already exists")
+	}
+	return nil
+}
+
+func (rd *Redis) PutRecord(table string, rec Record) error {
+	_, err := rd.putRecord(table, rec, false)
+	return err
+}
+
+func (rd *Redis) ReplaceRecord(table, key, old, data string) error {
+	ctx, cancel := rd.ctx()
+	defer cancel()
+	n, err := replaceRecordScript.Run(ctx, rd.client, rd.recordKeys(table, key)[:1], old, data).Int()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errors.New("Record changed")
+	}
+	return nil
+}
+
+func (rd *Redis) GetRecord(table, key string) (Record, error) {
+	ctx, cancel := rd.ctx()
+	defer cancel()
+	data, err := rd.client.Get(ctx, rd.recordKeys(table, key)[0]).Bytes()
+	if err == redis.Nil {
+		return Record{}, errors.New("No such record")
+	}
+	if err != nil {
+		return Record{}, err
+	}
+
+	var rec Record
+	err = json.Unmarshal(data, &rec)
+	return rec, err
+}
+
+func (rd *Redis) TakeRecord(table, key string) (Record, error) {
+	ctx, cancel := rd.ctx()
+	defer cancel()
+	keys := rd.recordKeys(table, key)
+	data, err := takeRecordScript.Run(ctx, rd.client, keys).Text()
+	if err == redis.Nil {
+		data, err := rd.client.Get(ctx, keys[1]).Bytes()
+		switch {
+		case err == redis.Nil:
+			return Record{}, errors.New("No such record")
+		case err != nil:
+			return Record{}, err
+		}
+		var rec Record
+		json.Unmarshal(data, &rec)
+		return rec, openid.ErrCodeRedeemed
+	}
+	if err != nil {
+		return Record{}, err
+	}
+
+	var rec Record
+	err = json.Unmarshal([]byte(data), &rec)
+	return rec, err
+}
+
+func (rd *Redis) DeleteRecord(table, key string) error {
+	ctx, cancel := rd.ctx()
+	defer cancel()
+	return rd.client.Del(ctx, rd.recordKeys(table, key)...).Err()
+}
+
+// DeleteGroup removes the members of the group set, which were read. Records
+// added meanwhile are kept. Members are removed from the set, even if their
+// record is gone or belongs to another group by now. The records are in
+// different slots, so each one is removed by its own script.
+func (rd *Redis) DeleteGroup(table, group string) error {
+	if group == "" {
+		return nil
+	}
+	ctx, cancel := rd.ctx()
+	defer cancel()
+	set := rd.groupKey(table, group)
+	members, err := rd.client.SMembers(ctx, set).Result()
+	if err != nil || len(members) == 0 {
+		return err
+	}
+
+	for _, key := range members {
+		if err := deleteMemberScript.Run(ctx, rd.client, rd.recordKeys(table, key), group).Err(); err != nil {
+			return err
+		}
+	}
+	args := make([]interface{}, len(members))
+	for i, key := range members {
+		args[i] = key
+	}
+	return rd.client.SRem(ctx, set, args...).Err()
+}
@@ -0,0 +1,138 @@
+package bindings
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/openbolt/openid"
+	"github.com/openbolt/openid/bindings/storetest"
+)
+
+// newTestRedis connects to the redis-server in OPENID_TEST_REDIS, e.g.
+// "localhost:6379", or starts an in-process fake. `wait` lets time pass for
+// TTLs.
+func newTestRedis(t *testing.T) (rd *Redis, wait func(time.Duration), done func()) {
+	rd = &Redis{Prefix: "openid_test:" + time.Now().Format("150405.000000") + ":"}
+	if addr := os.Getenv("OPENID_TEST_REDIS"); addr != "" {
+		rd.Addr = addr
+		wait = time.Sleep
+		done = rd.Close
+	} else {
+		mr, err := miniredis.Run()
+		if err != nil {
+			t.Fatal(err)
+		}
+		rd.Addr = mr.Addr()
+		wait = mr.FastForward
+		done = func() {
+			rd.Close()
+			mr.Close()
+		}
+	}
+	if err := rd.Init(); err != nil {
+		t.Fatal(err)
+	}
+	return rd, wait, done
+}
+
+// The retired marker is written by the redeem script and expires
+func TestRedisRetiredMarker(t *testing.T) {
+	rd, _, done := newTestRedis(t)
+	defer done()
+
+	if err := rd.Cache(openid.Session{Code: "code1"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rd.Redeem("code1"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := rd.ctx()
+	defer cancel()
+	if ttl := rd.client.TTL(ctx, rd.Prefix+"retired:{code1}").Val(); ttl <= 0 || ttl > rd.CodeLifetime {
+		t.Errorf("expected marker with TTL, got %v", ttl)
+	}
+	if n := rd.client.Exists(ctx, rd.Prefix+"code:{code1}").Val(); n != 0 {
+		t.Error("redeemed code not removed")
+	}
+}
+
+// Keys of one script must be in the same slot of a Redis Cluster
+func TestRedisHashTags(t *testing.T) {
+	rd := &Redis{Prefix: "openid:{x}:"}
+	tag := func(key string) string {
+		key = strings.TrimPrefix(key, rd.Prefix)
+		return key[strings.Index(key, "{")+1 : strings.Index(key, "}")]
+	}
+	for _, keys := range [][]string{rd.codeKeys("code1"), rd.recordKeys("sso", "key1")} {
+		if tag(keys[0]) == "" || tag(keys[0]) != tag(keys[1]) {
+			t.Errorf("keys in different slots: %v", keys)
+		}
+	}
+}
+
+// Group sets expire with their longest-lived record and don't keep records
+// of other groups
+func TestRedisGroupSet(t *testing.T) {
+	rd, _, done := newTestRedis(t)
+	defer done()
+	ctx, cancel := rd.ctx()
+	defer cancel()
+	set := rd.groupKey("grant", "g1")
+
+	rd.PutRecord("grant", Record{Key: "key1", Group: "g1", Expires: time.Now().Add(time.Hour)})
+	rd.PutRecord("grant", Record{Key: "key2", Group: "g1", Expires: time.Now().Add(time.Minute)})
+	if ttl := rd.client.PTTL(ctx, set).Val(); ttl < 59*time.Minute || ttl > time.Hour {
+		t.Errorf("expected TTL of the longest-lived record, got %v", ttl)
+	}
+	rd.PutRecord("grant", Record{Key: "key3", Group: "g1"})
+	if ttl := rd.client.PTTL(ctx, set).Val(); ttl != -1 {
+		t.Errorf("expected no TTL, got %v", ttl)
+	}
+
+	// key1 moved to another group
+	rd.PutRecord("grant", Record{Key: "key1", Group: "g2"})
+	if err := rd.DeleteGroup("grant", "g1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rd.GetRecord("grant", "key1"); err != nil {
+		t.Error("record of another group removed")
+	}
+	if _, err := rd.GetRecord("grant", "key3"); err == nil {
+		t.Error("record not removed")
+	}
+	if n := rd.client.Exists(ctx, set).Val(); n != 0 {
+		t.Error("group set not removed")
+	}
+}
+
+func TestRedisConformance(t *testing.T) {
+	var (
+		_ openid.Cacher       = (*Redis)(nil)
+		_ openid.ReplayCache  = (*Redis)(nil)
+		_ openid.SessionStore = (*Redis)(nil)
+		_ RecordStore         = (*Redis)(nil)
+	)
+
+	storetest.RunCacherTests(t, func(t *testing.T, lifetime time.Duration) storetest.CacherSetup {
+		rd, wait, done := newTestRedis(t)
+		rd.CodeLifetime = lifetime
+		return storetest.CacherSetup{Cacher: rd, Sleep: wait, Close: done}
+	})
+	storetest.RunSessionStoreTests(t, func(t *testing.T, maxAge time.Duration) (openid.SessionStore, func()) {
+		rd, _, done := newTestRedis(t)
+		rd.SessionMaxAge = maxAge
+		return rd, done
+	})
+	storetest.RunReplayCacheTests(t, func(t *testing.T) storetest.ReplayCacheSetup {
+		rd, wait, done := newTestRedis(t)
+		return storetest.ReplayCacheSetup{Cache: rd, Sleep: wait, Close: done}
+	})
+	runRecordStoreTests(t, func(t *testing.T) (RecordStore, func()) {
+		rd, _, done := newTestRedis(t)
+		return rd, done
+	})
+}
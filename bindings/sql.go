@@ -0,0 +1,625 @@
+package bindings
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/openbolt/openid"
+	"github.com/openbolt/openid/utils"
+)
+
+// After Config, call Init(), on exit call Close()
+
+const (
+	// DefaultSQLTimeout is used for each query, if SQL.Timeout isn't set
+	DefaultSQLTimeout = 5 * time.Second
+	// sqlMigrationLock is the PostgreSQL advisory lock held while migrating,
+	// "openid" in hex
+	sqlMigrationLock = 0x6f70656e6964
+)
+
+// sqlMigrations are applied in order by Init(). Never edit an existing entry,
+// append a new one instead.
+var sqlMigrations = []string{
+	`CREATE TABLE openid_codes (
+		code       TEXT PRIMARY KEY,
+		session    TEXT NOT NULL,
+		expires_at BIGINT NOT NULL,
+		retired    BOOLEAN NOT NULL DEFAULT FALSE
+	);
+	CREATE INDEX openid_codes_expires_at ON openid_codes (expires_at);
+	CREATE TABLE openid_clients (
+		client_id TEXT PRIMARY KEY,
+		client    TEXT NOT NULL
+	);
+	CREATE TABLE openid_claims (
+		sub   TEXT NOT NULL,
+		claim TEXT NOT NULL,
+		value TEXT NOT NULL,
+		PRIMARY KEY (sub, claim)
+	);
+	CREATE TABLE openid_grants (
+		sub       TEXT NOT NULL,
+		client_id TEXT NOT NULL,
+		data      TEXT NOT NULL,
+		PRIMARY KEY (sub, client_id)
+	);
+	CREATE INDEX openid_grants_client_id ON openid_grants (client_id);
+	CREATE TABLE openid_sessions (
+		id         TEXT PRIMARY KEY,
+		data       TEXT NOT NULL,
+		expires_at BIGINT NOT NULL
+	);
+	CREATE INDEX openid_sessions_expires_at ON openid_sessions (expires_at);
+	CREATE TABLE openid_revocations (
+		client_id      TEXT PRIMARY KEY,
+		revoked_before BIGINT NOT NULL
+	)`,
+	`CREATE TABLE openid_code_revocations (
+		code_hash  TEXT PRIMARY KEY,
+		expires_at BIGINT NOT NULL
+	)`,
+	`CREATE TABLE openid_records (
+		record_table TEXT NOT NULL,
+		record_key   TEXT NOT NULL,
+		record_group TEXT NOT NULL,
+		data         TEXT NOT NULL,
+		expires_at   BIGINT NOT NULL,
+		taken        BOOLEAN NOT NULL DEFAULT FALSE,
+		PRIMARY KEY (record_table, record_key)
+	);
+	CREATE INDEX openid_records_group ON openid_records (record_table, record_group);
+	CREATE INDEX openid_records_expires_at ON openid_records (expires_at)`,
+	`CREATE TABLE openid_jti (
+		jti        TEXT PRIMARY KEY,
+		expires_at BIGINT NOT NULL
+	);
+	CREATE INDEX openid_jti_expires_at ON openid_jti (expires_at)`,
+}
+
+// sqlQueries are prepared by Init(). Placeholders are written as `?` and
+// rewritten for the dialect.
+var sqlQueries = map[string]string{
+	"cache":       `INSERT INTO openid_codes (code, session, expires_at) VALUES (?, ?, ?)`,
+	"codeRetired": `SELECT retired, session FROM openid_codes WHERE code = ?`,
+	"redeem":      `UPDATE openid_codes SET retired = TRUE WHERE code = ? AND retired = FALSE AND expires_at > ? RETURNING session`,
+	"getClaim":    `SELECT value FROM openid_claims WHERE sub = ? AND claim = ?`,
+	"saveClaim":   `INSERT INTO openid_claims (sub, claim, value) VALUES (?, ?, ?) ON CONFLICT (sub, claim) DO UPDATE SET value = excluded.value`,
+	"getClient":   `SELECT client FROM openid_clients WHERE client_id = ?`,
+	"saveClient":  `INSERT INTO openid_clients (client_id, client) VALUES (?, ?) ON CONFLICT (client_id) DO UPDATE SET client = excluded.client`,
+	"delClient":   `DELETE FROM openid_clients WHERE client_id = ?`,
+	"getGrant":    `SELECT data FROM openid_grants WHERE sub = ? AND client_id = ?`,
+	"saveGrant":   `INSERT INTO openid_grants (sub, client_id, data) VALUES (?, ?, ?) ON CONFLICT (sub, client_id) DO UPDATE SET data = excluded.data`,
+	"delGrants":   `DELETE FROM openid_grants WHERE client_id = ?`,
+	"getSSO":      `SELECT data FROM openid_sessions WHERE id = ? AND expires_at > ?`,
+	"saveSSO":     `INSERT INTO openid_sessions (id, data, expires_at) VALUES (?, ?, ?) ON CONFLICT (id) DO UPDATE SET data = excluded.data, expires_at = excluded.expires_at`,
+	"delSSO":      `DELETE FROM openid_sessions WHERE id = ?`,
+	"revoke":      `INSERT INTO openid_revocations (client_id, revoked_before) VALUES (?, ?) ON CONFLICT (client_id) DO UPDATE SET revoked_before = excluded.revoked_before`,
+	"revoked":     `SELECT revoked_before FROM openid_revocations WHERE client_id = ?`,
+	"gcCodes":     `DELETE FROM openid_codes WHERE expires_at <= ?`,
+	"gcSessions":  `DELETE FROM openid_sessions WHERE expires_at <= ?`,
+	"revokeCode":  `INSERT INTO openid_code_revocations (code_hash, expires_at) VALUES (?, ?) ON CONFLICT (code_hash) DO UPDATE SET expires_at = excluded.expires_at`,
+	"codeRevoked": `SELECT 1 FROM openid_code_revocations WHERE code_hash = ? AND expires_at > ?`,
+	"gcCodeRevs":  `DELETE FROM openid_code_revocations WHERE expires_at <= ?`,
+	// Records without expiry have expires_at 0. An expired record is replaced
+	// by addRecord, even if it hasn't been removed yet.
+	"addRecord":   `INSERT INTO openid_records (record_table, record_key, record_group, data, expires_at) VALUES (?, ?, ?, ?, ?) ON CONFLICT (record_table, record_key) DO UPDATE SET record_group = excluded.record_group, data = excluded.data, expires_at = excluded.expires_at, taken = FALSE WHERE openid_records.expires_at <> 0 AND openid_records.expires_at <= ?`,
+	"putRecord":   `INSERT INTO openid_records (record_table, record_key, record_group, data, expires_at) VALUES (?, ?, ?, ?, ?) ON CONFLICT (record_table, record_key) DO UPDATE SET record_group = excluded.record_group, data = excluded.data, expires_at = excluded.expires_at, taken = FALSE`,
+	"swapRecord":  `UPDATE openid_records SET data = ? WHERE record_table = ? AND record_key = ? AND data = ? AND taken = FALSE AND (expires_at = 0 OR expires_at > ?)`,
+	"getRecord":   `SELECT record_group, data, expires_at FROM openid_records WHERE record_table = ? AND record_key = ? AND taken = FALSE AND (expires_at = 0 OR expires_at > ?)`,
+	"takeRecord":  `UPDATE openid_records SET taken = TRUE WHERE record_table = ? AND record_key = ? AND taken = FALSE AND (expires_at = 0 OR expires_at > ?) RETURNING record_group, data, expires_at`,
+	"recordTaken": `SELECT record_group, data, expires_at FROM openid_records WHERE record_table = ? AND record_key = ? AND taken = TRUE AND (expires_at = 0 OR expires_at > ?)`,
+	"delRecord":   `DELETE FROM openid_records WHERE record_table = ? AND record_key = ?`,
+	"delGroup":    `DELETE FROM openid_records WHERE record_table = ? AND record_group = ?`,
+	"gcRecords":   `DELETE FROM openid_records WHERE expires_at <> 0 AND expires_at <= ?`,
+	// Like addRecord, an expired identifier is replaced, a valid one is left
+	// alone
+	"useJTI": `INSERT INTO openid_jti (jti, expires_at) VALUES (?, ?) ON CONFLICT (jti) DO UPDATE SET expires_at = excluded.expires_at WHERE openid_jti.expires_at <= ?`,
+	"gcJTIs": `DELETE FROM openid_jti WHERE expires_at <= ?`,
+}
+
+// SQL is a database/sql binding, tested with PostgreSQL and SQLite. It
+// implements Cacher, Claimsource, ClientStore, ConsentStore, SessionStore,
+// RevocationStore, ReplayCache and RecordStore. The driver must be imported by
+// the caller.
+//
+// Times are stored as unix nanoseconds, structs as JSON. For SQLite, set
+// `_busy_timeout` in the DSN, so concurrent writers wait for each other.
+type SQL struct {
+	// Passed to sql.Open
+	Driver string
+	DSN    string
+
+	// Timeout for each query
+	Timeout time.Duration
+	// Codes are kept this long, should be at least OpenID.CodeLifetime
+	CodeLifetime time.Duration
+	// SSO sessions are removed after this time, should match
+	// OpenID.SessionMaxAge
+	SessionMaxAge time.Duration
+	// How often expired entries are removed
+	GCInterval time.Duration
+
+	db    *sql.DB
+	stmts map[string]*sql.Stmt
+	stop  chan struct{}
+	wg    sync.WaitGroup
+}
+
+func (s *SQL) Init() (err error) {
+	if s.Timeout == 0 {
+		s.Timeout = DefaultSQLTimeout
+	}
+	if s.CodeLifetime == 0 {
+		s.CodeLifetime = DefaultCodeRetention
+	}
+	if s.SessionMaxAge == 0 {
+		s.SessionMaxAge = openid.DefaultSessionMaxAge
+	}
+	if s.GCInterval == 0 {
+		s.GCInterval = DefaultGCInterval
+	}
+
+	s.db, err = sql.Open(s.Driver, s.DSN)
+	if err != nil {
+		return err
+	}
+	if err = s.migrate(); err != nil {
+		s.db.Close()
+		return err
+	}
+
+	s.stmts = make(map[string]*sql.Stmt, len(sqlQueries))
+	for name, q := range sqlQueries {
+		if s.stmts[name], err = s.db.Prepare(s.rebind(q)); err != nil {
+			s.Close()
+			return err
+		}
+	}
+
+	s.stop = make(chan struct{})
+	s.wg.Add(1)
+	go s.gcLoop()
+	return nil
+}
+
+func (s *SQL) Close() {
+	if s.stop != nil {
+		close(s.stop)
+		s.wg.Wait()
+	}
+	for _, stmt := range s.stmts {
+		if stmt != nil {
+			stmt.Close()
+		}
+	}
+	s.db.Close()
+}
+
+func (s *SQL) postgres() bool {
+	return s.Driver == "postgres" || s.Driver == "pgx"
+}
+
+// rebind rewrites `?` placeholders to `$n` for PostgreSQL
+func (s *SQL) rebind(q string) string {
+	if !s.postgres() {
+		return q
+	}
+	var b strings.Builder
+	n := 0
+	for _, c := range q {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+		} else {
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+// migrate applies all sqlMigrations, which are not yet recorded in
+// openid_schema. Providers starting at the same time migrate one after
+// another: PostgreSQL holds an advisory lock until the end of the
+// transaction, SQLite takes the write lock with a first, empty write.
+func (s *SQL) migrate() error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.Timeout)
+	defer cancel()
+
+	const createSchema = `CREATE TABLE IF NOT EXISTS openid_schema (version INTEGER NOT NULL)`
+	if !s.postgres() {
+		if _, err := s.db.ExecContext(ctx, createSchema); err != nil {
+			return err
+		}
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if s.postgres() {
+		// Concurrent CREATE TABLE IF NOT EXISTS may fail in PostgreSQL, so
+		// the table is created under the lock
+		if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1)`, sqlMigrationLock); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, createSchema); err != nil {
+			return err
+		}
+	} else if _, err := tx.ExecContext(ctx, `DELETE FROM openid_schema WHERE version < 0`); err != nil {
+		return err
+	}
+
+	var version int
+	if err := tx.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM openid_schema`).Scan(&version); err != nil {
+		return err
+	}
+	for i := version; i < len(sqlMigrations); i++ {
+		for _, stmt := range strings.Split(sqlMigrations[i], ";") {
+			if strings.TrimSpace(stmt) == "" {
+				continue
+			}
+			if _, err := tx.ExecContext(ctx, stmt); err != nil {
+				return errors.New("Migration " + strconv.Itoa(i+1) + ": " + err.Error())
+			}
+		}
+		if _, err := tx.ExecContext(ctx, s.rebind(`INSERT INTO openid_schema (version) VALUES (?)`), i+1); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SQL) gcLoop() {
+	defer s.wg.Done()
+	t := time.NewTicker(s.GCInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if err := s.GC(); err != nil {
+				utils.ELog(err, nil)
+			}
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// GC removes expired codes, SSO sessions, code revocations, records and
+// one-time identifiers. It is called periodically after Init().
+func (s *SQL) GC() error {
+	now := time.Now().UnixNano()
+	for _, q := range []string{"gcCodes", "gcSessions", "gcCodeRevs", "gcRecords", "gcJTIs"} {
+		if _, err := s.exec(q, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SQL) exec(name string, args ...interface{}) (sql.Result, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.Timeout)
+	defer cancel()
+	return s.stmts[name].ExecContext(ctx, args...)
+}
+
+// queryRow scans a single row into dest. Returns false, if there is no row.
+func (s *SQL) queryRow(name string, args []interface{}, dest ...interface{}) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.Timeout)
+	defer cancel()
+	err := s.stmts[name].QueryRowContext(ctx, args...).Scan(dest...)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// queryJSON decodes a single JSON column into val
+func (s *SQL) queryJSON(name string, val interface{}, args ...interface{}) (bool, error) {
+	var data string
+	found, err := s.queryRow(name, args, &data)
+	if !found || err != nil {
+		return found, err
+	}
+	return true, json.Unmarshal([]byte(data), val)
+}
+
+func (s *SQL) execJSON(name string, key string, val interface{}, args ...interface{}) error {
+	data, err := json.Marshal(val)
+	if err != nil {
+		return err
+	}
+	_, err = s.exec(name, append([]interface{}{key, string(data)}, args...)...)
+	return err
+}
+
+/*
+ * Cacher
+ */
+func (s *SQL) Cache(val openid.Session) error {
+	return s.execJSON("cache", val.Code, val, time.Now().Add(s.CodeLifetime).UnixNano())
+}
+
+// Redeem retires the code in one statement
+func (s *SQL) Redeem(code string) (openid.Session, error) {
+	var ses openid.Session
+	found, err := s.queryJSON("redeem", &ses, code, time.Now().UnixNano())
+	if err != nil {
+		return openid.Session{}, err
+	}
+	if found {
+		return ses, nil
+	}
+
+	// Tell apart why
+	var retired bool
+	var data string
+	found, err = s.queryRow("codeRetired", []interface{}{code}, &retired, &data)
+	switch {
+	case err != nil:
+		return openid.Session{}, err
+	case found && retired:
+		json.Unmarshal([]byte(data), &ses)
+		return ses, openid.ErrCodeRedeemed
+	case found:
+		return openid.Session{}, errors.New("Code expired")
+	}
+	return openid.Session{}, errors.New("Invalid code")
+}
+
+/*
+ * Claimsource
+ */
+func (s *SQL) Get(id, claim, def string) (string, bool) {
+	var val string
+	found, err := s.queryRow("getClaim", []interface{}{id, claim}, &val)
+	if err != nil {
+		utils.ELog(err, nil)
+	}
+	if !found {
+		return def, false
+	}
+	return val, true
+}
+
+// SaveUser stores the claims of a subject
+func (s *SQL) SaveUser(sub string, claims map[string]string) error {
+	for claim, val := range claims {
+		if _, err := s.exec("saveClaim", sub, claim, val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+ * ClientStore
+ */
+func (s *SQL) GetClient(id string) (openid.Client, error) {
+	var clt openid.Client
+	found, err := s.queryJSON("getClient", &clt, id)
+	if err != nil {
+		return openid.Client{}, err
+	}
+	if !found {
+		return openid.Client{}, errors.New("No such client")
+	}
+	return clt, nil
+}
+
+func (s *SQL) SaveClient(clt openid.Client) error {
+	return s.execJSON("saveClient", clt.ClientID, clt)
+}
+
+func (s *SQL) DeleteClient(id string) error {
+	_, err := s.exec("delClient", id)
+	return err
+}
+
+/*
+ * ConsentStore
+ */
+func (s *SQL) GetGrant(sub, clientID string) (openid.Grant, error) {
+	var g openid.Grant
+	found, err := s.queryJSON("getGrant", &g, sub, clientID)
+	if err != nil {
+		return openid.Grant{}, err
+	}
+	if !found {
+		return openid.Grant{}, errors.New("Nothing granted")
+	}
+	return g, nil
+}
+
+func (s *SQL) SaveGrant(g openid.Grant) error {
+	data, err := json.Marshal(g)
+	if err != nil {
+		return err
+	}
+	_, err = s.exec("saveGrant", g.Sub, g.ClientID, string(data))
+	return err
+}
+
+func (s *SQL) DeleteGrants(clientID string) error {
+	_, err := s.exec("delGrants", clientID)
+	return err
+}
+
+/*
+ * SessionStore
+ */
+func (s *SQL) SaveSSOSession(ses openid.SSOSession) error {
+	return s.execJSON("saveSSO", ses.ID, ses, ses.Created.Add(s.SessionMaxAge).UnixNano())
+}
+
+func (s *SQL) GetSSOSession(id string) (openid.SSOSession, error) {
+	var ses openid.SSOSession
+	found, err := s.queryJSON("getSSO", &ses, id, time.Now().UnixNano())
+	if err != nil {
+		return openid.SSOSession{}, err
+	}
+	if !found {
+		return openid.SSOSession{}, errors.New("No such session")
+	}
+	return ses, nil
+}
+
+func (s *SQL) DeleteSSOSession(id string) error {
+	_, err := s.exec("delSSO", id)
+	return err
+}
+
+/*
+ * RevocationStore
+ */
+func (s *SQL) Revoke(clientID string, t time.Time) error {
+	_, err := s.exec("revoke", clientID, t.UnixNano())
+	return err
+}
+
+func (s *SQL) RevokedBefore(clientID string) time.Time {
+	var nsec int64
+	found, err := s.queryRow("revoked", []interface{}{clientID}, &nsec)
+	if err != nil {
+		utils.ELog(err, nil)
+	}
+	if !found {
+		return time.Time{}
+	}
+	return time.Unix(0, nsec)
+}
+
+func (s *SQL) RevokeCode(codeHash string, exp time.Time) error {
+	_, err := s.exec("revokeCode", codeHash, exp.UnixNano())
+	return err
+}
+
+func (s *SQL) CodeRevoked(codeHash string) bool {
+	var one int
+	found, err := s.queryRow("codeRevoked", []interface{}{codeHash, time.Now().UnixNano()}, &one)
+	if err != nil {
+		utils.ELog(err, nil)
+	}
+	return found
+}
+
+/*
+ * ReplayCache
+ */
+func (s *SQL) Use(id string, exp time.Time) (bool, error) {
+	now := time.Now()
+	if !exp.After(now) {
+		// Expired identifiers must be rejected by the caller anyway
+		return true, nil
+	}
+	res, err := s.exec("useJTI", id, exp.UnixNano(), now.UnixNano())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1 && err == nil, err
+}
+
+/*
+ * RecordStore
+ */
+
+// sqlExpires stores "never" as 0
+func sqlExpires(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func (s *SQL) AddRecord(table string, rec Record) error {
+	res, err := s.exec("addRecord", table, rec.Key, rec.Group, rec.Data, sqlExpires(rec.Expires), time.Now().UnixNano())
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return errors.New("Record already exists")
+	}
+	return nil
+}
+
+func (s *SQL) PutRecord(table string, rec Record) error {
+	_, err := s.exec("putRecord", table, rec.Key, rec.Group, rec.Data, sqlExpires(rec.Expires))
+	return err
+}
+
+func (s *SQL) ReplaceRecord(table, key, old, data string) error {
+	res, err := s.exec("swapRecord", data, table, key, old, time.Now().UnixNano())
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return errors.New("Record changed")
+	}
+	return nil
+}
+
+// queryRecord scans the record returned by `name`
+func (s *SQL) queryRecord(name, table, key string) (Record, bool, error) {
+	rec := Record{Key: key}
+	var exp int64
+	found, err := s.queryRow(name, []interface{}{table, key, time.Now().UnixNano()}, &rec.Group, &rec.Data, &exp)
+	if exp != 0 {
+		rec.Expires = time.Unix(0, exp)
+	}
+	return rec, found, err
+}
+
+func (s *SQL) GetRecord(table, key string) (Record, error) {
+	rec, found, err := s.queryRecord("getRecord", table, key)
+	if err != nil {
+		return Record{}, err
+	}
+	if !found {
+		return Record{}, errors.New("No such record")
+	}
+	return rec, nil
+}
+
+// TakeRecord marks the record as taken in one statement
+func (s *SQL) TakeRecord(table, key string) (Record, error) {
+	rec, found, err := s.queryRecord("takeRecord", table, key)
+	if err != nil {
+		return Record{}, err
+	}
+	if found {
+		return rec, nil
+	}
+
+	// Tell apart why
+	rec, found, err = s.queryRecord("recordTaken", table, key)
+	switch {
+	case err != nil:
+		return Record{}, err
+	case found:
+		return rec, openid.ErrCodeRedeemed
+	}
+	return Record{}, errors.New("No such record")
+}
+
+func (s *SQL) DeleteRecord(table, key string) error {
+	_, err := s.exec("delRecord", table, key)
+	return err
+}
+
+func (s *SQL) DeleteGroup(table, group string) error {
+	if group == "" {
+		return nil
+	}
+	_, err := s.exec("delGroup", table, group)
+	return err
+}
@@ -0,0 +1,248 @@
+package bindings
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/openbolt/openid"
+	"github.com/openbolt/openid/bindings/storetest"
+)
+
+func TestSQLite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "openid-sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dsn := "file:" + filepath.Join(dir, "openid.db") + "?_busy_timeout=5000&_journal_mode=WAL"
+	first := &SQL{Driver: "sqlite3", DSN: dsn}
+	if err := first.Init(); err != nil {
+		t.Fatal(err)
+	}
+	first.Close()
+
+	// Migrations are applied once
+	s := &SQL{Driver: "sqlite3", DSN: dsn}
+	if err := s.Init(); err != nil {
+		t.Fatal("reopening:", err)
+	}
+	defer s.Close()
+	var n int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM openid_schema`).Scan(&n); err != nil || n != len(sqlMigrations) {
+		t.Errorf("%d migrations recorded, %v", n, err)
+	}
+}
+
+// Providers starting at the same time migrate one after another
+func TestSQLiteConcurrentMigration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "openid-sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dsn := "file:" + filepath.Join(dir, "openid.db") + "?_busy_timeout=5000&_journal_mode=WAL"
+	var wg sync.WaitGroup
+	errs := make(chan error, 5)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s := &SQL{Driver: "sqlite3", DSN: dsn}
+			if err := s.Init(); err != nil {
+				errs <- err
+				return
+			}
+			s.Close()
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM openid_schema`).Scan(&n); err != nil || n != len(sqlMigrations) {
+		t.Errorf("%d migrations recorded, %v", n, err)
+	}
+}
+
+// newTestPostgres connects to the database in OPENID_TEST_POSTGRES, e.g.
+// "postgres://localhost/openid_test?sslmode=disable". All openid_* tables are
+// dropped first.
+func newTestPostgres(t *testing.T, lifetime time.Duration) (*SQL, func()) {
+	dsn := os.Getenv("OPENID_TEST_POSTGRES")
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	rows, err := db.Query(`SELECT tablename FROM pg_tables WHERE schemaname = current_schema() AND tablename LIKE 'openid\_%'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tables []string
+	for rows.Next() {
+		var table string
+		if err := rows.Scan(&table); err != nil {
+			t.Fatal(err)
+		}
+		tables = append(tables, table)
+	}
+	rows.Close()
+	for _, table := range tables {
+		if _, err := db.Exec(`DROP TABLE IF EXISTS ` + table); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := &SQL{Driver: "postgres", DSN: dsn, CodeLifetime: lifetime}
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	return s, s.Close
+}
+
+func TestPostgres(t *testing.T) {
+	if os.Getenv("OPENID_TEST_POSTGRES") == "" {
+		t.Skip("OPENID_TEST_POSTGRES not set")
+	}
+	testSQL(t, newTestPostgres)
+}
+
+func TestSQLRebind(t *testing.T) {
+	q := `SELECT a FROM b WHERE c = ? AND d = ?`
+	if got := (&SQL{Driver: "sqlite3"}).rebind(q); got != q {
+		t.Error("sqlite3:", got)
+	}
+	if got := (&SQL{Driver: "postgres"}).rebind(q); got != `SELECT a FROM b WHERE c = $1 AND d = $2` {
+		t.Error("postgres:", got)
+	}
+}
+
+func newTestSQLite(t *testing.T, lifetime time.Duration) (*SQL, func()) {
+	dir, err := ioutil.TempDir("", "openid-sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &SQL{
+		Driver:       "sqlite3",
+		DSN:          "file:" + filepath.Join(dir, "openid.db") + "?_busy_timeout=5000&_journal_mode=WAL",
+		CodeLifetime: lifetime,
+	}
+	if err := s.Init(); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return s, func() {
+		s.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestSQLiteConformance(t *testing.T) {
+	testSQL(t, newTestSQLite)
+}
+
+// testSQL runs the conformance tests and the tests of the SQL specific parts
+func testSQL(t *testing.T, newSQL func(t *testing.T, lifetime time.Duration) (*SQL, func())) {
+	var (
+		_ openid.Cacher          = (*SQL)(nil)
+		_ openid.Claimsource     = (*SQL)(nil)
+		_ openid.ClientStore     = (*SQL)(nil)
+		_ openid.ConsentStore    = (*SQL)(nil)
+		_ openid.SessionStore    = (*SQL)(nil)
+		_ openid.RevocationStore = (*SQL)(nil)
+		_ openid.ReplayCache     = (*SQL)(nil)
+		_ RecordStore            = (*SQL)(nil)
+	)
+
+	t.Run("GC", func(t *testing.T) {
+		s, done := newSQL(t, 0)
+		defer done()
+
+		lifetime := s.CodeLifetime
+		s.CodeLifetime = time.Millisecond
+		err := s.Cache(openid.Session{Code: "code3"})
+		s.CodeLifetime = lifetime
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Cache(openid.Session{Code: "code4"}); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(5 * time.Millisecond)
+		if _, err := s.Redeem("code3"); err == nil {
+			t.Error("expired code valid")
+		}
+		if _, err := s.Redeem("code3"); err == nil {
+			t.Error("expired code redeemed")
+		}
+		if err := s.GC(); err != nil {
+			t.Fatal(err)
+		}
+		var n int
+		s.db.QueryRow(s.rebind(`SELECT COUNT(*) FROM openid_codes WHERE code = ?`), "code3").Scan(&n)
+		if n != 0 {
+			t.Error("expired code not removed")
+		}
+		if _, err := s.Redeem("code4"); err != nil {
+			t.Error("valid code removed")
+		}
+	})
+
+	storetest.RunCacherTests(t, func(t *testing.T, lifetime time.Duration) storetest.CacherSetup {
+		s, done := newSQL(t, lifetime)
+		return storetest.CacherSetup{Cacher: s, Close: done}
+	})
+	storetest.RunClientsourceTests(t, func(t *testing.T, clients []openid.Client) (openid.Clientsource, func()) {
+		s, done := newSQL(t, 0)
+		for _, c := range clients {
+			if err := s.SaveClient(c); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return s, done
+	})
+	storetest.RunClaimsourceTests(t, func(t *testing.T, users map[string]map[string]string) (openid.Claimsource, func()) {
+		s, done := newSQL(t, 0)
+		for sub, claims := range users {
+			if err := s.SaveUser(sub, claims); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return s, done
+	})
+	storetest.RunSessionStoreTests(t, func(t *testing.T, maxAge time.Duration) (openid.SessionStore, func()) {
+		s, done := newSQL(t, 0)
+		s.SessionMaxAge = maxAge
+		return s, done
+	})
+	storetest.RunConsentStoreTests(t, func(t *testing.T) (openid.ConsentStore, func()) {
+		return newSQL(t, 0)
+	})
+	storetest.RunRevocationStoreTests(t, func(t *testing.T) (openid.RevocationStore, func()) {
+		return newSQL(t, 0)
+	})
+	storetest.RunReplayCacheTests(t, func(t *testing.T) storetest.ReplayCacheSetup {
+		s, done := newSQL(t, 0)
+		return storetest.ReplayCacheSetup{Cache: s, Close: done}
+	})
+	runRecordStoreTests(t, func(t *testing.T) (RecordStore, func()) {
+		return newSQL(t, 0)
+	})
+}
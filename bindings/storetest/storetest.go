@@ -0,0 +1,781 @@
+// Package storetest checks that bindings implement the data interfaces of
+// the provider with the expected semantics. Call the runners from the tests
+// of a binding:
+//
+//	func TestConformance(t *testing.T) {
+//		storetest.RunCacherTests(t, func(t *testing.T, lifetime time.Duration) storetest.CacherSetup {
+//			m := &MyStore{CodeLifetime: lifetime}
+//			m.Init()
+//			return storetest.CacherSetup{Cacher: m, Close: m.Close}
+//		})
+//	}
+package storetest
+
+import (
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/openbolt/openid"
+)
+
+// CodeLifetime is passed to CacherFactory. Expiry tests wait for it to pass.
+const CodeLifetime = 500 * time.Millisecond
+
+// CacherSetup is a Cacher under test
+type CacherSetup struct {
+	Cacher openid.Cacher
+	// Lets time pass for expiry, time.Sleep if nil. Set this, if the backend
+	// uses a fake clock.
+	Sleep func(time.Duration)
+	// Called after the test, may be nil
+	Close func()
+}
+
+// CacherFactory returns an empty Cacher, whose codes expire after `lifetime`.
+// It is called once per test.
+type CacherFactory func(t *testing.T, lifetime time.Duration) CacherSetup
+
+// ClientsourceFactory returns a Clientsource which knows exactly `clients`.
+// It is called once per test. If the result implements openid.ClientStore,
+// saving and deleting is tested as well.
+type ClientsourceFactory func(t *testing.T, clients []openid.Client) (openid.Clientsource, func())
+
+// ClaimsourceFactory returns a Claimsource which knows exactly `users`, a map
+// of subjects to claims. It is called once per test.
+type ClaimsourceFactory func(t *testing.T, users map[string]map[string]string) (openid.Claimsource, func())
+
+// testSession has every field set, which must survive a round trip
+func testSession(code string) openid.Session {
+	return openid.Session{
+		Code:            code,
+		ClientID:        "clt1",
+		Sub:             "pairwise-alice",
+		LocalSub:        "alice",
+		Nonce:           "n-0S6_WzA2Mj",
+		Scope:           "openid email",
+		AuthTime:        time.Unix(1500000000, 0),
+		MaxAge:          time.Hour,
+		RequireAuthTime: true,
+		Acr:             "1",
+		ClaimsLocales:   "de en",
+		Claims: openid.ClaimsRequest{
+			IDToken: map[string]openid.ClaimRequest{
+				"email": {Essential: true},
+				"name":  {Default: true},
+			},
+		},
+		Sid:                 "sid1",
+		AccessTokenLifetime: time.Minute,
+		IDTokenLifetime:     time.Hour,
+		RedirectURI:         "https://rp.example.com/cb",
+		CodeChallenge:       "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM",
+		CodeChallengeMethod: "S256",
+		Resources:           []string{"https://api.example.com"},
+	}
+}
+
+func sameSession(a, b openid.Session) bool {
+	if !a.AuthTime.Equal(b.AuthTime) {
+		return false
+	}
+	a.AuthTime, b.AuthTime = time.Time{}, time.Time{}
+	return reflect.DeepEqual(a, b)
+}
+
+// RunCacherTests checks storing, redemption, expiry and concurrent use of
+// codes
+func RunCacherTests(t *testing.T, factory CacherFactory) {
+	setup := func(t *testing.T) (openid.Cacher, func(time.Duration)) {
+		s := factory(t, CodeLifetime)
+		if s.Close != nil {
+			t.Cleanup(s.Close)
+		}
+		if s.Sleep == nil {
+			s.Sleep = time.Sleep
+		}
+		return s.Cacher, s.Sleep
+	}
+
+	t.Run("CodeRoundTrip", func(t *testing.T) {
+		c, _ := setup(t)
+		want := testSession("code1")
+		if err := c.Cache(want); err != nil {
+			t.Fatal(err)
+		}
+		got, err := c.Redeem("code1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !sameSession(got, want) {
+			t.Errorf("got %+v, want %+v", got, want)
+		}
+	})
+
+	t.Run("UnknownCode", func(t *testing.T) {
+		c, _ := setup(t)
+		for _, code := range []string{"unknown", ""} {
+			if _, err := c.Redeem(code); err == nil || err == openid.ErrCodeRedeemed {
+				t.Errorf("%q: expected an error other than ErrCodeRedeemed, got %v", code, err)
+			}
+		}
+	})
+
+	t.Run("CodeNoOverwrite", func(t *testing.T) {
+		c, _ := setup(t)
+		if err := c.Cache(testSession("code1")); err != nil {
+			t.Fatal(err)
+		}
+		other := testSession("code1")
+		other.ClientID = "clt2"
+		if err := c.Cache(other); err == nil {
+			t.Error("code cached twice")
+		}
+		if got, err := c.Redeem("code1"); err != nil || got.ClientID != "clt1" {
+			t.Errorf("first session replaced: %+v, %v", got, err)
+		}
+	})
+
+	t.Run("CodeIsolation", func(t *testing.T) {
+		c, _ := setup(t)
+		codes := []string{"abc", "abcd", "ABC"}
+		for i, code := range codes {
+			ses := testSession(code)
+			ses.ClientID = "clt" + strconv.Itoa(i)
+			if err := c.Cache(ses); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := c.Redeem("ab"); err == nil {
+			t.Error("prefix of a code redeemed")
+		}
+		// Redeeming one code leaves the others alone
+		for i, code := range codes {
+			got, err := c.Redeem(code)
+			if err != nil || got.Code != code || got.ClientID != "clt"+strconv.Itoa(i) {
+				t.Errorf("%s: got %+v, %v", code, got, err)
+			}
+		}
+	})
+
+	t.Run("CodeRedeemOnce", func(t *testing.T) {
+		c, sleep := setup(t)
+		if err := c.Cache(testSession("code1")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.Redeem("code1"); err != nil {
+			t.Fatal(err)
+		}
+		got, err := c.Redeem("code1")
+		if err != openid.ErrCodeRedeemed {
+			t.Errorf("expected ErrCodeRedeemed, got %v", err)
+		}
+		// The session is optional on reuse, but must be the right one
+		if got.Code != "" && !sameSession(got, testSession("code1")) {
+			t.Errorf("got %+v with ErrCodeRedeemed", got)
+		}
+
+		// Never comes back, not even after the redemption might be
+		// garbage collected
+		sleep(2 * CodeLifetime)
+		if _, err := c.Redeem("code1"); err == nil {
+			t.Error("redeemed code came back")
+		}
+	})
+
+	t.Run("CodeExpiry", func(t *testing.T) {
+		c, sleep := setup(t)
+		for _, code := range []string{"code1", "code2"} {
+			if err := c.Cache(testSession(code)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := c.Redeem("code1"); err != nil {
+			t.Fatal("code expired early:", err)
+		}
+		sleep(CodeLifetime + 100*time.Millisecond)
+		if _, err := c.Redeem("code2"); err == nil {
+			t.Error("expired code redeemed")
+		}
+	})
+
+	t.Run("CodeConcurrent", func(t *testing.T) {
+		c, _ := setup(t)
+		const n = 50
+
+		var wg sync.WaitGroup
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				if err := c.Cache(testSession("code" + strconv.Itoa(i))); err != nil {
+					t.Error(err)
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		// Redeem each code from several goroutines at once, exactly one
+		// must succeed
+		var mu sync.Mutex
+		redeemed := make(map[string]int)
+		for i := 0; i < n; i++ {
+			for j := 0; j < 5; j++ {
+				wg.Add(1)
+				go func(code string) {
+					defer wg.Done()
+					ses, err := c.Redeem(code)
+					if err != nil {
+						return
+					}
+					if ses.Code != code {
+						t.Errorf("%s: got session of %s", code, ses.Code)
+					}
+					mu.Lock()
+					redeemed[code]++
+					mu.Unlock()
+				}("code" + strconv.Itoa(i))
+			}
+		}
+		wg.Wait()
+		for i := 0; i < n; i++ {
+			code := "code" + strconv.Itoa(i)
+			if redeemed[code] != 1 {
+				t.Errorf("%s redeemed %d times", code, redeemed[code])
+			}
+			if _, err := c.Redeem(code); err != openid.ErrCodeRedeemed {
+				t.Errorf("%s: expected ErrCodeRedeemed, got %v", code, err)
+			}
+		}
+	})
+}
+
+var testClients = []openid.Client{
+	{
+		ClientID:                "clt1",
+		RedirectURIs:            []string{"https://clt1.example.com/cb"},
+		ResponseTypes:           []string{"code"},
+		GrantTypes:              []string{"authorization_code"},
+		TokenEndpointAuthMethod: "client_secret_basic",
+		SecretHash:              "hash1",
+		AccessTokenLifetime:     60,
+		Trusted:                 true,
+	},
+	{
+		ClientID:     "clt10",
+		RedirectURIs: []string{"https://clt10.example.com/cb", "https://clt10.example.com/cb2"},
+		SubjectType:  "pairwise",
+	},
+}
+
+func checkClient(t *testing.T, got, want openid.Client) {
+	if got.ClientID != want.ClientID ||
+		!reflect.DeepEqual(got.RedirectURIs, want.RedirectURIs) ||
+		got.TokenEndpointAuthMethod != want.TokenEndpointAuthMethod ||
+		got.SecretHash != want.SecretHash ||
+		got.SubjectType != want.SubjectType ||
+		got.AccessTokenLifetime != want.AccessTokenLifetime ||
+		got.Trusted != want.Trusted {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+// RunClientsourceTests checks lookups of clients. If the Clientsource is an
+// openid.ClientStore, updates are checked as well.
+func RunClientsourceTests(t *testing.T, factory ClientsourceFactory) {
+	setup := func(t *testing.T) openid.Clientsource {
+		src, done := factory(t, testClients)
+		if done != nil {
+			t.Cleanup(done)
+		}
+		return src
+	}
+
+	t.Run("ClientLookup", func(t *testing.T) {
+		src := setup(t)
+		for _, want := range testClients {
+			got, err := src.GetClient(want.ClientID)
+			if err != nil {
+				t.Errorf("%s: %v", want.ClientID, err)
+				continue
+			}
+			checkClient(t, got, want)
+		}
+	})
+
+	t.Run("UnknownClient", func(t *testing.T) {
+		src := setup(t)
+		for _, id := range []string{"", "clt", "CLT1", "clt1 ", "clt100"} {
+			if c, err := src.GetClient(id); err == nil {
+				t.Errorf("%q returned %q", id, c.ClientID)
+			}
+		}
+	})
+
+	t.Run("ClientConcurrent", func(t *testing.T) {
+		src := setup(t)
+		var wg sync.WaitGroup
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func(want openid.Client) {
+				defer wg.Done()
+				got, err := src.GetClient(want.ClientID)
+				if err != nil || got.ClientID != want.ClientID {
+					t.Errorf("%s: got %+v, %v", want.ClientID, got, err)
+				}
+			}(testClients[i%len(testClients)])
+		}
+		wg.Wait()
+	})
+
+	t.Run("ClientStore", func(t *testing.T) {
+		src := setup(t)
+		store, ok := src.(openid.ClientStore)
+		if !ok {
+			t.Skip("not a ClientStore")
+		}
+
+		updated := testClients[0]
+		updated.RedirectURIs = []string{"https://clt1.example.com/new"}
+		updated.SecretHash = "hash2"
+		if err := store.SaveClient(updated); err != nil {
+			t.Fatal(err)
+		}
+		got, err := store.GetClient("clt1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkClient(t, got, updated)
+
+		if err := store.DeleteClient("clt1"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.GetClient("clt1"); err == nil {
+			t.Error("deleted client found")
+		}
+		if _, err := store.GetClient("clt10"); err != nil {
+			t.Error("deleting one client deleted another")
+		}
+		if err := store.DeleteClient("clt1"); err != nil {
+			t.Error("deleting an unknown client:", err)
+		}
+	})
+}
+
+var testUsers = map[string]map[string]string{
+	"alice": {"email": "alice@example.com", "name": "Alice"},
+	"bob":   {"email": "bob@example.com", "phone_number": "+1 555 0100"},
+}
+
+// RunClaimsourceTests checks lookups of claims
+func RunClaimsourceTests(t *testing.T, factory ClaimsourceFactory) {
+	setup := func(t *testing.T) openid.Claimsource {
+		src, done := factory(t, testUsers)
+		if done != nil {
+			t.Cleanup(done)
+		}
+		return src
+	}
+
+	t.Run("ClaimLookup", func(t *testing.T) {
+		src := setup(t)
+		for sub, claims := range testUsers {
+			for claim, want := range claims {
+				if got, ok := src.Get(sub, claim, "default"); !ok || got != want {
+					t.Errorf("%s %s: got %q, %v", sub, claim, got, ok)
+				}
+			}
+		}
+	})
+
+	t.Run("ClaimMissing", func(t *testing.T) {
+		src := setup(t)
+		for _, c := range []struct{ sub, claim string }{
+			{"alice", "phone_number"}, // bob's claim
+			{"bob", "name"},
+			{"carol", "email"},
+			{"", "email"},
+			{"alice", ""},
+		} {
+			if got, ok := src.Get(c.sub, c.claim, "default"); ok || got != "default" {
+				t.Errorf("%q %q: got %q, %v", c.sub, c.claim, got, ok)
+			}
+		}
+	})
+
+	t.Run("ClaimConcurrent", func(t *testing.T) {
+		src := setup(t)
+		var wg sync.WaitGroup
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func(sub string) {
+				defer wg.Done()
+				if got, ok := src.Get(sub, "email", ""); !ok || got != testUsers[sub]["email"] {
+					t.Errorf("%s: got %q, %v", sub, got, ok)
+				}
+			}([]string{"alice", "bob"}[i%2])
+		}
+		wg.Wait()
+	})
+}
+
+// SessionStoreFactory returns an empty SessionStore, which removes sessions
+// `maxAge` after their creation. It is called once per test.
+type SessionStoreFactory func(t *testing.T, maxAge time.Duration) (openid.SessionStore, func())
+
+// testSSOSession has every field set, which must survive a round trip
+func testSSOSession(id string) openid.SSOSession {
+	now := time.Now().Truncate(time.Second)
+	return openid.SSOSession{
+		ID:       id,
+		Sid:      "sid-" + id,
+		Sub:      "alice",
+		AuthTime: now.Add(-time.Minute),
+		Acr:      "1",
+		Amr:      "pwd",
+		Created:  now.Add(-time.Minute),
+		LastSeen: now,
+		Clients:  []string{"clt1", "clt10"},
+	}
+}
+
+func sameSSOSession(a, b openid.SSOSession) bool {
+	if !a.AuthTime.Equal(b.AuthTime) || !a.Created.Equal(b.Created) || !a.LastSeen.Equal(b.LastSeen) {
+		return false
+	}
+	a.AuthTime, b.AuthTime = time.Time{}, time.Time{}
+	a.Created, b.Created = time.Time{}, time.Time{}
+	a.LastSeen, b.LastSeen = time.Time{}, time.Time{}
+	return reflect.DeepEqual(a, b)
+}
+
+// RunSessionStoreTests checks storing, updating, expiry and removal of SSO
+// sessions
+func RunSessionStoreTests(t *testing.T, factory SessionStoreFactory) {
+	setup := func(t *testing.T) openid.SessionStore {
+		s, done := factory(t, time.Hour)
+		if done != nil {
+			t.Cleanup(done)
+		}
+		return s
+	}
+
+	t.Run("SessionRoundTrip", func(t *testing.T) {
+		s := setup(t)
+		want := testSSOSession("s1")
+		if err := s.SaveSSOSession(want); err != nil {
+			t.Fatal(err)
+		}
+		got, err := s.GetSSOSession("s1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !sameSSOSession(got, want) {
+			t.Errorf("got %+v, want %+v", got, want)
+		}
+	})
+
+	t.Run("SessionUpdate", func(t *testing.T) {
+		s := setup(t)
+		want := testSSOSession("s1")
+		if err := s.SaveSSOSession(want); err != nil {
+			t.Fatal(err)
+		}
+		want.LastSeen = want.LastSeen.Add(time.Second)
+		want.Clients = append(want.Clients, "clt2")
+		if err := s.SaveSSOSession(want); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := s.GetSSOSession("s1"); err != nil || !sameSSOSession(got, want) {
+			t.Errorf("got %+v, %v", got, err)
+		}
+	})
+
+	t.Run("SessionIsolation", func(t *testing.T) {
+		s := setup(t)
+		for _, id := range []string{"s1", "s10"} {
+			if err := s.SaveSSOSession(testSSOSession(id)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, id := range []string{"", "s", "S1", "s100"} {
+			if got, err := s.GetSSOSession(id); err == nil {
+				t.Errorf("%q returned %q", id, got.ID)
+			}
+		}
+		if err := s.DeleteSSOSession("s1"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.GetSSOSession("s1"); err == nil {
+			t.Error("deleted session found")
+		}
+		if got, err := s.GetSSOSession("s10"); err != nil || got.Sid != "sid-s10" {
+			t.Errorf("deleting one session deleted another: %+v, %v", got, err)
+		}
+		if err := s.DeleteSSOSession("unknown"); err != nil {
+			t.Error("deleting an unknown session:", err)
+		}
+	})
+
+	t.Run("SessionExpiry", func(t *testing.T) {
+		s := setup(t)
+		old := testSSOSession("s1")
+		old.Created = time.Now().Add(-2 * time.Hour)
+		if err := s.SaveSSOSession(old); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.GetSSOSession("s1"); err == nil {
+			t.Error("expired session found")
+		}
+	})
+}
+
+// ConsentStoreFactory returns an empty ConsentStore. It is called once per
+// test.
+type ConsentStoreFactory func(t *testing.T) (openid.ConsentStore, func())
+
+func sameGrant(a, b openid.Grant) bool {
+	if !a.GrantedAt.Equal(b.GrantedAt) {
+		return false
+	}
+	a.GrantedAt, b.GrantedAt = time.Time{}, time.Time{}
+	return reflect.DeepEqual(a, b)
+}
+
+// RunConsentStoreTests checks that grants are kept per subject and client
+func RunConsentStoreTests(t *testing.T, factory ConsentStoreFactory) {
+	setup := func(t *testing.T) openid.ConsentStore {
+		s, done := factory(t)
+		if done != nil {
+			t.Cleanup(done)
+		}
+		return s
+	}
+	grant := func(sub, clientID string) openid.Grant {
+		return openid.Grant{
+			Sub:       sub,
+			ClientID:  clientID,
+			Scopes:    []string{"openid", "email"},
+			Claims:    []string{"name"},
+			GrantedAt: time.Now().Truncate(time.Second),
+		}
+	}
+
+	t.Run("GrantRoundTrip", func(t *testing.T) {
+		s := setup(t)
+		want := grant("alice", "clt1")
+		if err := s.SaveGrant(want); err != nil {
+			t.Fatal(err)
+		}
+		got, err := s.GetGrant("alice", "clt1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !sameGrant(got, want) {
+			t.Errorf("got %+v, want %+v", got, want)
+		}
+
+		want.Scopes = append(want.Scopes, "phone")
+		if err := s.SaveGrant(want); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := s.GetGrant("alice", "clt1"); err != nil || !sameGrant(got, want) {
+			t.Errorf("grant not updated: %+v, %v", got, err)
+		}
+	})
+
+	// A grant for one client is invisible to other clients and subjects
+	t.Run("GrantIsolation", func(t *testing.T) {
+		s := setup(t)
+		if err := s.SaveGrant(grant("alice", "clt1")); err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range []struct{ sub, clientID string }{
+			{"alice", "clt10"},
+			{"alice", "clt"},
+			{"alice", ""},
+			{"bob", "clt1"},
+			{"alicec", "lt1"},
+			{"", "clt1"},
+		} {
+			if g, err := s.GetGrant(c.sub, c.clientID); err == nil {
+				t.Errorf("%q %q: got grant %+v", c.sub, c.clientID, g)
+			}
+		}
+	})
+
+	t.Run("DeleteGrants", func(t *testing.T) {
+		s := setup(t)
+		for _, g := range []openid.Grant{
+			grant("alice", "clt1"),
+			grant("bob", "clt1"),
+			grant("alice", "clt10"),
+		} {
+			if err := s.SaveGrant(g); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := s.DeleteGrants("clt1"); err != nil {
+			t.Fatal(err)
+		}
+		for _, sub := range []string{"alice", "bob"} {
+			if _, err := s.GetGrant(sub, "clt1"); err == nil {
+				t.Errorf("%s: grant of deleted client found", sub)
+			}
+		}
+		if _, err := s.GetGrant("alice", "clt10"); err != nil {
+			t.Error("grant of other client deleted")
+		}
+		if err := s.DeleteGrants("unknown"); err != nil {
+			t.Error("deleting grants of an unknown client:", err)
+		}
+	})
+}
+
+// RevocationStoreFactory returns an empty RevocationStore. It is called once
+// per test.
+type RevocationStoreFactory func(t *testing.T) (openid.RevocationStore, func())
+
+// RunRevocationStoreTests checks revocations of clients and codes
+func RunRevocationStoreTests(t *testing.T, factory RevocationStoreFactory) {
+	setup := func(t *testing.T) openid.RevocationStore {
+		s, done := factory(t)
+		if done != nil {
+			t.Cleanup(done)
+		}
+		return s
+	}
+
+	t.Run("RevokeClient", func(t *testing.T) {
+		s := setup(t)
+		if !s.RevokedBefore("clt1").IsZero() {
+			t.Error("not revoked client revoked")
+		}
+		first := time.Now().Truncate(time.Millisecond)
+		if err := s.Revoke("clt1", first); err != nil {
+			t.Fatal(err)
+		}
+		if got := s.RevokedBefore("clt1"); !got.Equal(first) {
+			t.Errorf("got %v, want %v", got, first)
+		}
+		for _, id := range []string{"clt10", "clt", ""} {
+			if !s.RevokedBefore(id).IsZero() {
+				t.Errorf("%q revoked", id)
+			}
+		}
+
+		later := first.Add(time.Minute)
+		if err := s.Revoke("clt1", later); err != nil {
+			t.Fatal(err)
+		}
+		if got := s.RevokedBefore("clt1"); !got.Equal(later) {
+			t.Errorf("got %v, want %v", got, later)
+		}
+	})
+
+	t.Run("RevokeCode", func(t *testing.T) {
+		s := setup(t)
+		if s.CodeRevoked("hash1") {
+			t.Error("not revoked code revoked")
+		}
+		if err := s.RevokeCode("hash1", time.Now().Add(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+		if !s.CodeRevoked("hash1") {
+			t.Error("revocation not saved")
+		}
+		for _, hash := range []string{"hash10", "hash", ""} {
+			if s.CodeRevoked(hash) {
+				t.Errorf("%q revoked", hash)
+			}
+		}
+	})
+}
+
+// ReplayCacheSetup is a ReplayCache under test
+type ReplayCacheSetup struct {
+	Cache openid.ReplayCache
+	// Lets time pass for expiry, time.Sleep if nil
+	Sleep func(time.Duration)
+	// Called after the test, may be nil
+	Close func()
+}
+
+// ReplayCacheFactory returns an empty ReplayCache. It is called once per test.
+type ReplayCacheFactory func(t *testing.T) ReplayCacheSetup
+
+// RunReplayCacheTests checks that identifiers are accepted once until they
+// expire
+func RunReplayCacheTests(t *testing.T, factory ReplayCacheFactory) {
+	setup := func(t *testing.T) (openid.ReplayCache, func(time.Duration)) {
+		s := factory(t)
+		if s.Close != nil {
+			t.Cleanup(s.Close)
+		}
+		if s.Sleep == nil {
+			s.Sleep = time.Sleep
+		}
+		return s.Cache, s.Sleep
+	}
+
+	t.Run("UseOnce", func(t *testing.T) {
+		c, _ := setup(t)
+		exp := time.Now().Add(time.Hour)
+		if ok, err := c.Use("jti1", exp); !ok || err != nil {
+			t.Errorf("first use: %v, %v", ok, err)
+		}
+		if ok, err := c.Use("jti1", exp); ok || err != nil {
+			t.Errorf("replay: %v, %v", ok, err)
+		}
+		for _, id := range []string{"jti10", "jti", "JTI1"} {
+			if ok, err := c.Use(id, exp); !ok || err != nil {
+				t.Errorf("%q: %v, %v", id, ok, err)
+			}
+		}
+	})
+
+	t.Run("UseExpiry", func(t *testing.T) {
+		c, sleep := setup(t)
+		// Expired identifiers are rejected by the caller, they needn't be
+		// remembered
+		if ok, _ := c.Use("jti1", time.Now().Add(-time.Second)); !ok {
+			t.Error("first use rejected")
+		}
+		if ok, _ := c.Use("jti1", time.Now().Add(time.Hour)); !ok {
+			t.Error("expired id still remembered")
+		}
+
+		if ok, _ := c.Use("jti2", time.Now().Add(CodeLifetime)); !ok {
+			t.Error("first use rejected")
+		}
+		sleep(CodeLifetime + 100*time.Millisecond)
+		if ok, _ := c.Use("jti2", time.Now().Add(time.Hour)); !ok {
+			t.Error("expired id still remembered")
+		}
+	})
+
+	t.Run("UseConcurrent", func(t *testing.T) {
+		c, _ := setup(t)
+		exp := time.Now().Add(time.Hour)
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		accepted := 0
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if ok, err := c.Use("jti1", exp); ok && err == nil {
+					mu.Lock()
+					accepted++
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+		if accepted != 1 {
+			t.Errorf("accepted %d times", accepted)
+		}
+	})
+}
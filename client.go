@@ -1,13 +1,189 @@
 package openid
 
-import "net/http"
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultAccessTokenLifetime is used, if the client has no own lifetime
+	DefaultAccessTokenLifetime = 300 * time.Second
+	// DefaultIDTokenLifetime is used, if the client has no own lifetime
+	DefaultIDTokenLifetime = 72 * time.Hour
+)
 
 // AuthenticateClient returns true when the client is successfuly authenticated as defined in OAuth 2.0 Spec
 // 9.  Client Authentication
-func (op *OpenID) AuthenticateClient(client_id string, req *http.Request) (bool, int) {
-	// BUG Implement
-	return true, 0
+// The registered token_endpoint_auth_method is used, unregistered methods
+// are rejected.
+func (op *OpenID) AuthenticateClient(clt Client, req *http.Request) (bool, int) {
+	switch clt.TokenEndpointAuthMethod {
+	case "none":
+		return true, 0
+	case "client_secret_post":
+		secret := req.PostFormValue("client_secret")
+		if secret == "" || !clt.validSecret(secret) {
+			return false, CLIENT_NOT_ALLOWED
+		}
+		return true, 0
+	default:
+		// client_secret_basic, the credentials are form-urlencoded
+		// Ref OAuth 2.0 rfc6749#section-2.3.1
+		user, pass, ok := req.BasicAuth()
+		if !ok {
+			return false, REQUIRE_401
+		}
+		id, err1 := url.QueryUnescape(user)
+		secret, err2 := url.QueryUnescape(pass)
+		if err1 != nil || err2 != nil || id != clt.ClientID || !clt.validSecret(secret) {
+			return false, REQUIRE_401
+		}
+		return true, 0
+	}
+}
+
+// Client holds the metadata of a registered client
+// Ref OpenID Connect Dynamic Client Registration 1.0, 2.  Client Metadata
+type Client struct {
+	ClientID         string `json:"client_id"`
+	ClientIDIssuedAt int64  `json:"client_id_issued_at,omitempty"`
+
+	RedirectURIs            []string        `json:"redirect_uris,omitempty"`
+	ResponseTypes           []string        `json:"response_types,omitempty"`
+	GrantTypes              []string        `json:"grant_types,omitempty"`
+	ApplicationType         string          `json:"application_type,omitempty"`
+	Contacts                []string        `json:"contacts,omitempty"`
+	ClientName              string          `json:"client_name,omitempty"`
+	LogoURI                 string          `json:"logo_uri,omitempty"`
+	ClientURI               string          `json:"client_uri,omitempty"`
+	PolicyURI               string          `json:"policy_uri,omitempty"`
+	TosURI                  string          `json:"tos_uri,omitempty"`
+	JWKSURI                 string          `json:"jwks_uri,omitempty"`
+	JWKS                    json.RawMessage `json:"jwks,omitempty"`
+	SectorIdentifierURI     string          `json:"sector_identifier_uri,omitempty"`
+	SubjectType             string          `json:"subject_type,omitempty"`
+	IDTokenSignedAlg        string          `json:"id_token_signed_response_alg,omitempty"`
+	IDTokenEncryptedAlg     string          `json:"id_token_encrypted_response_alg,omitempty"`
+	IDTokenEncryptedEnc     string          `json:"id_token_encrypted_response_enc,omitempty"`
+	UserinfoSignedAlg       string          `json:"userinfo_signed_response_alg,omitempty"`
+	UserinfoEncryptedAlg    string          `json:"userinfo_encrypted_response_alg,omitempty"`
+	UserinfoEncryptedEnc    string          `json:"userinfo_encrypted_response_enc,omitempty"`
+	RequestObjectSigningAlg string          `json:"request_object_signing_alg,omitempty"`
+	TokenEndpointAuthMethod string          `json:"token_endpoint_auth_method,omitempty"`
+	TokenEndpointAuthAlg    string          `json:"token_endpoint_auth_signing_alg,omitempty"`
+	DefaultMaxAge           int64           `json:"default_max_age,omitempty"`
+	RequireAuthTime         bool            `json:"require_auth_time,omitempty"`
+	DefaultAcrValues        []string        `json:"default_acr_values,omitempty"`
+	InitiateLoginURI        string          `json:"initiate_login_uri,omitempty"`
+	Scope                   string          `json:"scope,omitempty"`
+
+	// Ref OpenID Connect RP-Initiated Logout 1.0, 3.1.  Client Registration Metadata
+	PostLogoutRedirectURIs []string `json:"post_logout_redirect_uris,omitempty"`
+	// Ref OpenID Connect Back-Channel Logout 1.0, 2.2.  Indicating RP Support for Back-Channel Logout
+	BackchannelLogoutURI             string `json:"backchannel_logout_uri,omitempty"`
+	BackchannelLogoutSessionRequired bool   `json:"backchannel_logout_session_required,omitempty"`
+	// Ref OpenID Connect Front-Channel Logout 1.0, 2.  RP Logout
+	FrontchannelLogoutURI             string `json:"frontchannel_logout_uri,omitempty"`
+	FrontchannelLogoutSessionRequired bool   `json:"frontchannel_logout_session_required,omitempty"`
+
+	// Provider policy, can't be set by dynamic registration.
+	// Lifetimes are in seconds, if 0 the defaults are used.
+	AccessTokenLifetime int64 `json:"access_token_lifetime,omitempty"`
+	IDTokenLifetime     int64 `json:"id_token_lifetime,omitempty"`
+	// First-party clients don't need consent
+	Trusted bool `json:"trusted,omitempty"`
+	// Codes are only issued with a PKCE code_challenge
+	RequirePKCE bool `json:"require_pkce,omitempty"`
+
+	// Only stored, never sent to the client. Secrets are kept as hashes.
+	SecretHash            string `json:"secret_hash,omitempty"`
+	RegistrationTokenHash string `json:"registration_token_hash,omitempty"`
+}
+
+// ClientStore is a writable databinding for clients, used by dynamic client
+// registration
+type ClientStore interface {
+	Clientsource
+	SaveClient(c Client) error
+	DeleteClient(id string) error
+}
+
+// ValidRedirectURI returns true, if `uri` exactly matches a registered
+// redirect_uri
+// Ref 3.1.2.1.  Authentication Request, redirect_uri
+func (c Client) ValidRedirectURI(uri string) bool {
+	return containsAll(c.RedirectURIs, []string{uri})
+}
+
+// ValidPostLogoutRedirectURI returns true, if `uri` exactly matches a
+// registered post_logout_redirect_uri
+func (c Client) ValidPostLogoutRedirectURI(uri string) bool {
+	return containsAll(c.PostLogoutRedirectURIs, []string{uri})
+}
+
+// AllowsResponseType returns true, if the client registered `rt`. The order
+// of the values doesn't matter. Without registration only "code" is allowed.
+func (c Client) AllowsResponseType(rt string) bool {
+	registered := c.ResponseTypes
+	if len(registered) == 0 {
+		registered = []string{"code"}
+	}
+	want := strings.Fields(rt)
+	for _, r := range registered {
+		have := strings.Fields(r)
+		if len(have) == len(want) && containsAll(have, want) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsGrantType returns true, if the client registered `gt`. Without
+// registration only "authorization_code" is allowed.
+func (c Client) AllowsGrantType(gt string) bool {
+	if len(c.GrantTypes) == 0 {
+		return gt == "authorization_code"
+	}
+	return containsAll(c.GrantTypes, []string{gt})
+}
+
+// AllowsScopes returns true, if all `scopes` were registered. Without
+// registered scopes, everything is allowed. "openid" is always allowed.
+func (c Client) AllowsScopes(scopes []string) bool {
+	if c.Scope == "" {
+		return true
+	}
+	allowed := append(strings.Fields(c.Scope), "openid")
+	return containsAll(allowed, scopes)
+}
+
+// AccessTokenExpiresIn returns the lifetime of access tokens
+func (c Client) AccessTokenExpiresIn() time.Duration {
+	if c.AccessTokenLifetime > 0 {
+		return time.Duration(c.AccessTokenLifetime) * time.Second
+	}
+	return DefaultAccessTokenLifetime
+}
+
+// IDTokenExpiresIn returns the lifetime of ID Tokens
+func (c Client) IDTokenExpiresIn() time.Duration {
+	if c.IDTokenLifetime > 0 {
+		return time.Duration(c.IDTokenLifetime) * time.Second
+	}
+	return DefaultIDTokenLifetime
+}
+
+func (c Client) validSecret(secret string) bool {
+	return c.SecretHash != "" && hmac.Equal([]byte(hashSecret(secret)), []byte(c.SecretHash))
+}
 
-	// false, REQUIRE_401
-	// false, CLIENT_NOT_ALLOWED
+// InitialAccessTokenSource authorizes client registrations, if open
+// registration is disabled
+// Ref RFC 7591, 3.  Client Registration Endpoint
+type InitialAccessTokenSource interface {
+	ValidateInitialAccessToken(token string) bool
 }
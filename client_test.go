@@ -0,0 +1,60 @@
+package openid
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestAuthenticateClient(t *testing.T) {
+	op := NewProvider()
+	clt := Client{ClientID: "clt:1", SecretHash: hashSecret("s3cret")}
+
+	basic := func(id, secret string) *http.Request {
+		r, _ := http.NewRequest("POST", "/token", nil)
+		r.SetBasicAuth(url.QueryEscape(id), url.QueryEscape(secret))
+		return r
+	}
+	post := func(secret string) *http.Request {
+		r, _ := http.NewRequest("POST", "/token", strings.NewReader("client_secret="+secret))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return r
+	}
+
+	tests := []struct {
+		method string
+		r      *http.Request
+		ok     bool
+	}{
+		{"", basic("clt:1", "s3cret"), true},
+		{"client_secret_basic", basic("clt:1", "s3cret"), true},
+		{"client_secret_basic", basic("clt:1", "wrong"), false},
+		{"client_secret_basic", basic("clt:2", "s3cret"), false},
+		{"client_secret_basic", post("s3cret"), false},
+		{"client_secret_post", post("s3cret"), true},
+		{"client_secret_post", post("wrong"), false},
+		{"client_secret_post", basic("clt:1", "s3cret"), false},
+		{"none", post(""), true},
+	}
+	for i, test := range tests {
+		clt.TokenEndpointAuthMethod = test.method
+		if ok, _ := op.AuthenticateClient(clt, test.r); ok != test.ok {
+			t.Errorf("%d: expected %v, got %v", i, test.ok, ok)
+		}
+	}
+}
+
+func TestClientAllows(t *testing.T) {
+	clt := Client{ResponseTypes: []string{"code", "code id_token"}, Scope: "profile email"}
+
+	if !clt.AllowsResponseType("id_token code") || clt.AllowsResponseType("id_token") {
+		t.Error("unexpected response_type check")
+	}
+	if !clt.AllowsScopes([]string{"openid", "email"}) || clt.AllowsScopes([]string{"openid", "address"}) {
+		t.Error("unexpected scope check")
+	}
+	if !(Client{}).AllowsResponseType("code") || (Client{}).AllowsResponseType("id_token") {
+		t.Error("unexpected default response_type")
+	}
+}
@@ -0,0 +1,76 @@
+package openid
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// Authorization codes are either random values which reference a Session in
+// the Cache, or stateless: the code is the Session itself, sealed with
+// OpenID.CodeKeys. A stateless code carries a random `jti`, which is recorded
+// in OpenID.CodeReplay on redemption, so it can only be redeemed once.
+
+// codeAD binds sealed codes to their purpose, so other values sealed with the
+// same keys can't be used as code
+var codeAD = []byte("openid code")
+
+// statelessCode is the plaintext of a stateless code
+type statelessCode struct {
+	JTI     string  `json:"jti"`
+	Session Session `json:"ses"`
+}
+
+// issueCode returns a new code for `ses`, which is cached or sealed
+func (op *OpenID) issueCode(ses Session) (string, error) {
+	if op.StatelessCodes {
+		jti, err := GetRandomString(AuthzCodeOctetsRand)
+		if err != nil {
+			return "", err
+		}
+		data, err := json.Marshal(statelessCode{jti, ses})
+		if err != nil {
+			return "", err
+		}
+		return op.CodeKeys.Seal(data, codeAD)
+	}
+
+	code, err := GetRandomString(AuthzCodeOctetsRand)
+	if err != nil {
+		return "", err
+	}
+	ses.Code = code
+	return code, op.Cache.Cache(ses)
+}
+
+// redeemCode returns the Session of `code` and invalidates it. Like
+// Cacher.Redeem, ErrCodeRedeemed is returned on reuse, with the Session if it
+// is known.
+func (op *OpenID) redeemCode(code string) (Session, error) {
+	if !op.StatelessCodes {
+		return op.Cache.Redeem(code)
+	}
+
+	data, err := op.CodeKeys.Open(code, codeAD)
+	if err != nil {
+		return Session{}, errors.New("Invalid code")
+	}
+	var sc statelessCode
+	if err := json.Unmarshal(data, &sc); err != nil || sc.JTI == "" {
+		return Session{}, errors.New("Invalid code")
+	}
+	if time.Now().After(sc.Session.ExpiresAt) {
+		return Session{}, errors.New("Code expired")
+	}
+
+	// The jti is only needed until the code expires
+	fresh, err := op.CodeReplay.Use(sc.JTI, sc.Session.ExpiresAt)
+	if err != nil {
+		return Session{}, err
+	}
+	if !fresh {
+		return sc.Session, ErrCodeRedeemed
+	}
+	sc.Session.Code = code
+	return sc.Session, nil
+}
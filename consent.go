@@ -0,0 +1,353 @@
+package openid
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/openbolt/openid/utils"
+)
+
+// Grant records which scopes and claims an End-User has granted to a client
+type Grant struct {
+	Sub       string
+	ClientID  string
+	Scopes    []string
+	Claims    []string
+	GrantedAt time.Time
+}
+
+// Covers returns true, if all `scopes` and `claims` are granted
+func (g Grant) Covers(scopes, claims []string) bool {
+	return containsAll(g.Scopes, scopes) && containsAll(g.Claims, claims)
+}
+
+// ConsentStore persists the consent of End-Users per (subject, client)
+type ConsentStore interface {
+	// Returns an error, if nothing was granted yet
+	GetGrant(sub, clientID string) (Grant, error)
+	SaveGrant(g Grant) error
+	// Removes the grants of all End-Users for this client
+	DeleteGrants(clientID string) error
+}
+
+// ConsentIf is used for rendering the consent dialog
+// Ref 3.1.2.4.  Authorization Server Obtains End-User Consent/Authorization
+// The dialog is submitted back to the authorization endpoint. To keep the
+// End-User authenticated meanwhile, OpenID.Sessions should be set.
+type ConsentIf interface {
+	// Q: Did the End-User already decide (e.g. form submitted)?
+	//   Y: Return ConsentState:ConsentOk or ConsentDenied
+	//   N: Display the consent dialog, return ConsentPrompting
+	Consentpage(w http.ResponseWriter, r *http.Request, req ConsentRequest) ConsentState
+}
+
+// ConsentRequest describes what the client asks the End-User for
+type ConsentRequest struct {
+	Request *AuthenticationRequest
+	Sub     string
+	Scopes  []string
+	Claims  []string
+
+	// Bound to the SSO session or the browser, the client and the
+	// authentication. The consent dialog must check that the submitted
+	// decision carries this value (CSRF protection). Submitted as
+	// `_consent_token`, the authentication isn't required again, even with
+	// prompt=login, max_age or acr_values.
+	Token string
+}
+
+// ConsentState is used as the return value of ConsentIf
+type ConsentState struct {
+	ConsentOk        bool
+	ConsentDenied    bool
+	ConsentPrompting bool
+}
+
+// consent checks if the End-User has granted the requested scopes and claims
+// to the client. Otherwise the consent dialog is shown.
+// Returns false, if the request can't continue (error or dialog displayed).
+func (op *OpenID) consent(w http.ResponseWriter, r *http.Request, ar *AuthenticationRequest, clt Client, state AuthState, sso *SSOSession) (bool, AuthErrResp) {
+	// First-party clients don't need consent
+	if op.Consent == nil || clt.Trusted {
+		return true, AuthErrResp{}
+	}
+
+	scopes := strings.Fields(ar.Scope)
+	claims := requestedClaims(ar.Claims)
+	grant, err := op.Consent.GetGrant(state.Sub, ar.ClientID)
+	if err != nil {
+		grant = Grant{Sub: state.Sub, ClientID: ar.ClientID}
+	} else if grant.Covers(scopes, claims) && !ar.Prompt.Consent {
+		utils.EDebug(errors.New("Consent already granted"), r)
+		return true, AuthErrResp{}
+	}
+
+	resp := AuthErrResp{}
+	resp.State = ar.State
+	if ar.Prompt.None {
+		resp.Error = "consent_required"
+		utils.EDebug(errors.New("returning consent_required"), r)
+		return false, resp
+	}
+
+	page := op.Consentpage
+	if page == nil {
+		page = DefaultConsentPage{}
+	}
+	req := ConsentRequest{
+		Request: ar,
+		Sub:     state.Sub,
+		Scopes:  scopes,
+		Claims:  claims,
+	}
+	if req.Token, err = op.consentToken(w, r, sso, ar.ClientID, state.AuthTime); err != nil {
+		utils.ELog(err, r)
+		resp.Error = "server_error"
+		resp.ErrorDescription = "Server isn't able to fullfill your request"
+		return false, resp
+	}
+	cs := page.Consentpage(w, r, req)
+
+	switch {
+	case cs.ConsentOk:
+		grant.Scopes = mergeValues(grant.Scopes, scopes)
+		grant.Claims = mergeValues(grant.Claims, claims)
+		grant.GrantedAt = time.Now()
+		if err := op.Consent.SaveGrant(grant); err != nil {
+			utils.ELog(err, r)
+			resp.Error = "server_error"
+			resp.ErrorDescription = "Cannot save consent"
+			return false, resp
+		}
+		utils.EDebug(errors.New("Consent granted"), r)
+		return true, AuthErrResp{}
+	case cs.ConsentDenied:
+		resp.Error = "access_denied"
+		resp.ErrorDescription = "Consent denied"
+		utils.EDebug(errors.New("returning access_denied"), r)
+		return false, resp
+	default:
+		utils.EDebug(errors.New("Consent prompting"), r)
+		return false, AuthErrResp{}
+	}
+}
+
+// ConsentCookieName holds a random value, which binds the consent dialog to
+// the browser, if there is no SSO session
+const ConsentCookieName = "openid_consent"
+
+// consentResumeWindow limits how long a submitted consent dialog stands in
+// for prompt=login, max_age and acr_values
+const consentResumeWindow = 10 * time.Minute
+
+// consentBinding returns what the consent token is bound to: the SSO session
+// or the consent cookie of the browser. The id is empty, if there is neither.
+func consentBinding(r *http.Request, sso *SSOSession) (kind, id string) {
+	if sso != nil {
+		return "consent", sso.ID
+	}
+	if cookie, err := r.Cookie(ConsentCookieName); err == nil && cookie.Value != "" {
+		return "consent-browser", cookie.Value
+	}
+	return "", ""
+}
+
+// consentToken returns the CSRF token of the consent dialog. It is bound to the
+// SSO session or, without one, to a random cookie of the browser, which is set
+// if missing. It carries the time of the authentication, which met the
+// requirements of the request, see resumedAuth.
+func (op *OpenID) consentToken(w http.ResponseWriter, r *http.Request, sso *SSOSession, clientID string, authTime time.Time) (string, error) {
+	kind, id := consentBinding(r, sso)
+	if id == "" {
+		raw := make([]byte, 32)
+		if _, err := rand.Read(raw); err != nil {
+			return "", err
+		}
+		kind, id = "consent-browser", base64.RawURLEncoding.EncodeToString(raw)
+		http.SetCookie(w, &http.Cookie{
+			Name:     ConsentCookieName,
+			Value:    id,
+			Path:     "/",
+			Secure:   strings.HasPrefix(op.Issuer, "https:"),
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+	at := strconv.FormatInt(authTime.Unix(), 10)
+	return at + "." + op.sessionMAC(kind, id, clientID, at), nil
+}
+
+// resumedAuth returns the authentication time of a submitted consent dialog.
+// The dialog is only shown after prompt=login, max_age and acr_values have
+// been dealt with, so the End-User isn't asked to log in again, as long as the
+// same authentication is used. Otherwise the submitted form would lead to the
+// login and the dialog again and again.
+func (op *OpenID) resumedAuth(r *http.Request, clientID string) (time.Time, bool) {
+	token := GetParam(r, "_consent_token")
+	i := strings.IndexByte(token, '.')
+	if i < 0 {
+		return time.Time{}, false
+	}
+	sec, err := strconv.ParseInt(token[:i], 10, 64)
+	if err != nil || time.Since(time.Unix(sec, 0)) > consentResumeWindow {
+		return time.Time{}, false
+	}
+
+	var sso *SSOSession
+	if ses, ok := op.loadSSOSession(r); ok {
+		sso = &ses
+	}
+	kind, id := consentBinding(r, sso)
+	if id == "" {
+		return time.Time{}, false
+	}
+	want := token[:i] + "." + op.sessionMAC(kind, id, clientID, token[:i])
+	return time.Unix(sec, 0), hmac.Equal([]byte(token), []byte(want))
+}
+
+// requestedClaims returns the names of all claims requested with the claims
+// parameter
+func requestedClaims(c ClaimsRequest) []string {
+	var names []string
+	for k := range c.IDToken {
+		names = mergeValues(names, []string{k})
+	}
+	for k := range c.Userinfo {
+		names = mergeValues(names, []string{k})
+	}
+	return names
+}
+
+// containsAll returns true, if each of `vals` is in `set`
+func containsAll(set, vals []string) bool {
+	for _, v := range vals {
+		found := false
+		for _, s := range set {
+			if s == v {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// mergeValues appends all `vals` which are not yet in `set`
+func mergeValues(set, vals []string) []string {
+	for _, v := range vals {
+		if !containsAll(set, []string{v}) {
+			set = append(set, v)
+		}
+	}
+	return set
+}
+
+/*
+ * Default consent dialog
+ */
+
+// scopeDescriptions are displayed by DefaultConsentPage
+// Ref 5.4.  Requesting Claims using Scope Values
+var scopeDescriptions = map[string]string{
+	"openid":         "Sign you in",
+	"profile":        "Your basic profile (name, picture, locale, ...)",
+	"email":          "Your email address",
+	"address":        "Your postal address",
+	"phone":          "Your phone number",
+	"offline_access": "Access your data while you are not logged in",
+}
+
+var consentTemplate = template.Must(template.New("consent.html").Parse(`<!DOCTYPE html>
+<html>
+	<head>
+		<title>Authorize {{ .ClientID }}</title>
+	</head>
+	<body>
+		<p><strong>{{ .ClientID }}</strong> would like to:</p>
+		<ul>
+			{{ range .Scopes }}
+			<li>{{ . }}</li>
+			{{ end }}
+			{{ range .Claims }}
+			<li>Read your "{{ . }}"</li>
+			{{ end }}
+		</ul>
+		<form action="{{ .Baseurl }}" method="post">
+			<!-- keep request parameters -->
+			{{ range $key, $values := .Values }}{{ range $values }}
+			<input type="hidden" name="{{ $key }}" value="{{ . }}" />
+			{{ end }}{{ end }}
+			<input type="hidden" name="_consent_token" value="{{ .Token }}" />
+			<input type="submit" name="_consent" value="deny"/>
+			<input type="submit" name="_consent" value="allow"/>
+		</form>
+	</body>
+</html>
+`))
+
+// DefaultConsentPage is the ConsentIf used, if OpenID.Consentpage isn't set.
+// It lists the requested scopes and claims and lets the End-User allow or deny.
+type DefaultConsentPage struct{}
+
+// Consentpage renders the consent dialog or evaluates the submitted form
+func (DefaultConsentPage) Consentpage(w http.ResponseWriter, r *http.Request, req ConsentRequest) ConsentState {
+	// The decision must be submitted from the dialog (CSRF protection)
+	token := GetParam(r, "_consent_token")
+	if req.Token != "" && hmac.Equal([]byte(token), []byte(req.Token)) {
+		switch GetParam(r, "_consent") {
+		case "allow":
+			return ConsentState{ConsentOk: true}
+		case "deny":
+			return ConsentState{ConsentDenied: true}
+		}
+	}
+
+	var scopes []string
+	for _, s := range req.Scopes {
+		if d, ok := scopeDescriptions[s]; ok {
+			scopes = append(scopes, d)
+		} else {
+			scopes = append(scopes, s)
+		}
+	}
+
+	// Keep request parameters, so the request can continue on submit.
+	// Parameters like `resource` may be repeated.
+	vals := make(map[string][]string)
+	for k, v := range readParams(r) {
+		if !strings.HasPrefix(k, "_") {
+			vals[k] = v
+		}
+	}
+
+	x := struct {
+		ClientID string
+		Scopes   []string
+		Claims   []string
+		Baseurl  string
+		Values   map[string][]string
+		Token    string
+	}{
+		req.Request.ClientID,
+		scopes,
+		req.Claims,
+		r.URL.Path,
+		vals,
+		req.Token,
+	}
+
+	if err := consentTemplate.Execute(w, x); err != nil {
+		utils.ELog(err, r)
+	}
+	return ConsentState{ConsentPrompting: true}
+}
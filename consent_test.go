@@ -0,0 +1,171 @@
+package openid
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var reConsentToken = regexp.MustCompile(`name="_consent_token" value="([^"]*)"`)
+
+// newConsentProvider returns a provider, which asks for consent for clt1
+func newConsentProvider(t *testing.T, src *testSource) *OpenID {
+	c := src.clients["clt1"]
+	c.Trusted = false
+	src.clients["clt1"] = c
+
+	op := newTestProvider(t, src)
+	op.Consent = src
+	return op
+}
+
+// consentToken returns the token of the rendered consent dialog
+func consentToken(t *testing.T, w *httptest.ResponseRecorder) string {
+	m := reConsentToken.FindStringSubmatch(w.Body.String())
+	if m == nil || m[1] == "" {
+		t.Fatalf("expected consent dialog, got %q", w.Body.String())
+	}
+	return m[1]
+}
+
+func TestConsent(t *testing.T) {
+	src := newTestSource()
+	op := newConsentProvider(t, src)
+
+	// First use shows the consent dialog
+	vals, w := authorize(op, "_login=1", nil)
+	if vals != nil {
+		t.Fatalf("expected consent dialog, got %v", vals)
+	}
+	token := consentToken(t, w)
+	cookies := w.Result().Cookies()
+
+	// A crafted decision without the token is ignored
+	vals, w = authorize(op, "_consent=allow", cookies)
+	if vals != nil || len(src.grants) != 0 {
+		t.Fatalf("expected consent dialog, got %v", vals)
+	}
+	consentToken(t, w)
+
+	// Allow
+	vals, _ = authorize(op, "_consent=allow&_consent_token="+token, cookies)
+	if vals.Get("code") == "" || len(src.grants) != 1 {
+		t.Fatalf("expected code, got %v", vals)
+	}
+
+	// The grant is reused, even without interaction
+	vals, _ = authorize(op, "prompt=none", cookies)
+	if vals.Get("code") == "" {
+		t.Fatalf("expected code, got %v", vals)
+	}
+
+	// prompt=consent forces the dialog
+	vals, w = authorize(op, "prompt=consent", cookies)
+	if vals != nil {
+		t.Fatalf("expected consent dialog, got %v", vals)
+	}
+	consentToken(t, w)
+
+	// Deny
+	vals, _ = authorize(op, "prompt=consent&_consent=deny&_consent_token="+token, cookies)
+	if vals.Get("error") != "access_denied" {
+		t.Fatalf("expected access_denied, got %v", vals)
+	}
+
+	// Without grant, prompt=none fails
+	src.DeleteGrants("clt1")
+	vals, _ = authorize(op, "prompt=none", cookies)
+	if vals.Get("error") != "consent_required" {
+		t.Fatalf("expected consent_required, got %v", vals)
+	}
+}
+
+// Without SSO sessions, the token is bound to a browser cookie
+func TestConsentWithoutSessions(t *testing.T) {
+	src := newTestSource()
+	op := newConsentProvider(t, src)
+	op.Sessions = nil
+
+	// A crafted decision is ignored
+	vals, w := authorize(op, "_login=1&_consent=allow&_consent_token=", nil)
+	if vals != nil || len(src.grants) != 0 {
+		t.Fatalf("expected consent dialog, got %v", vals)
+	}
+	token := consentToken(t, w)
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != ConsentCookieName {
+		t.Fatalf("expected consent cookie, got %v", cookies)
+	}
+
+	// The token of another browser is ignored
+	vals, _ = authorize(op, "_login=1&_consent=allow&_consent_token="+token, nil)
+	if vals != nil || len(src.grants) != 0 {
+		t.Fatalf("expected consent dialog, got %v", vals)
+	}
+
+	vals, _ = authorize(op, "_login=1&_consent=allow&_consent_token="+token, cookies)
+	if vals.Get("code") == "" || len(src.grants) != 1 {
+		t.Fatalf("expected code, got %v", vals)
+	}
+}
+
+// Repeated parameters are kept in the dialog
+func TestConsentPageValues(t *testing.T) {
+	r, _ := http.NewRequest("GET", "/authorize?client_id=clt1&resource=https%3A%2F%2Fa.example.com&resource=https%3A%2F%2Fb.example.com", nil)
+	w := httptest.NewRecorder()
+	cs := DefaultConsentPage{}.Consentpage(w, r, ConsentRequest{
+		Request: &AuthenticationRequest{ClientID: "clt1"},
+		Scopes:  []string{"openid"},
+		Token:   "token",
+	})
+	if !cs.ConsentPrompting {
+		t.Fatalf("expected ConsentPrompting, got %+v", cs)
+	}
+	body := w.Body.String()
+	for _, v := range []string{"https://a.example.com", "https://b.example.com"} {
+		if !strings.Contains(body, `name="resource" value="`+v+`"`) {
+			t.Errorf("missing resource %s in %s", v, body)
+		}
+	}
+}
+
+// Submitting the dialog doesn't ask for the login of this flow again, which
+// would show the dialog again
+func TestConsentAfterForcedLogin(t *testing.T) {
+	for _, params := range []string{"prompt=login", "max_age=0", "acr_values=2"} {
+		t.Run(params, func(t *testing.T) {
+			src := newTestSource()
+			op := newConsentProvider(t, src)
+			op.AcrValuesSupported = []string{"0", "1", "2"}
+
+			vals, w := authorize(op, params+"&_login=1", nil)
+			if vals != nil {
+				t.Fatalf("expected consent dialog, got %v", vals)
+			}
+			token := consentToken(t, w)
+			// The step-up login replaced the session, a browser keeps the
+			// last cookie
+			var cookies []*http.Cookie
+			seen := make(map[string]bool)
+			all := w.Result().Cookies()
+			for i := len(all) - 1; i >= 0; i-- {
+				if !seen[all[i].Name] {
+					seen[all[i].Name] = true
+					cookies = append(cookies, all[i])
+				}
+			}
+
+			// Without the token, the login is required
+			if vals, w := authorize(op, params+"&_consent=allow", cookies); vals != nil || w.Body.String() != "login form" {
+				t.Fatalf("expected login form, got %v %q", vals, w.Body.String())
+			}
+
+			vals, _ = authorize(op, params+"&_consent=allow&_consent_token="+token, cookies)
+			if vals.Get("code") == "" || len(src.grants) != 1 {
+				t.Fatalf("expected code, got %v, %d grants", vals, len(src.grants))
+			}
+		})
+	}
+}
@@ -10,6 +10,7 @@ import (
 
 func main() {
 	op := openid.NewProvider()
+	op.Issuer = "https://localhost:8443"
 	src := &bindings.DummySource{}
 
 	// Add datasources
@@ -17,6 +18,11 @@ func main() {
 	op.Clientsrc = src
 	op.Enduser = src
 	op.Cache = src
+	op.Consent = src
+	op.Sessions = src
+	op.Clients = src
+	op.Revocations = src
+	op.OpenRegistration = true
 
 	// ssh-keygen -t ecdsa -f accesstoken_signkey.pem
 	op.AccessTokenSignKeyFile = "./accesstoken_signkey.pem"
@@ -24,7 +30,6 @@ func main() {
 	// Configure http api
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", helloWorld)
-	mux.HandleFunc("/.well-known/openid-configuration", finger)
 
 	op.AddServer(mux)
 
@@ -45,9 +50,4 @@ func helloWorld(w http.ResponseWriter, r *http.Request) {
 	w.Write(data)
 }
 
-func finger(w http.ResponseWriter, r *http.Request) {
-	data, _ := Asset("finger.json")
-	w.Write(data)
-}
-
 //go:generate go-bindata -o bindata.go hello.html finger.json
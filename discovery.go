@@ -0,0 +1,80 @@
+package openid
+
+import "strings"
+
+// Metadata describes the OpenID Provider configuration
+// Ref OpenID Connect Discovery 1.0, 3.  OpenID Provider Metadata
+type Metadata struct {
+	Issuer                           string   `json:"issuer"`
+	AuthorizationEndpoint            string   `json:"authorization_endpoint"`
+	TokenEndpoint                    string   `json:"token_endpoint"`
+	ResponseTypesSupported           []string `json:"response_types_supported"`
+	ResponseModesSupported           []string `json:"response_modes_supported,omitempty"`
+	GrantTypesSupported              []string `json:"grant_types_supported,omitempty"`
+	SubjectTypesSupported            []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported []string `json:"id_token_signing_alg_values_supported"`
+	ScopesSupported                  []string `json:"scopes_supported,omitempty"`
+	AcrValuesSupported               []string `json:"acr_values_supported,omitempty"`
+	RegistrationEndpoint             string   `json:"registration_endpoint,omitempty"`
+
+	// Ref OpenID Connect RP-Initiated Logout 1.0, 2.1.  OpenID Provider Discovery Metadata
+	EndSessionEndpoint string `json:"end_session_endpoint,omitempty"`
+
+	// Ref OpenID Connect Back-Channel Logout 1.0, 2.1.  Indicating OP Support for Back-Channel Logout
+	BackchannelLogoutSupported        bool `json:"backchannel_logout_supported"`
+	BackchannelLogoutSessionSupported bool `json:"backchannel_logout_session_supported"`
+
+	// Ref OpenID Connect Front-Channel Logout 1.0, 3.  OpenID Provider Discovery Metadata
+	FrontchannelLogoutSupported        bool `json:"frontchannel_logout_supported"`
+	FrontchannelLogoutSessionSupported bool `json:"frontchannel_logout_session_supported"`
+
+	// Ref OpenID Connect Session Management 1.0, 3.3.  OpenID Provider Discovery Metadata
+	CheckSessionIframe string `json:"check_session_iframe,omitempty"`
+
+	// Ref RFC 9207, 3.  Authorization Server Metadata
+	AuthorizationResponseIssParameterSupported bool `json:"authorization_response_iss_parameter_supported"`
+
+	// Ref RFC 8414, 2.  Authorization Server Metadata
+	CodeChallengeMethodsSupported []string `json:"code_challenge_methods_supported,omitempty"`
+}
+
+// Metadata returns the provider configuration, as served on
+// /.well-known/openid-configuration
+func (op *OpenID) Metadata() Metadata {
+	base := strings.TrimSuffix(op.Issuer, "/")
+
+	md := Metadata{
+		Issuer:                           op.Issuer,
+		AuthorizationEndpoint:            base + "/authorize",
+		TokenEndpoint:                    base + "/token",
+		ResponseTypesSupported:           []string{"code", "id_token", "id_token token", "code id_token", "code token", "code id_token token"},
+		ResponseModesSupported:           []string{"query", "fragment"},
+		GrantTypesSupported:              []string{"authorization_code", "implicit"},
+		SubjectTypesSupported:            []string{"public"},
+		IDTokenSigningAlgValuesSupported: []string{"ES256"},
+		ScopesSupported:                  []string{"openid"},
+		AcrValuesSupported:               op.AcrValuesSupported,
+
+		EndSessionEndpoint: base + "/logout",
+
+		BackchannelLogoutSupported:        op.Sessions != nil,
+		BackchannelLogoutSessionSupported: op.Sessions != nil,
+
+		FrontchannelLogoutSupported:        op.Sessions != nil,
+		FrontchannelLogoutSessionSupported: op.Sessions != nil,
+
+		AuthorizationResponseIssParameterSupported: true,
+
+		CodeChallengeMethodsSupported: []string{"plain", "S256"},
+	}
+	if len(op.PairwiseSalt) != 0 {
+		md.SubjectTypesSupported = append(md.SubjectTypesSupported, "pairwise")
+	}
+	if op.Clients != nil {
+		md.RegistrationEndpoint = base + "/register"
+	}
+	if op.Sessions != nil {
+		md.CheckSessionIframe = base + "/check_session"
+	}
+	return md
+}
@@ -3,6 +3,7 @@ package openid
 import (
 	"errors"
 	"net/http"
+	"time"
 
 	"github.com/openbolt/openid/utils"
 )
@@ -16,16 +17,24 @@ func (op *OpenID) Authorize(w http.ResponseWriter, r *http.Request) (AuthSuccess
 		return AuthSuccessResp{}, AuthErrResp{}
 	}
 
-	// ref 3.1.2.2
-	err1 := validateOAuthParams(r)             // ref Rule 1
-	err2 := validateScopeParam(r)              // ref Rule 2
-	err3 := validateReqParams(r, op.Clientsrc) // ref Rule 3
+	ar, err := ParseAuthenticationRequest(r)
+	if len(err.Error) != 0 {
+		return AuthSuccessResp{}, err
+	}
+	return op.AuthorizeRequest(w, r, ar)
+}
 
-	// Check first part of validation
-	if len(err1.Error) != 0 {
-		utils.EDebug(errors.New("Failed Rule 1"), r)
-		return AuthSuccessResp{}, err1
+// AuthorizeRequest processes an already parsed AuthenticationRequest
+func (op *OpenID) AuthorizeRequest(w http.ResponseWriter, r *http.Request, ar *AuthenticationRequest) (AuthSuccessResp, AuthErrResp) {
+	if !op.serving {
+		return AuthSuccessResp{}, AuthErrResp{}
 	}
+
+	// ref 3.1.2.2, Rule 1 is checked on parsing
+	err2 := validateScopeParam(r, ar)                   // ref Rule 2
+	clt, err3 := validateReqParams(r, ar, op.Clientsrc) // ref Rule 3
+
+	// Check first part of validation
 	if len(err2.Error) != 0 {
 		utils.EDebug(errors.New("Failed Rule 2"), r)
 		return AuthSuccessResp{}, err2
@@ -35,8 +44,83 @@ func (op *OpenID) Authorize(w http.ResponseWriter, r *http.Request) (AuthSuccess
 		return AuthSuccessResp{}, err3
 	}
 
+	// Ref OpenID Connect Dynamic Client Registration 1.0, 2.  default_max_age
+	if !ar.MaxAgeSet && clt.DefaultMaxAge > 0 {
+		ar.MaxAge = time.Duration(clt.DefaultMaxAge) * time.Second
+		ar.MaxAgeSet = true
+	}
+
+	hintSub, err7 := op.subjectHint(r, ar)
+	if len(err7.Error) != 0 {
+		utils.EDebug(errors.New("Failed id_token_hint validation"), r)
+		return AuthSuccessResp{}, err7
+	}
+	prompt := ar.Prompt
+	// A submitted consent dialog doesn't ask for a new login
+	resumeAt, resuming := op.resumedAuth(r, ar.ClientID)
+	hints := AuthHints{Request: ar, Prompt: prompt, ForceLogin: prompt.Login && !resuming}
+	hints.AcrValues, hints.AcrEssential = requestedAcr(ar, clt)
+	// A pairwise subject can't be mapped back, it's only checked after
+	// authentication
+	if clt.SubjectType != "pairwise" {
+		hints.Sub = hintSub
+	}
+	start := time.Now()
+
 	// Ref 3.1.2.3.  Authorization Server Authenticates End-User
-	state := op.Enduser.Authpage(w, r)
+	state, sso := op.authenticate(w, r, hints)
+	resumed := resuming && state.AuthOk && state.AuthTime.Unix() == resumeAt.Unix()
+
+	// With prompt=none, the End-User must already be authenticated
+	if prompt.None && !state.AuthOk {
+		utils.EDebug(errors.New("prompt=none, but not authenticated"), r)
+		err := AuthErrResp{}
+		switch {
+		case state.AuthAccountSelectionRequired:
+			err.Error = "account_selection_required"
+		case state.AuthInteractionRequired:
+			err.Error = "interaction_required"
+		default:
+			err.Error = "login_required"
+		}
+		err.State = ar.State
+		return AuthSuccessResp{}, err
+	}
+
+	// Ref 3.1.2.1. max_age and prompt=login
+	// If the authentication is too old, actively re-authenticate the End-User
+	if state.AuthOk && !resumed && !authFresh(state, start, ar, prompt.Login) {
+		utils.EDebug(errors.New("Authentication too old, forcing login"), r)
+		if !prompt.None {
+			hints.ForceLogin = true
+			state, sso = op.authenticate(w, r, hints)
+		}
+		if prompt.None || (state.AuthOk && !authFresh(state, start, ar, prompt.Login)) {
+			err := AuthErrResp{}
+			err.Error = "login_required"
+			err.ErrorDescription = "Re-authentication required"
+			err.State = ar.State
+			return AuthSuccessResp{}, err
+		}
+	}
+
+	// Step-up, if the authentication doesn't meet the requested acr
+	// Ref 5.5.1.1.  Requesting the "acr" Claim
+	if state.AuthOk && !op.acrSatisfies(state.Acr, hints.AcrValues) {
+		utils.EDebug(errors.New("acr "+state.Acr+" too weak, forcing login"), r)
+		if !prompt.None && !hints.ForceLogin && !resumed {
+			hints.ForceLogin = true
+			state, sso = op.authenticate(w, r, hints)
+		}
+		if hints.AcrEssential && (prompt.None || (state.AuthOk && !op.acrSatisfies(state.Acr, hints.AcrValues))) {
+			// Ref OpenID Connect Core Unmet Authentication Requirements 1.0
+			err := AuthErrResp{}
+			err.Error = "unmet_authentication_requirements"
+			err.ErrorDescription = "Requested acr not satisfied"
+			err.State = ar.State
+			return AuthSuccessResp{}, err
+		}
+	}
 
 	// Respond to enduser if not successfully authenticated
 	if state.AuthAbort {
@@ -44,14 +128,14 @@ func (op *OpenID) Authorize(w http.ResponseWriter, r *http.Request) (AuthSuccess
 		err := AuthErrResp{}
 		err.Error = "login_required"
 		err.ErrorDescription = "Authentication aborted"
-		err.State = GetParam(r, "state")
+		err.State = ar.State
 		return AuthSuccessResp{}, err
 	} else if state.AuthFailed {
 		utils.EDebug(errors.New("Auth failed"), r)
 		err := AuthErrResp{}
 		err.Error = "access_denied"
 		err.ErrorDescription = "Authentication failed"
-		err.State = GetParam(r, "state")
+		err.State = ar.State
 		return AuthSuccessResp{}, err
 	} else if state.AuthPrompting {
 		utils.EDebug(errors.New("Auth prompting"), r)
@@ -60,38 +144,116 @@ func (op *OpenID) Authorize(w http.ResponseWriter, r *http.Request) (AuthSuccess
 	} else if !state.AuthOk {
 		utils.EDebug(errors.New("Auth requests reload"), r)
 		// Reload page using the same method
-		w.Header().Set("Location", r.RequestURI)
+		w.Header().Set("Location", r.URL.RequestURI())
 		w.WriteHeader(http.StatusTemporaryRedirect)
+		return AuthSuccessResp{}, AuthErrResp{}
 	} else if state.AuthOk {
 		utils.EDebug(errors.New("Authpage returned ok"), r)
 	}
 
 	// Can only be checked after authentification
 	// (compare "sub" with requested `claims`->`sub`)
-	err4 := validateSubParam(r, state.Sub) // ref Rule 4
+	sub, serr := op.subjectFor(clt, state.Sub)
+	if serr != nil {
+		return AuthSuccessResp{}, issueFailed(serr, r, ar)
+	}
+	err4 := validateSubParam(r, ar, hintSub, sub) // ref Rule 4
 	if len(err4.Error) != 0 {
 		utils.EDebug(errors.New("Failed Rule 4"), r)
 		return AuthSuccessResp{}, err4
 	}
 
+	// Ref 3.1.2.4.  Authorization Server Obtains End-User Consent/Authorization
+	if ok, err := op.consent(w, r, ar, clt, state, sso); !ok {
+		return AuthSuccessResp{}, err
+	}
+
+	// Remember the client for logout notifications
+	var sid string
+	if sso != nil {
+		op.addSSOClient(r, sso, ar.ClientID)
+		sid = sso.Sid
+	}
+
 	// Run through flow
 	// ref 3
-	switch getFlow(GetParam(r, "response_type")) {
+	var resp AuthSuccessResp
+	var err AuthErrResp
+	switch getFlow(ar.ResponseType) {
 	case "authorization_code":
 		utils.EDebug(errors.New("Using authzCodeFlow"), r)
-		return op.authzCodeFlow(r, state)
+		resp, err = op.authzCodeFlow(r, ar, clt, state, sid)
 	case "implicit":
 		utils.EDebug(errors.New("Using implicit flow"), r)
-		return op.implicitFlow(r, state)
+		resp, err = op.implicitFlow(r, ar, clt, state, sid)
 	case "hybrid":
 		utils.EDebug(errors.New("Using hybrid flow"), r)
-		return op.hybridFlow(r, state)
+		resp, err = op.hybridFlow(r, ar, clt, state, sid)
 	default:
 		utils.EDebug(errors.New("invalid response_type, cannot find flow"), r)
-		err := AuthErrResp{}
 		err.Error = "invalid_request"
 		err.ErrorDescription = "Invalid `code` request sent"
-		err.State = GetParam(r, "state")
+		err.State = ar.State
 		return AuthSuccessResp{}, err
 	}
+
+	// Ref OpenID Connect Session Management 1.0, 3.  Creating and Updating Sessions
+	if resp.ok && sso != nil {
+		resp.SessionState = op.sessionState(ar, sso)
+	}
+	return resp, err
+}
+
+// authenticate returns the authentication state of the End-User. An existing
+// SSO session is reused, so the EnduserIf is only asked if interaction is
+// needed. With prompt=none no user interface may be displayed, so the output
+// of Authpage is discarded.
+// Returns the SSO session, if sessions are enabled and the End-User is
+// authenticated.
+func (op *OpenID) authenticate(w http.ResponseWriter, r *http.Request, hints AuthHints) (AuthState, *SSOSession) {
+	if ses, ok := op.loadSSOSession(r); ok {
+		if !hints.ForceLogin && !hints.Prompt.SelectAccount && (hints.Sub == "" || hints.Sub == ses.Sub) {
+			utils.EDebug(errors.New("Reusing SSO session"), r)
+			ses = op.touchSSOSession(r, ses)
+			return AuthState{
+				AuthOk:   true,
+				Sub:      ses.Sub,
+				AuthTime: ses.AuthTime,
+				Acr:      ses.Acr,
+				Amr:      ses.Amr,
+			}, &ses
+		}
+	} else if op.Sessions != nil && hints.Prompt.None {
+		// Not logged in, no need to ask the EnduserIf
+		return AuthState{}, nil
+	}
+
+	var state AuthState
+	if hints.Prompt.None {
+		state = op.Enduser.Authpage(&discardWriter{}, r, hints)
+	} else {
+		state = op.Enduser.Authpage(w, r, hints)
+	}
+
+	if !state.AuthOk || op.Sessions == nil {
+		return state, nil
+	}
+	ses, err := op.startSSOSession(w, r, state)
+	if err != nil {
+		utils.ELog(err, r)
+		return state, nil
+	}
+	return state, &ses
+}
+
+// authFresh returns false, if the authentication is older than max_age. With
+// prompt=login, the End-User must have been authenticated during this request.
+func authFresh(state AuthState, start time.Time, ar *AuthenticationRequest, login bool) bool {
+	if login {
+		return !state.AuthTime.Before(start)
+	}
+	if ar.MaxAgeSet {
+		return !state.AuthTime.Before(start.Add(-ar.MaxAge))
+	}
+	return true
 }
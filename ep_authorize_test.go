@@ -0,0 +1,174 @@
+package openid
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+func TestPromptNone(t *testing.T) {
+	src := newTestSource()
+	op := newTestProvider(t, src)
+	// Without SSO sessions, the EnduserIf decides, its output is discarded
+	op.Sessions = nil
+
+	tests := []struct {
+		silent AuthState
+		error  string
+	}{
+		{AuthState{}, "login_required"},
+		{AuthState{AuthPrompting: true}, "login_required"},
+		{AuthState{AuthInteractionRequired: true}, "interaction_required"},
+		{AuthState{AuthAccountSelectionRequired: true}, "account_selection_required"},
+	}
+	for _, test := range tests {
+		src.silent = test.silent
+		vals, w := authorize(op, "prompt=none", nil)
+		if vals.Get("error") != test.error || vals.Get("state") != "xyz" {
+			t.Errorf("%+v: expected %s, got %v", test.silent, test.error, vals)
+		}
+		if strings.Contains(w.Body.String(), "login form") {
+			t.Errorf("%+v: user interface displayed: %s", test.silent, w.Body)
+		}
+	}
+
+	src.silent = AuthState{AuthOk: true, Sub: "alice", AuthTime: time.Now()}
+	if vals, _ := authorize(op, "prompt=none", nil); vals.Get("code") == "" {
+		t.Errorf("expected code, got %v", vals)
+	}
+
+	// none can't be combined with other values
+	if vals, _ := authorize(op, "prompt=none+login", nil); vals.Get("error") != "invalid_request" {
+		t.Errorf("expected invalid_request, got %v", vals)
+	}
+}
+
+func TestPromptLogin(t *testing.T) {
+	src := newTestSource()
+	op := newTestProvider(t, src)
+
+	_, w := authorize(op, "_login=1", nil)
+	cookies := w.Result().Cookies()
+
+	// The session is reused without prompt=login
+	before := src.authpages
+	if vals, _ := authorize(op, "", cookies); vals.Get("code") == "" || src.authpages != before {
+		t.Fatalf("expected silent authentication, got %v", vals)
+	}
+
+	// With prompt=login, Authpage is asked, even though a session exists
+	vals, w := authorize(op, "prompt=login", cookies)
+	if vals != nil || w.Body.String() != "login form" || src.authpages != before+1 {
+		t.Fatalf("expected login form, got %v", vals)
+	}
+	if vals, _ := authorize(op, "prompt=login&_login=1", cookies); vals.Get("code") == "" {
+		t.Errorf("expected code, got %v", vals)
+	}
+}
+
+// An Authpage requesting a reload gets a redirect, never a code
+func TestAuthpageReload(t *testing.T) {
+	src := newTestSource()
+	op := newTestProvider(t, src)
+
+	vals, w := authorize(op, "_reload=1", nil)
+	if vals != nil || w.Code != http.StatusTemporaryRedirect || len(src.codes) != 0 {
+		t.Errorf("expected reload, got %d %v", w.Code, vals)
+	}
+	if loc := w.Header().Get("Location"); !strings.HasPrefix(loc, "/authorize?") {
+		t.Errorf("expected redirect to the request, got %q", loc)
+	}
+}
+
+func TestMaxAge(t *testing.T) {
+	src := newTestSource()
+	op := newTestProvider(t, src)
+
+	_, w := authorize(op, "_login=1", nil)
+	cookies := w.Result().Cookies()
+
+	// A recent enough authentication is reused
+	before := src.authpages
+	if vals, _ := authorize(op, "max_age=3600", cookies); vals.Get("code") == "" || src.authpages != before {
+		t.Fatalf("expected silent authentication, got %v", vals)
+	}
+
+	// An older one forces re-authentication
+	vals, w := authorize(op, "max_age=0", cookies)
+	if vals != nil || w.Body.String() != "login form" {
+		t.Fatalf("expected login form, got %v", vals)
+	}
+	if vals, _ := authorize(op, "max_age=0&prompt=none", cookies); vals.Get("error") != "login_required" {
+		t.Fatalf("expected login_required, got %v", vals)
+	}
+
+	// The ID Token carries auth_time
+	start := time.Now().Add(-time.Second)
+	vals, _ = authorize(op, "max_age=0&_login=1", cookies)
+	ses := src.codes[vals.Get("code")]
+	if !ses.RequireAuthTime || ses.AuthTime.Before(start) {
+		t.Fatalf("expected fresh auth_time, got %+v", ses)
+	}
+	resp, _ := exchange(op, vals.Get("code"))
+	raw, _ := resp["id_token"].(string)
+	tok, err := jwt.Parse(raw, func(*jwt.Token) (interface{}, error) { return &op.accessTokenSignKey.PublicKey, nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if authTime, _ := tok.Claims["auth_time"].(float64); int64(authTime) != ses.AuthTime.Unix() {
+		t.Errorf("expected auth_time %d, got %v", ses.AuthTime.Unix(), tok.Claims["auth_time"])
+	}
+
+	// max_age is a number of seconds
+	if vals, _ := authorize(op, "max_age=1h", cookies); vals.Get("error") != "invalid_request" {
+		t.Errorf("expected invalid_request, got %v", vals)
+	}
+}
+
+// idTokenHint returns an ID Token of op for `sub` and `clientID`
+func idTokenHint(t *testing.T, op *OpenID, sub, clientID string, lifetime time.Duration) string {
+	tok, err := NewIDToken(Session{Sub: sub, ClientID: clientID, IDTokenLifetime: lifetime}, op.Issuer, op.accessTokenSignKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tok.TokenSignedString
+}
+
+func TestSubjectRequests(t *testing.T) {
+	src := newTestSource()
+	op := newTestProvider(t, src)
+	_, w := authorize(op, "_login=1", nil)
+	cookies := w.Result().Cookies()
+
+	tests := []struct {
+		name   string
+		params string
+		error  string
+	}{
+		{"hint", "id_token_hint=" + idTokenHint(t, op, "alice", "clt1", time.Hour), ""},
+		{"expired hint", "id_token_hint=" + idTokenHint(t, op, "alice", "clt1", -time.Hour), ""},
+		{"hint for another subject", "id_token_hint=" + idTokenHint(t, op, "bob", "clt1", time.Hour), "login_required"},
+		{"hint for another client", "id_token_hint=" + idTokenHint(t, op, "alice", "clt2", time.Hour), "invalid_request"},
+		{"forged hint", "id_token_hint=" + idTokenHint(t, op, "alice", "clt1", time.Hour) + "x", "invalid_request"},
+		{"sub claim", "claims=" + url.QueryEscape(`{"id_token":{"sub":{"value":"alice"}}}`), ""},
+		{"sub claim of another subject", "claims=" + url.QueryEscape(`{"id_token":{"sub":{"value":"bob"}}}`), "login_required"},
+	}
+	for _, test := range tests {
+		vals, _ := authorize(op, "_login=1&"+test.params, cookies)
+		if test.error == "" && vals.Get("code") == "" {
+			t.Errorf("%s: expected code, got %v", test.name, vals)
+		} else if test.error != "" && vals.Get("error") != test.error {
+			t.Errorf("%s: expected %s, got %v", test.name, test.error, vals)
+		}
+	}
+
+	// The session of another subject isn't reused silently
+	hint := idTokenHint(t, op, "bob", "clt1", time.Hour)
+	if vals, _ := authorize(op, "prompt=none&id_token_hint="+hint, cookies); vals.Get("error") != "login_required" {
+		t.Errorf("expected login_required, got %v", vals)
+	}
+}
@@ -1,9 +1,14 @@
 package openid
 
 import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
 	"errors"
 	"net/http"
+	"net/url"
 	"strings"
+	"time"
 
 	"github.com/openbolt/openid/utils"
 )
@@ -15,6 +20,9 @@ func (op *OpenID) Token(w http.ResponseWriter, r *http.Request) (AuthSuccessResp
 	}
 
 	clientID := GetParam(r, "client_id")
+	if user, _, ok := r.BasicAuth(); ok && clientID == "" {
+		clientID, _ = url.QueryUnescape(user)
+	}
 	if clientID == "" {
 		err := AuthErrResp{
 			Error:            "invalid_client",
@@ -24,8 +32,18 @@ func (op *OpenID) Token(w http.ResponseWriter, r *http.Request) (AuthSuccessResp
 		return AuthSuccessResp{}, err
 	}
 
+	clt, cerr := op.Clientsrc.GetClient(clientID)
+	if cerr != nil {
+		err := AuthErrResp{
+			Error:            "invalid_client",
+			ErrorDescription: "Unknown client",
+		}
+		utils.EDebug(errors.New("returning invalid_client"), r)
+		return AuthSuccessResp{}, err
+	}
+
 	// Authenticate the Client if it was issued Client Credentials or if it uses another Client Authentication method, per Section 9.
-	if authok, autherr := op.AuthenticateClient(clientID, r); !authok {
+	if authok, autherr := op.AuthenticateClient(clt, r); !authok {
 		err := AuthErrResp{Error: "Undefined"}
 		switch autherr {
 		case CLIENT_NOT_ALLOWED:
@@ -48,11 +66,38 @@ func (op *OpenID) Token(w http.ResponseWriter, r *http.Request) (AuthSuccessResp
 		return AuthSuccessResp{}, err
 	}
 
+	// Only the Authorization Code Flow uses the token endpoint
+	// Ref RFC 6749, 5.2.  Error Response
+	if GetParam(r, "grant_type") != "authorization_code" {
+		err := AuthErrResp{
+			Error:            "unsupported_grant_type",
+			ErrorDescription: "Only grant_type authorization_code is supported",
+		}
+		utils.EDebug(errors.New("returning unsupported_grant_type"), r)
+		return AuthSuccessResp{}, err
+	}
+
+	if !clt.AllowsGrantType("authorization_code") {
+		err := AuthErrResp{
+			Error:            "unauthorized_client",
+			ErrorDescription: "grant_type not registered for this client",
+		}
+		utils.EDebug(errors.New("returning unauthorized_client"), r)
+		return AuthSuccessResp{}, err
+	}
+
 	// Ensure the Authorization Code was issued to the authenticated Client.
 	// Verify that the Authorization Code is valid.
-	// If possible, verify that the Authorization Code has not been previously used. => On exchange, the code will be retired
-	session, err := op.Cache.GetSession(GetParam(r, "code"))
-	if err != nil || session.ClientID != clientID {
+	// If possible, verify that the Authorization Code has not been previously used. => Redeem invalidates the code at once
+	// The code is burnt before the client is checked, on purpose: a code
+	// presented by the wrong client has leaked, so it must not stay usable
+	// for the legitimate one either.
+	code := GetParam(r, "code")
+	session, err := op.redeemCode(code)
+	if err == ErrCodeRedeemed {
+		op.revokeCode(code, session, clt, r)
+	}
+	if err != nil || session.ClientID != clientID || time.Now().After(session.ExpiresAt) {
 		err := AuthErrResp{
 			Error:            "invalid_grant",
 			ErrorDescription: "Authorization Code is invalid",
@@ -62,7 +107,11 @@ func (op *OpenID) Token(w http.ResponseWriter, r *http.Request) (AuthSuccessResp
 	}
 
 	// Ensure that the redirect_uri parameter value is identical to the redirect_uri parameter value that was included in the initial Authorization Request. If the redirect_uri parameter value is not present when there is only one registered redirect_uri value, the Authorization Server MAY return an error (since the Client should have included the parameter) or MAY proceed without an error (since OAuth 2.0 permits the parameter to be omitted in this case).
-	if !op.Clientsrc.ValidateRedirectURI(clientID, GetParam(r, "redirect_uri")) {
+	// Ref RFC 6749, 4.1.3.  Access Token Request: if the "redirect_uri"
+	// parameter was included in the authorization request [...] their values
+	// MUST be identical.
+	redirectURI := GetParam(r, "redirect_uri")
+	if redirectURI != session.RedirectURI || !clt.ValidRedirectURI(redirectURI) {
 		err := AuthErrResp{
 			Error:            "invalid_grant",
 			ErrorDescription: "Redirection URI is invalid",
@@ -71,6 +120,41 @@ func (op *OpenID) Token(w http.ResponseWriter, r *http.Request) (AuthSuccessResp
 		return AuthSuccessResp{}, err
 	}
 
+	// Ref RFC 7636, 4.6.  Server Verifies code_verifier before Returning the Tokens
+	if !verifyCodeChallenge(session, GetParam(r, "code_verifier")) {
+		err := AuthErrResp{
+			Error:            "invalid_grant",
+			ErrorDescription: "PKCE verification failed",
+		}
+		utils.EDebug(errors.New("returning invalid_grant"), r)
+		return AuthSuccessResp{}, err
+	}
+
+	// The client registration may have changed since the code was issued
+	if !clt.AllowsScopes(strings.Fields(session.Scope)) {
+		err := AuthErrResp{
+			Error:            "invalid_grant",
+			ErrorDescription: "Scope no longer allowed for this client",
+		}
+		utils.EDebug(errors.New("returning invalid_grant"), r)
+		return AuthSuccessResp{}, err
+	}
+
+	// Ref RFC 8707, 2.2.  Access Token Request: the requested resources must
+	// have been granted by the authorization request. They restrict the
+	// access token.
+	if res := readParams(r)["resource"]; len(res) != 0 {
+		if validateResources(res) != nil || !containsAll(session.Resources, res) {
+			err := AuthErrResp{
+				Error:            "invalid_target",
+				ErrorDescription: "Resource not granted",
+			}
+			utils.EDebug(errors.New("returning invalid_target"), r)
+			return AuthSuccessResp{}, err
+		}
+		session.Resources = res
+	}
+
 	// Verify that the Authorization Code used was issued in response to an OpenID Connect Authentication Request (so that an ID Token will be returned from the Token Endpoint).
 	if !strings.Contains(session.Scope, "openid") {
 		err := AuthErrResp{
@@ -82,11 +166,10 @@ func (op *OpenID) Token(w http.ResponseWriter, r *http.Request) (AuthSuccessResp
 	}
 
 	// Issue token according to variable `session`
-	idToken, err := NewIDToken(session, op.accessTokenSignKey)
+	idToken, err := NewIDToken(session, op.Issuer, op.accessTokenSignKey)
 	atok := AccessToken{}
 	atok.Load(session, op.accessTokenSignKey)
 	if err == nil {
-		op.Cache.Retire(GetParam(r, "code"))
 		utils.EDebug(errors.New("returning ok"), r)
 		return AuthSuccessResp{
 			ok:          true,
@@ -105,3 +188,50 @@ func (op *OpenID) Token(w http.ResponseWriter, r *http.Request) (AuthSuccessResp
 		return AuthSuccessResp{}, err
 	}
 }
+
+// verifyCodeChallenge returns true, if `verifier` matches the code challenge
+// of the session. Without a challenge, no verifier may be sent, so PKCE can't
+// be downgraded.
+// Ref RFC 7636, 4.6.  Server Verifies code_verifier before Returning the Tokens
+func verifyCodeChallenge(ses Session, verifier string) bool {
+	if ses.CodeChallenge == "" {
+		return verifier == ""
+	}
+	if !reCodeVerifier.MatchString(verifier) {
+		return false
+	}
+
+	challenge := verifier
+	if ses.CodeChallengeMethod == "S256" {
+		sum := sha256.Sum256([]byte(verifier))
+		challenge = base64.RawURLEncoding.EncodeToString(sum[:])
+	}
+	return subtle.ConstantTimeCompare([]byte(challenge), []byte(ses.CodeChallenge)) == 1
+}
+
+// revokeCode revokes all tokens issued from `code`, which was used twice.
+// `clt` presented the code. The tokens were issued with the lifetime of the
+// redeemed session `ses`, only if the Cacher doesn't know it anymore, the
+// lifetime of `clt` is used.
+// Ref RFC 6749, 4.1.2.  Authorization Response: If an authorization code is
+// used more than once, the authorization server MUST deny the request and
+// SHOULD revoke (when possible) all tokens previously issued based on that
+// authorization code.
+func (op *OpenID) revokeCode(code string, ses Session, clt Client, r *http.Request) {
+	utils.EInfo(errors.New("Authorization Code reused by "+clt.ClientID), r)
+	if op.Revocations == nil {
+		return
+	}
+	// Tokens of the code expire within the token lifetime of the session
+	lifetime := clt.AccessTokenExpiresIn()
+	if ses.ClientID != "" {
+		lifetime = ses.AccessTokenLifetime
+		if lifetime == 0 {
+			lifetime = DefaultAccessTokenLifetime
+		}
+	}
+	exp := time.Now().Add(lifetime)
+	if err := op.Revocations.RevokeCode(CodeHash(code), exp); err != nil {
+		utils.ELog(err, r)
+	}
+}
@@ -0,0 +1,314 @@
+package openid
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// exchange redeems `code` at the token endpoint of op
+func exchange(op *OpenID, code string) (map[string]interface{}, *httptest.ResponseRecorder) {
+	return exchangeParams(op, url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"client_id":    {"clt1"},
+		"redirect_uri": {"https://rp.example.com/cb"},
+	})
+}
+
+// exchangeParams posts `body` to the token endpoint of op
+func exchangeParams(op *OpenID, body url.Values) (map[string]interface{}, *httptest.ResponseRecorder) {
+	mux := http.NewServeMux()
+	op.AddServer(mux)
+
+	r, _ := http.NewRequest("POST", "/token", strings.NewReader(body.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+
+	resp := make(map[string]interface{})
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	return resp, w
+}
+
+func TestCodeReplay(t *testing.T) {
+	src := newTestSource()
+	op := newTestProvider(t, src)
+	op.Revocations = src
+
+	vals, _ := authorize(op, "_login=1", nil)
+	code := vals.Get("code")
+	if code == "" {
+		t.Fatalf("expected code, got %v", vals)
+	}
+
+	resp, w := exchange(op, code)
+	token, _ := resp["access_token"].(string)
+	if w.Code != http.StatusOK || token == "" {
+		t.Fatalf("expected tokens, got %d %s", w.Code, w.Body)
+	}
+	if _, err := op.ValidateAccessToken(token); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reuse is denied and revokes the tokens issued before
+	_, w = exchange(op, code)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "invalid_grant") {
+		t.Errorf("expected invalid_grant, got %d %s", w.Code, w.Body)
+	}
+	if _, err := op.ValidateAccessToken(token); err == nil {
+		t.Error("access_token of reused code still valid")
+	}
+
+	// Tokens of other codes are not affected
+	vals, _ = authorize(op, "_login=1", nil)
+	resp, _ = exchange(op, vals.Get("code"))
+	if token, _ := resp["access_token"].(string); token == "" {
+		t.Fatalf("expected tokens, got %v", resp)
+	} else if _, err := op.ValidateAccessToken(token); err != nil {
+		t.Error(err)
+	}
+}
+
+// The revocation lasts as long as the tokens of the code, even if another
+// client with a shorter lifetime reuses it
+func TestCodeReplayLifetime(t *testing.T) {
+	src := newTestSource()
+	clt := src.clients["clt1"]
+	clt.AccessTokenLifetime = 3600
+	src.clients["clt1"] = clt
+	clt.ClientID = "clt2"
+	clt.AccessTokenLifetime = 0
+	src.clients["clt2"] = clt
+	op := newTestProvider(t, src)
+	op.Revocations = src
+
+	vals, _ := authorize(op, "_login=1", nil)
+	code := vals.Get("code")
+	if _, w := exchange(op, code); w.Code != http.StatusOK {
+		t.Fatalf("expected tokens, got %d %s", w.Code, w.Body)
+	}
+	exchangeParams(op, url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"client_id":    {"clt2"},
+		"redirect_uri": {"https://rp.example.com/cb"},
+	})
+	if exp := src.revokedCodes[CodeHash(code)]; time.Until(exp) < 59*time.Minute {
+		t.Errorf("expected revocation for the lifetime of clt1, got %v", exp)
+	}
+}
+
+func TestTokenGrantType(t *testing.T) {
+	src := newTestSource()
+	op := newTestProvider(t, src)
+
+	vals, _ := authorize(op, "_login=1", nil)
+	code := vals.Get("code")
+	for _, grantType := range []string{"", "password", "refresh_token"} {
+		_, w := exchangeParams(op, url.Values{
+			"grant_type":   {grantType},
+			"code":         {code},
+			"client_id":    {"clt1"},
+			"redirect_uri": {"https://rp.example.com/cb"},
+		})
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "unsupported_grant_type") {
+			t.Errorf("%q: expected unsupported_grant_type, got %d %s", grantType, w.Code, w.Body)
+		}
+	}
+
+	// The code wasn't burnt
+	if _, w := exchange(op, code); w.Code != http.StatusOK {
+		t.Errorf("expected tokens, got %d %s", w.Code, w.Body)
+	}
+}
+
+func TestCodeConcurrentRedemption(t *testing.T) {
+	src := newTestSource()
+	op := newTestProvider(t, src)
+
+	vals, _ := authorize(op, "_login=1", nil)
+	code := vals.Get("code")
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	issued := 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if resp, _ := exchange(op, code); resp["access_token"] != nil {
+				mu.Lock()
+				issued++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if issued != 1 {
+		t.Errorf("code redeemed %d times", issued)
+	}
+}
+
+func TestCodeLifetime(t *testing.T) {
+	src := newTestSource()
+	op := newTestProvider(t, src)
+	op.CodeLifetime = time.Millisecond
+
+	vals, _ := authorize(op, "_login=1", nil)
+	time.Sleep(5 * time.Millisecond)
+	if _, w := exchange(op, vals.Get("code")); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "invalid_grant") {
+		t.Errorf("expected invalid_grant, got %d %s", w.Code, w.Body)
+	}
+}
+
+func TestCodeRedirectURIBinding(t *testing.T) {
+	src := newTestSource()
+	clt := src.clients["clt1"]
+	clt.RedirectURIs = append(clt.RedirectURIs, "https://rp.example.com/other")
+	src.clients["clt1"] = clt
+	op := newTestProvider(t, src)
+
+	for _, uri := range []string{"https://rp.example.com/other", ""} {
+		vals, _ := authorize(op, "_login=1", nil)
+		_, w := exchangeParams(op, url.Values{
+			"grant_type":   {"authorization_code"},
+			"code":         {vals.Get("code")},
+			"client_id":    {"clt1"},
+			"redirect_uri": {uri},
+		})
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "invalid_grant") {
+			t.Errorf("redirect_uri %q: expected invalid_grant, got %d %s", uri, w.Code, w.Body)
+		}
+	}
+}
+
+func TestCodePKCE(t *testing.T) {
+	// Ref RFC 7636, Appendix B.  Example for the S256 code_challenge_method
+	const verifier = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	const challenge = "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+
+	tests := []struct {
+		name      string
+		params    string
+		verifier  string
+		requirePK bool
+		ok        bool
+	}{
+		{"S256", "code_challenge=" + challenge + "&code_challenge_method=S256", verifier, false, true},
+		{"S256 wrong verifier", "code_challenge=" + challenge + "&code_challenge_method=S256", challenge, false, false},
+		{"S256 no verifier", "code_challenge=" + challenge + "&code_challenge_method=S256", "", false, false},
+		{"plain", "code_challenge=" + verifier, verifier, false, true},
+		{"plain as S256", "code_challenge=" + verifier + "&code_challenge_method=S256", verifier, false, false},
+		{"verifier without challenge", "", verifier, false, false},
+		{"required", "code_challenge=" + challenge + "&code_challenge_method=S256", verifier, true, true},
+		{"required missing", "", "", true, false},
+	}
+	for _, tt := range tests {
+		src := newTestSource()
+		clt := src.clients["clt1"]
+		clt.RequirePKCE = tt.requirePK
+		src.clients["clt1"] = clt
+		op := newTestProvider(t, src)
+
+		vals, _ := authorize(op, "_login=1&"+tt.params, nil)
+		resp, _ := exchangeParams(op, url.Values{
+			"grant_type":    {"authorization_code"},
+			"code":          {vals.Get("code")},
+			"client_id":     {"clt1"},
+			"redirect_uri":  {"https://rp.example.com/cb"},
+			"code_verifier": {tt.verifier},
+		})
+		if ok := resp["access_token"] != nil; ok != tt.ok {
+			t.Errorf("%s: expected %v, got %v %v", tt.name, tt.ok, ok, resp)
+		}
+	}
+}
+
+func TestCodeResources(t *testing.T) {
+	src := newTestSource()
+	op := newTestProvider(t, src)
+
+	redeem := func(resources ...string) map[string]interface{} {
+		vals, _ := authorize(op, "_login=1&resource=https%3A%2F%2Fapi.example.com&resource=https%3A%2F%2Fmail.example.com", nil)
+		resp, _ := exchangeParams(op, url.Values{
+			"grant_type":   {"authorization_code"},
+			"code":         {vals.Get("code")},
+			"client_id":    {"clt1"},
+			"redirect_uri": {"https://rp.example.com/cb"},
+			"resource":     resources,
+		})
+		return resp
+	}
+
+	// Without the parameter, the token covers all granted resources
+	token, _ := redeem()["access_token"].(string)
+	payload, err := op.ValidateAccessToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(payload.Resources) != 2 {
+		t.Errorf("expected both resources, got %v", payload.Resources)
+	}
+
+	// The token can be restricted to one of them
+	token, _ = redeem("https://mail.example.com")["access_token"].(string)
+	if payload, _ := op.ValidateAccessToken(token); len(payload.Resources) != 1 || payload.Resources[0] != "https://mail.example.com" {
+		t.Errorf("expected restricted token, got %v", payload.Resources)
+	}
+
+	// But not be extended
+	if resp := redeem("https://other.example.com"); resp["access_token"] != nil {
+		t.Errorf("resource not granted, got %v", resp)
+	}
+}
+
+func TestStatelessCodes(t *testing.T) {
+	src := newTestSource()
+	op := newTestProvider(t, src)
+	op.Revocations = src
+	key, _ := NewKey()
+	op.CodeKeys, _ = NewKeyring(key)
+	op.CodeReplay = src
+	op.StatelessCodes = true
+
+	vals, _ := authorize(op, "_login=1", nil)
+	code := vals.Get("code")
+	if code == "" || len(src.codes) != 0 {
+		t.Fatalf("expected stateless code, got %v, %d cached", vals, len(src.codes))
+	}
+
+	// Codes stay valid after key rotation
+	next, _ := NewKey()
+	op.CodeKeys.Rotate(next)
+
+	resp, w := exchange(op, code)
+	token, _ := resp["access_token"].(string)
+	if w.Code != http.StatusOK || token == "" {
+		t.Fatalf("expected tokens, got %d %s", w.Code, w.Body)
+	}
+
+	// Reuse is detected through the jti
+	if _, w := exchange(op, code); w.Code != http.StatusBadRequest {
+		t.Errorf("expected invalid_grant, got %d %s", w.Code, w.Body)
+	}
+	if _, err := op.ValidateAccessToken(token); err == nil {
+		t.Error("access_token of reused code still valid")
+	}
+
+	// Codes of retired keys and forged codes are rejected
+	vals, _ = authorize(op, "_login=1", nil)
+	forged := next.ID + "." + strings.Repeat("A", 100)
+	op.CodeKeys.Rotate(Key{ID: "k3", Secret: make([]byte, 32)})
+	op.CodeKeys.Retire(next.ID)
+	for _, code := range []string{vals.Get("code"), forged} {
+		if _, w := exchange(op, code); w.Code != http.StatusBadRequest {
+			t.Errorf("expected invalid_grant, got %d %s", w.Code, w.Body)
+		}
+	}
+}
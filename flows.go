@@ -10,74 +10,48 @@ import (
 const (
 	// AuthzCodeOctetsRand has the number of random bytes used in authz_code `code` generation
 	AuthzCodeOctetsRand = 32
+
+	// DefaultCodeLifetime is used, if OpenID.CodeLifetime isn't set. Clients
+	// redeem codes right after the redirect, so a minute is enough even for
+	// slow clients, and keeps the window for a leaked code short.
+	// Ref RFC 6749, 4.1.2.  Authorization Response: A maximum authorization
+	// code lifetime of 10 minutes is RECOMMENDED.
+	DefaultCodeLifetime = time.Minute
 )
 
 // Ref 3.1.  Authentication using the Authorization Code Flow
 // The Authorization Code Flow returns an Authorization Code to the Client,
 // which can then exchange it for an ID Token and an Access Token directly.
-func (op *OpenID) authzCodeFlow(r *http.Request, state AuthState) (AuthSuccessResp, AuthErrResp) {
-	// Generate `code` for response
-	code, err := GetRandomString(AuthzCodeOctetsRand)
+func (op *OpenID) authzCodeFlow(r *http.Request, ar *AuthenticationRequest, clt Client, state AuthState, sid string) (AuthSuccessResp, AuthErrResp) {
+	// Cache or seal request to be able to respond with token
+	ses, err := op.newSession(ar, clt, state, sid)
 	if err != nil {
-		utils.ELog(err, r)
-
-		resp := AuthErrResp{}
-		resp.Error = "server_error"
-		resp.ErrorDescription = "Server isn't able to fullfill your request"
-		resp.State = GetParam(r, "state")
-		return AuthSuccessResp{}, resp
+		return AuthSuccessResp{}, issueFailed(err, r, ar)
+	}
+	ses.ExpiresAt = time.Now().Add(op.codeLifetime())
+	code, err := op.issueCode(ses)
+	if err != nil {
+		return AuthSuccessResp{}, issueFailed(err, r, ar)
 	}
 
 	// Generate response value
 	suc := AuthSuccessResp{ok: true}
-	suc.State = GetParam(r, "state")
+	suc.State = ar.State
 	suc.Code = code
 
-	// Cache request to be able to respond with token
-	ses := Session{}
-	ses.Code = suc.Code
-	ses.ClientID = GetParam(r, "client_id")
-	ses.Nonce = GetParam(r, "nonce")
-	ses.Scope = GetParam(r, "scope")
-	ses.AuthTime = state.AuthTime
-	ses.MaxAge, _ = time.ParseDuration(GetParam(r, "max_age"))
-	ses.Acr = state.Acr
-	ses.ClaimsLocales = GetParam(r, "claim_locales")
-	ses.Claims, err = ReadClaimsRequest(GetParam(r, "claims"))
-	if err != nil {
-		utils.ELog(err, r)
-		// TODO: Is it safe to continue program flow here?
-	}
-
-	// Now it's needed to cache this
-	op.Cache.Cache(ses)
-
 	return suc, AuthErrResp{}
 }
 
-func (op *OpenID) implicitFlow(r *http.Request, state AuthState) (AuthSuccessResp, AuthErrResp) {
+func (op *OpenID) implicitFlow(r *http.Request, ar *AuthenticationRequest, clt Client, state AuthState, sid string) (AuthSuccessResp, AuthErrResp) {
 	// Generate an session, no need to save/cache
-	ses := Session{}
-	ses.ClientID = GetParam(r, "client_id")
-	ses.Nonce = GetParam(r, "nonce")
-	ses.Scope = GetParam(r, "scope")
-	ses.AuthTime = state.AuthTime
-	ses.MaxAge, _ = time.ParseDuration(GetParam(r, "max_age"))
-	ses.Acr = state.Acr
-	ses.ClaimsLocales = GetParam(r, "claim_locales")
-	var err error
-	ses.Claims, err = ReadClaimsRequest(GetParam(r, "claims"))
+	ses, err := op.newSession(ar, clt, state, sid)
 	if err != nil {
-		utils.ELog(err, r)
-		return AuthSuccessResp{}, AuthErrResp{
-			Error:            "invalid_request",
-			ErrorDescription: "id_token not avaiable",
-		}
+		return AuthSuccessResp{}, issueFailed(err, r, ar)
 	}
 
 	suc := AuthSuccessResp{ok: true}
-	suc.State = GetParam(r, "state")
-	suc.IDToken, err = NewIDToken(ses, op.accessTokenSignKey)
+	suc.State = ar.State
+	suc.IDToken, err = NewIDToken(ses, op.Issuer, op.accessTokenSignKey)
 	if err != nil {
 		utils.ELog(err, r)
 		return AuthSuccessResp{}, AuthErrResp{
@@ -86,7 +60,7 @@ func (op *OpenID) implicitFlow(r *http.Request, state AuthState) (AuthSuccessRes
 		}
 	}
 
-	if GetParam(r, "response_type") != "id_token" {
+	if ar.ResponseType != "id_token" {
 		tok := AccessToken{}
 		tok.Load(ses, op.accessTokenSignKey)
 		suc.AccessToken = tok.Token
@@ -97,43 +71,24 @@ func (op *OpenID) implicitFlow(r *http.Request, state AuthState) (AuthSuccessRes
 	return suc, AuthErrResp{}
 }
 
-func (op *OpenID) hybridFlow(r *http.Request, state AuthState) (AuthSuccessResp, AuthErrResp) {
-	// Generate `code` for response
-	code, err := GetRandomString(AuthzCodeOctetsRand)
+func (op *OpenID) hybridFlow(r *http.Request, ar *AuthenticationRequest, clt Client, state AuthState, sid string) (AuthSuccessResp, AuthErrResp) {
+	// Cache or seal request to be able to respond with token
+	ses, err := op.newSession(ar, clt, state, sid)
 	if err != nil {
-		utils.ELog(err, r)
-
-		resp := AuthErrResp{}
-		resp.Error = "server_error"
-		resp.ErrorDescription = "Server isn't able to fullfill your request"
-		resp.State = GetParam(r, "state")
-		return AuthSuccessResp{}, resp
+		return AuthSuccessResp{}, issueFailed(err, r, ar)
 	}
-
-	// Cache request to be able to respond with token
-	ses := Session{}
-	ses.Code = code
-	ses.ClientID = GetParam(r, "client_id")
-	ses.Nonce = GetParam(r, "nonce")
-	ses.Scope = GetParam(r, "scope")
-	ses.AuthTime = state.AuthTime
-	ses.MaxAge, _ = time.ParseDuration(GetParam(r, "max_age"))
-	ses.Acr = state.Acr
-	ses.ClaimsLocales = GetParam(r, "claim_locales")
-	ses.Claims, err = ReadClaimsRequest(GetParam(r, "claims"))
+	ses.ExpiresAt = time.Now().Add(op.codeLifetime())
+	code, err := op.issueCode(ses)
 	if err != nil {
-		utils.ELog(err, r)
-		return AuthSuccessResp{}, AuthErrResp{
-			Error:            "invalid_request",
-			ErrorDescription: "id_token not avaiable",
-		}
+		return AuthSuccessResp{}, issueFailed(err, r, ar)
 	}
+	ses.Code = code
 
 	// Generate response value
 	suc := AuthSuccessResp{ok: true}
-	suc.State = GetParam(r, "state")
+	suc.State = ar.State
 	suc.Code = code
-	suc.IDToken, err = NewIDToken(ses, op.accessTokenSignKey)
+	suc.IDToken, err = NewIDToken(ses, op.Issuer, op.accessTokenSignKey)
 	if err != nil {
 		utils.ELog(err, r)
 		return AuthSuccessResp{}, AuthErrResp{
@@ -142,7 +97,7 @@ func (op *OpenID) hybridFlow(r *http.Request, state AuthState) (AuthSuccessResp,
 		}
 	}
 
-	if GetParam(r, "response_type") != "id_token" {
+	if ar.ResponseType != "id_token" {
 		tok := AccessToken{}
 		tok.Load(ses, op.accessTokenSignKey)
 		suc.AccessToken = tok.Token
@@ -150,8 +105,53 @@ func (op *OpenID) hybridFlow(r *http.Request, state AuthState) (AuthSuccessResp,
 		suc.ExpiresIn = tok.ExpiresIn
 	}
 
-	// Now it's needed to cache this
-	op.Cache.Cache(ses)
-
 	return suc, AuthErrResp{}
 }
+
+// codeLifetime returns OpenID.CodeLifetime or its default
+func (op *OpenID) codeLifetime() time.Duration {
+	if op.CodeLifetime <= 0 {
+		return DefaultCodeLifetime
+	}
+	return op.CodeLifetime
+}
+
+// issueFailed is returned by the flows, if the code or tokens can't be issued
+func issueFailed(err error, r *http.Request, ar *AuthenticationRequest) AuthErrResp {
+	utils.ELog(err, r)
+
+	resp := AuthErrResp{}
+	resp.Error = "server_error"
+	resp.ErrorDescription = "Server isn't able to fullfill your request"
+	resp.State = ar.State
+	return resp
+}
+
+// newSession returns the Session for an authenticated request, which is used
+// by all flows for code and token generation
+func (op *OpenID) newSession(ar *AuthenticationRequest, clt Client, state AuthState, sid string) (Session, error) {
+	sub, err := op.subjectFor(clt, state.Sub)
+	if err != nil {
+		return Session{}, err
+	}
+	ses := Session{}
+	ses.ClientID = ar.ClientID
+	ses.Sub = sub
+	ses.LocalSub = state.Sub
+	ses.Nonce = ar.Nonce
+	ses.Scope = ar.Scope
+	ses.AuthTime = state.AuthTime
+	ses.MaxAge = ar.MaxAge
+	ses.RequireAuthTime = ar.MaxAgeSet || clt.RequireAuthTime
+	ses.Acr = state.Acr
+	ses.ClaimsLocales = ar.ClaimsLocales
+	ses.Claims = ar.Claims
+	ses.Sid = sid
+	ses.AccessTokenLifetime = clt.AccessTokenExpiresIn()
+	ses.IDTokenLifetime = clt.IDTokenExpiresIn()
+	ses.RedirectURI = ar.RedirectURI
+	ses.CodeChallenge = ar.CodeChallenge
+	ses.CodeChallengeMethod = ar.CodeChallengeMethod
+	ses.Resources = ar.Resources
+	return ses, nil
+}
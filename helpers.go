@@ -7,6 +7,8 @@ import (
 	"errors"
 	"net/http"
 	"net/url"
+	"strconv"
+	"time"
 
 	uquery "github.com/google/go-querystring/query"
 	"github.com/openbolt/openid/utils"
@@ -15,17 +17,7 @@ import (
 // GetParam extracts the OAuth parameters from an http.Request according to the
 // OIDC spec
 func GetParam(r *http.Request, param string) string {
-	if r.Method == "GET" {
-		// MUST URI Query String Serialization
-		return r.URL.Query().Get(param)
-
-	} else if r.Method == "POST" {
-		// MUST Form Serialization
-		r.ParseForm()
-		return r.PostForm.Get(param)
-	} else {
-		return ""
-	}
+	return readParams(r).Get(param)
 }
 
 // Serialize response serializes an struct to an url query or fragment
@@ -56,6 +48,25 @@ func serializeResponse(redirectURI url.URL, responseMode string, data interface{
 	return redirectURI, nil
 }
 
+// discardWriter is an http.ResponseWriter which drops everything written to it.
+// Used to call the EnduserIf, when no user interface may be displayed.
+type discardWriter struct {
+	header http.Header
+}
+
+func (d *discardWriter) Header() http.Header {
+	if d.header == nil {
+		d.header = make(http.Header)
+	}
+	return d.header
+}
+
+func (d *discardWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (d *discardWriter) WriteHeader(int) {}
+
 // getFlow returns authorization_code, implicit or hybrid. If any error occours,
 // "" will be returned
 func getFlow(field string) string {
@@ -74,6 +85,20 @@ func getFlow(field string) string {
 	}
 }
 
+// parseMaxAge parses the max_age parameter, which is given in seconds.
+// Returns if max_age was set at all.
+func parseMaxAge(val string) (time.Duration, bool, error) {
+	if val == "" {
+		return 0, false, nil
+	}
+
+	sec, err := strconv.ParseInt(val, 10, 64)
+	if err != nil || sec < 0 {
+		return 0, false, errors.New("max_age must be a non-negative integer")
+	}
+	return time.Duration(sec) * time.Second, true, nil
+}
+
 // GetRandomString returns an random string with size `size`
 func GetRandomString(size int) (string, error) {
 	// Generate `code` for response
@@ -86,29 +111,41 @@ func GetRandomString(size int) (string, error) {
 	return base64.StdEncoding.EncodeToString(sec), nil
 }
 
+// ReadClaimsRequest deserializes the `claims` request parameter
+// Ref 5.5.  Requesting Claims using the "claims" Request Parameter
 func ReadClaimsRequest(data string) (ClaimsRequest, error) {
 	if data == "" {
 		return ClaimsRequest{}, nil
 	}
 
-	type csreq struct {
-		Userinfo map[string]csreq `json:"userinfo"`
-		IDToken  map[string]csreq `json:"id_token"`
-	}
-
-	type creq struct {
-		Essential bool     `json:"essential"`
-		Value     string   `json:"value"`
-		Values    []string `json:"values"`
-	}
-	raw := csreq{}
-	err := json.Unmarshal([]byte(data), raw)
+	// null is a valid value for each claim, so use pointers here
+	raw := struct {
+		Userinfo map[string]*ClaimRequest `json:"userinfo"`
+		IDToken  map[string]*ClaimRequest `json:"id_token"`
+	}{}
+	err := json.Unmarshal([]byte(data), &raw)
 	if err != nil {
 		utils.ELog(err, nil)
 		return ClaimsRequest{}, err
 	}
 
-	// BUG Not implemented yes
-	// TODO: Convert csreq to ClaimsRequest
-	return ClaimsRequest{}, errors.New("Not implemented yet")
+	convert := func(in map[string]*ClaimRequest) map[string]ClaimRequest {
+		if in == nil {
+			return nil
+		}
+		out := make(map[string]ClaimRequest, len(in))
+		for k, v := range in {
+			if v == nil {
+				out[k] = ClaimRequest{Default: true}
+			} else {
+				out[k] = *v
+			}
+		}
+		return out
+	}
+
+	return ClaimsRequest{
+		Userinfo: convert(raw.Userinfo),
+		IDToken:  convert(raw.IDToken),
+	}, nil
 }
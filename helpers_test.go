@@ -1,11 +1,13 @@
 package openid
 
 import (
+	"fmt"
 	_ "testing"
 )
 
-func Example_ReadClaimsRequest() {
-	data := "blabla"
-	ReadClaimsRequest(data)
-	// Output: bla
+func ExampleReadClaimsRequest() {
+	data := `{"id_token": {"sub": {"value": "djboris"}, "email": null}}`
+	req, _ := ReadClaimsRequest(data)
+	fmt.Println(req.IDToken["sub"].Value, req.IDToken["email"].Default)
+	// Output: djboris true
 }
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"strings"
 
 	"github.com/gorilla/context"
 	"github.com/openbolt/openid/utils"
@@ -35,12 +36,16 @@ func (api *httpAPI) Authorize(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Run the authorization
-	resp, err := api.srv.Authorize(w, r)
+	// Run the authorization, the request is parsed only once
+	var resp AuthSuccessResp
+	ar, err := ParseAuthenticationRequest(r)
+	if err.Error == "" {
+		resp, err = api.srv.AuthorizeRequest(w, r, ar)
+	}
 
 	// Get default response_mode for flow and override it if another is set
 	var responseMode string
-	if getFlow(GetParam(r, "response_type")) == "authorization_code" {
+	if getFlow(ar.ResponseType) == "authorization_code" {
 		responseMode = "query"
 	} else {
 		responseMode = "fragment"
@@ -51,10 +56,10 @@ func (api *httpAPI) Authorize(w http.ResponseWriter, r *http.Request) {
 		utils.ELog(errors.New("Auth failed: "+err.Error), r)
 
 		// If redirect_uri is not valid, show error as JSON
-		redirectURI := GetParam(r, "redirect_uri")
-		clientID := GetParam(r, "client_id")
-		flow := GetParam(r, "code")
-		t := checkRedirectURI(redirectURI, clientID, flow, api.srv.Clientsrc)
+		redirectURI := ar.RedirectURI
+		flow := getFlow(ar.ResponseType)
+		clt, e := api.srv.Clientsrc.GetClient(ar.ClientID)
+		t := e == nil && checkRedirectURI(redirectURI, flow, clt)
 		u, e := url.Parse(redirectURI)
 		if e != nil || !t {
 			utils.EDebug(e, r)
@@ -66,7 +71,8 @@ func (api *httpAPI) Authorize(w http.ResponseWriter, r *http.Request) {
 		/*
 		 * Add error to query or fragment
 		 */
-		err.State = GetParam(r, "state")
+		err.State = ar.State
+		err.Iss = api.srv.Issuer
 		*u, e = serializeResponse(*u, responseMode, err)
 		if e != nil {
 			utils.EDebug(e, r)
@@ -84,8 +90,8 @@ func (api *httpAPI) Authorize(w http.ResponseWriter, r *http.Request) {
 		utils.EDebug(errors.New("Auth succeeded"), r)
 
 		// Return success
-		redirectURI := GetParam(r, "redirect_uri")
-		u, _ := url.Parse(redirectURI)
+		u, _ := url.Parse(ar.RedirectURI)
+		resp.Iss = api.srv.Issuer
 		*u, _ = serializeResponse(*u, responseMode, resp)
 
 		utils.EDebug(errors.New("Redirecting to "+u.String()), r)
@@ -130,9 +136,13 @@ func (api *httpAPI) Token(w http.ResponseWriter, r *http.Request) {
 		w.Write(data)
 		utils.EDebug(errors.New(string(data)), r)
 	} else if err.Error != "" {
-		// TODO: Return StatusCode and Headers from struct
-		data, _ := json.Marshal(resp)
-		utils.EDebug(errors.New("X"+string(data)), r)
+		for k, v := range err.Headers {
+			w.Header()[k] = v
+		}
+		data, _ := json.Marshal(err)
+		w.WriteHeader(err.StatusCode)
+		w.Write(data)
+		utils.EDebug(errors.New(string(data)), r)
 	} else if resp.ok {
 		// 3.1.3.3.  Successful Token Response
 		w.Header().Add("Cache-Control", "no-store")
@@ -144,3 +154,117 @@ func (api *httpAPI) Token(w http.ResponseWriter, r *http.Request) {
 		//BUG: Return 500
 	}
 }
+
+// /.well-known/openid-configuration
+// Ref OpenID Connect Discovery 1.0, 4.  Obtaining OpenID Provider Configuration Information
+func (api *httpAPI) Discovery(w http.ResponseWriter, r *http.Request) {
+	context.Set(r, REQUEST_UUID, string(uuid.NewUUID().String()))
+
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	data, err := json.Marshal(api.srv.Metadata())
+	if err != nil {
+		utils.ELog(err, r)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// /logout
+// Ref OpenID Connect RP-Initiated Logout 1.0
+func (api *httpAPI) EndSession(w http.ResponseWriter, r *http.Request) {
+	context.Set(r, REQUEST_UUID, string(uuid.NewUUID().String()))
+
+	// Return if Method not GET or POST
+	if r.Method != "GET" && r.Method != "POST" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Method must be GET or POST"))
+		return
+	}
+
+	api.srv.EndSession(w, r)
+}
+
+// /register
+// Ref OpenID Connect Dynamic Client Registration 1.0, 3.  Client Registration Endpoint
+func (api *httpAPI) Register(w http.ResponseWriter, r *http.Request) {
+	context.Set(r, REQUEST_UUID, string(uuid.NewUUID().String()))
+
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	resp, err := api.srv.Register(r)
+	writeRegistrationResp(w, r, resp, err, http.StatusCreated)
+}
+
+// /register/{client_id}
+// Ref RFC 7592, 2.  Client Configuration Endpoint
+func (api *httpAPI) ClientConfiguration(w http.ResponseWriter, r *http.Request) {
+	context.Set(r, REQUEST_UUID, string(uuid.NewUUID().String()))
+
+	id, e := url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), "/register/"))
+	if e != nil || id == "" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		resp, err := api.srv.ReadClient(r, id)
+		writeRegistrationResp(w, r, resp, err, http.StatusOK)
+	case "PUT":
+		resp, err := api.srv.UpdateClient(r, id)
+		writeRegistrationResp(w, r, resp, err, http.StatusOK)
+	case "DELETE":
+		if err := api.srv.DeleteClient(r, id); err.Error != "" {
+			writeRegistrationResp(w, r, nil, err, 0)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func writeRegistrationResp(w http.ResponseWriter, r *http.Request, resp interface{}, err RegistrationErrResp, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+
+	var data []byte
+	if err.Error != "" {
+		if err.StatusCode == http.StatusUnauthorized {
+			w.Header().Set("WWW-Authenticate", `Bearer error="`+err.Error+`"`)
+		}
+		status = err.StatusCode
+		if status == 0 {
+			status = http.StatusBadRequest
+		}
+		data, _ = json.Marshal(err)
+	} else {
+		data, _ = json.Marshal(resp)
+	}
+	utils.EDebug(errors.New(string(data)), r)
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+// /check_session
+// Ref OpenID Connect Session Management 1.0, 3.3.  OP iframe
+func (api *httpAPI) CheckSession(w http.ResponseWriter, r *http.Request) {
+	context.Set(r, REQUEST_UUID, string(uuid.NewUUID().String()))
+
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	api.srv.CheckSession(w, r)
+}
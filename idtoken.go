@@ -2,6 +2,7 @@ package openid
 
 import (
 	"crypto/ecdsa"
+	"errors"
 	"time"
 
 	jwt "github.com/dgrijalva/jwt-go"
@@ -14,13 +15,34 @@ type IDToken struct {
 }
 
 // NewIDToken returns an IDToken according to parameters from Session
-func NewIDToken(ses Session, signKey *ecdsa.PrivateKey) (*IDToken, error) {
-	// BUG Implement
+// Ref 2.  ID Token
+func NewIDToken(ses Session, iss string, signKey *ecdsa.PrivateKey) (*IDToken, error) {
+	// BUG Implement at_hash and c_hash
+	now := time.Now()
 	tok := new(IDToken)
-	//tok.Token = jwt.New(jwt.SigningMethodHS256) // HMAC
-	tok.Token = jwt.New(jwt.SigningMethodES256) // ECDSA
-	tok.Token.Claims["foo"] = "bar"
-	tok.Token.Claims["exp"] = time.Now().Add(time.Hour * 72).Unix()
+	//tok.Token = jwt.New(jwt.SigningMethodHS256) // HMAC
+	tok.Token = jwt.New(jwt.SigningMethodES256) // ECDSA
+	tok.Token.Claims["iss"] = iss
+	tok.Token.Claims["sub"] = ses.Sub
+	tok.Token.Claims["aud"] = ses.ClientID
+	lifetime := ses.IDTokenLifetime
+	if lifetime == 0 {
+		lifetime = DefaultIDTokenLifetime
+	}
+	tok.Token.Claims["exp"] = now.Add(lifetime).Unix()
+	tok.Token.Claims["iat"] = now.Unix()
+	if ses.RequireAuthTime {
+		tok.Token.Claims["auth_time"] = ses.AuthTime.Unix()
+	}
+	if ses.Nonce != "" {
+		tok.Token.Claims["nonce"] = ses.Nonce
+	}
+	if ses.Acr != "" {
+		tok.Token.Claims["acr"] = ses.Acr
+	}
+	if ses.Sid != "" {
+		tok.Token.Claims["sid"] = ses.Sid
+	}
 	var err error
 	tok.TokenSignedString, err = tok.Token.SignedString(signKey)
 	return tok, err
@@ -31,3 +53,42 @@ func NewIDToken(ses Session, signKey *ecdsa.PrivateKey) (*IDToken, error) {
 func (t *IDToken) MarshalText() (text []byte, err error) {
 	return []byte(t.TokenSignedString), nil
 }
+
+// verifyIDTokenHint checks that `hint` is an ID Token, which was issued by this
+// provider. As the End-User may have been logged out meanwhile, expired tokens
+// are accepted.
+// Ref 3.1.2.1. id_token_hint
+func (op *OpenID) verifyIDTokenHint(hint string) (*jwt.Token, error) {
+	tok, err := jwt.Parse(hint, func(t *jwt.Token) (interface{}, error) {
+		if _, ok := t.Method.(*jwt.SigningMethodECDSA); !ok {
+			return nil, errors.New("Unexpected signing method")
+		}
+		return &op.accessTokenSignKey.PublicKey, nil
+	})
+	if err != nil {
+		verr, ok := err.(*jwt.ValidationError)
+		if !ok || verr.Errors&^jwt.ValidationErrorExpired != 0 {
+			return nil, err
+		}
+	}
+
+	if iss, _ := tok.Claims["iss"].(string); iss != op.Issuer {
+		return nil, errors.New("id_token_hint issued by another provider")
+	}
+	return tok, nil
+}
+
+// hasAudience returns true, if the `aud` Claim of tok contains `clientID`
+func hasAudience(tok *jwt.Token, clientID string) bool {
+	switch aud := tok.Claims["aud"].(type) {
+	case string:
+		return aud == clientID
+	case []interface{}:
+		for _, v := range aud {
+			if v == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
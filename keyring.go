@@ -0,0 +1,158 @@
+package openid
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"sync"
+)
+
+// Key is a symmetric key of a Keyring. Secret must have 16, 24 or 32 bytes
+// (AES-128, AES-192 or AES-256). ID names the key in sealed values, so it must
+// be unique and must not contain a ".".
+type Key struct {
+	ID     string
+	Secret []byte
+}
+
+// Keyring seals values with AES-GCM. The newest key is used for sealing, all
+// keys for opening, so keys can be rotated without invalidating values which
+// were sealed before. A Keyring is safe for concurrent use.
+type Keyring struct {
+	mu   sync.RWMutex
+	keys []keyringKey // newest first
+}
+
+type keyringKey struct {
+	id   string
+	aead cipher.AEAD
+}
+
+// NewKeyring returns a Keyring with `keys`, the first one is used for sealing
+func NewKeyring(keys ...Key) (*Keyring, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("No keys given")
+	}
+	k := new(Keyring)
+	for i := len(keys) - 1; i >= 0; i-- {
+		if err := k.Rotate(keys[i]); err != nil {
+			return nil, err
+		}
+	}
+	return k, nil
+}
+
+// NewKey returns a random AES-256 key with a random ID
+func NewKey() (Key, error) {
+	raw := make([]byte, 6+32)
+	if _, err := rand.Read(raw); err != nil {
+		return Key{}, err
+	}
+	return Key{ID: base64.RawURLEncoding.EncodeToString(raw[:6]), Secret: raw[6:]}, nil
+}
+
+// Rotate makes `key` the sealing key. Older keys are kept for opening, until
+// they are removed with Retire.
+func (k *Keyring) Rotate(key Key) error {
+	if key.ID == "" || strings.Contains(key.ID, ".") {
+		return errors.New("Invalid key id")
+	}
+	block, err := aes.NewCipher(key.Secret)
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for _, old := range k.keys {
+		if old.id == key.ID {
+			return errors.New("Duplicate key id " + key.ID)
+		}
+	}
+	k.keys = append([]keyringKey{{key.ID, aead}}, k.keys...)
+	return nil
+}
+
+// Retire removes the key `id`, values sealed with it can't be opened anymore.
+// The sealing key can't be retired.
+func (k *Keyring) Retire(id string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for i, key := range k.keys {
+		if key.id != id {
+			continue
+		}
+		if i == 0 {
+			return errors.New("Cannot retire the sealing key")
+		}
+		k.keys = append(k.keys[:i:i], k.keys[i+1:]...)
+		return nil
+	}
+	return errors.New("No such key " + id)
+}
+
+// KeyID returns the id of the sealing key
+func (k *Keyring) KeyID() string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.keys[0].id
+}
+
+// Seal encrypts and authenticates `plaintext` and `ad`. The result is URL
+// safe and has the form "<key id>.<base64url(nonce|ciphertext)>". The same
+// `ad` must be passed to Open, it binds the value to its purpose.
+func (k *Keyring) Seal(plaintext, ad []byte) (string, error) {
+	k.mu.RLock()
+	key := k.keys[0]
+	k.mu.RUnlock()
+
+	nonce := make([]byte, key.aead.NonceSize(), key.aead.NonceSize()+len(plaintext)+key.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := key.aead.Seal(nonce, nonce, plaintext, append([]byte(key.id+"."), ad...))
+	return key.id + "." + base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// Open returns the plaintext of a value returned by Seal
+func (k *Keyring) Open(sealed string, ad []byte) ([]byte, error) {
+	i := strings.IndexByte(sealed, '.')
+	if i < 0 {
+		return nil, errors.New("Malformed sealed value")
+	}
+	id := sealed[:i]
+	data, err := base64.RawURLEncoding.DecodeString(sealed[i+1:])
+	if err != nil {
+		return nil, errors.New("Malformed sealed value")
+	}
+
+	k.mu.RLock()
+	var aead cipher.AEAD
+	for _, key := range k.keys {
+		if key.id == id {
+			aead = key.aead
+			break
+		}
+	}
+	k.mu.RUnlock()
+	if aead == nil {
+		return nil, errors.New("Unknown key " + id)
+	}
+	if len(data) < aead.NonceSize() {
+		return nil, errors.New("Malformed sealed value")
+	}
+
+	nonce, ciphertext := data[:aead.NonceSize()], data[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, append([]byte(id+"."), ad...))
+	if err != nil {
+		return nil, errors.New("Cannot open sealed value")
+	}
+	return plaintext, nil
+}
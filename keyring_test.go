@@ -0,0 +1,72 @@
+package openid
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestKeyring(t *testing.T) {
+	old, _ := NewKey()
+	kr, err := NewKeyring(old)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sealed, err := kr.Seal([]byte("secret"), []byte("ad"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(sealed, old.ID+".") || strings.Contains(sealed, "secret") {
+		t.Errorf("unexpected sealed value %s", sealed)
+	}
+	if data, err := kr.Open(sealed, []byte("ad")); err != nil || string(data) != "secret" {
+		t.Errorf("expected secret, got %q %v", data, err)
+	}
+
+	// The additional data and the key id are authenticated
+	if _, err := kr.Open(sealed, []byte("other")); err == nil {
+		t.Error("opened with wrong additional data")
+	}
+	tampered := []byte(sealed)
+	tampered[len(tampered)-1] ^= 1
+	if _, err := kr.Open(string(tampered), []byte("ad")); err == nil {
+		t.Error("opened tampered value")
+	}
+
+	// After rotation, old values can be opened until the key is retired
+	next, _ := NewKey()
+	if err := kr.Rotate(next); err != nil {
+		t.Fatal(err)
+	}
+	if kr.KeyID() != next.ID {
+		t.Errorf("expected sealing key %s, got %s", next.ID, kr.KeyID())
+	}
+	if _, err := kr.Open(sealed, []byte("ad")); err != nil {
+		t.Error(err)
+	}
+	if err := kr.Retire(next.ID); err == nil {
+		t.Error("retired the sealing key")
+	}
+	if err := kr.Retire(old.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kr.Open(sealed, []byte("ad")); err == nil {
+		t.Error("opened value of retired key")
+	}
+}
+
+func TestKeyringInvalidKeys(t *testing.T) {
+	for _, key := range []Key{
+		{ID: "", Secret: make([]byte, 32)},
+		{ID: "a.b", Secret: make([]byte, 32)},
+		{ID: "k1", Secret: make([]byte, 10)},
+	} {
+		if _, err := NewKeyring(key); err == nil {
+			t.Errorf("accepted key %q with %d bytes", key.ID, len(key.Secret))
+		}
+	}
+	k := Key{ID: "k1", Secret: make([]byte, 16)}
+	if _, err := NewKeyring(k, k); err == nil {
+		t.Error("accepted duplicate key id")
+	}
+}
@@ -0,0 +1,213 @@
+package openid
+
+import (
+	"crypto/hmac"
+	"errors"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/openbolt/openid/utils"
+)
+
+var logoutConfirmTemplate = template.Must(template.New("logout.html").Parse(`<!DOCTYPE html>
+<html{{ with .Lang }} lang="{{ . }}"{{ end }}>
+	<head>
+		<title>Log out</title>
+	</head>
+	<body>
+		<p>Do you want to log out?</p>
+		<form action="{{ .Baseurl }}" method="post">
+			<!-- keep request parameters -->
+			{{ range $key, $values := .Values }}{{ range $values }}
+			<input type="hidden" name="{{ $key }}" value="{{ . }}" />
+			{{ end }}{{ end }}
+			<input type="hidden" name="_logout" value="{{ .Token }}" />
+			<input type="submit" value="Log out"/>
+		</form>
+	</body>
+</html>
+`))
+
+// The frontchannel_logout_uri of each client is loaded in a hidden iframe,
+// the redirect to the RP happens after they have been loaded: a refresh
+// starts once the document, including its iframes, is loaded.
+// Ref OpenID Connect Front-Channel Logout 1.0, 4.  OpenID Provider Iframe
+var loggedOutTemplate = template.Must(template.New("loggedout.html").Parse(`<!DOCTYPE html>
+<html{{ with .Lang }} lang="{{ . }}"{{ end }}>
+	<head>
+		<title>Logged out</title>
+		{{ with .Redirect }}
+		<meta http-equiv="refresh" content="0; url={{ . }}" />
+		{{ end }}
+	</head>
+	<body>
+		<p>You have been logged out.</p>
+		{{ with .Redirect }}
+		<p><a href="{{ . }}">Continue</a></p>
+		{{ end }}
+		{{ range .Frontchannel }}
+		<iframe src="{{ . }}" style="display:none" width="0" height="0"></iframe>
+		{{ end }}
+	</body>
+</html>
+`))
+
+// EndSession logs the End-User out of the provider and ends the SSO session.
+// Without an id_token_hint of the logged in End-User, the End-User is asked to
+// confirm.
+// Ref OpenID Connect RP-Initiated Logout 1.0, 2.  RP-Initiated Logout
+func (op *OpenID) EndSession(w http.ResponseWriter, r *http.Request) {
+	vals := readParams(r)
+	clientID := vals.Get("client_id")
+	redirectURI := vals.Get("post_logout_redirect_uri")
+	var lang string
+	if locales := strings.Fields(vals.Get("ui_locales")); len(locales) != 0 {
+		lang = locales[0]
+	}
+
+	// The id_token_hint ties the request to a client and End-User
+	var hintSub string
+	if hint := vals.Get("id_token_hint"); hint != "" {
+		tok, err := op.verifyIDTokenHint(hint)
+		if err != nil {
+			utils.EDebug(err, r)
+			http.Error(w, "Invalid id_token_hint", http.StatusBadRequest)
+			return
+		}
+		hintSub, _ = tok.Claims["sub"].(string)
+		aud, _ := tok.Claims["aud"].(string)
+		if clientID == "" {
+			clientID = aud
+		} else if !hasAudience(tok, clientID) {
+			utils.EDebug(errors.New("client_id doesn't match id_token_hint"), r)
+			http.Error(w, "client_id doesn't match id_token_hint", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var clt Client
+	if clientID != "" {
+		var err error
+		if clt, err = op.Clientsrc.GetClient(clientID); err != nil {
+			http.Error(w, "Unknown client", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Ref 3.  Redirection to RP After Logout
+	if redirectURI != "" {
+		if clientID == "" || !clt.ValidPostLogoutRedirectURI(redirectURI) {
+			utils.EDebug(errors.New("post_logout_redirect_uri not registered"), r)
+			http.Error(w, "Invalid post_logout_redirect_uri", http.StatusBadRequest)
+			return
+		}
+		// Statically configured clients aren't checked on registration
+		if u, err := url.Parse(redirectURI); err != nil || (u.Scheme != "https" && u.Scheme != "http") {
+			utils.EDebug(errors.New("post_logout_redirect_uri must use http(s)"), r)
+			http.Error(w, "Invalid post_logout_redirect_uri", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Ask the End-User, unless the logout is requested with an id_token_hint
+	// of the logged in End-User. A client_id alone is public, so anyone could
+	// log the End-User out with it.
+	ses, loggedIn := op.loadSSOSession(r)
+	if sub, err := op.subjectFor(clt, ses.Sub); loggedIn && (hintSub == "" || err != nil || hintSub != sub) {
+		token := op.sessionMAC("logout", ses.ID)
+		if !hmac.Equal([]byte(vals.Get("_logout")), []byte(token)) {
+			op.renderLogoutConfirm(w, r, vals, token, lang)
+			return
+		}
+	}
+
+	op.endSSOSession(w, r)
+	utils.EDebug(errors.New("SSO session ended"), r)
+
+	var frontchannel []string
+	if loggedIn {
+		frontchannel = op.frontchannelLogoutURIs(ses)
+	}
+
+	var redirect string
+	if redirectURI != "" {
+		u, _ := url.Parse(redirectURI)
+		if state := vals.Get("state"); state != "" {
+			query := u.Query()
+			query.Set("state", state)
+			u.RawQuery = query.Encode()
+		}
+		redirect = u.String()
+	}
+
+	if redirect != "" && len(frontchannel) == 0 {
+		utils.EDebug(errors.New("Redirecting to "+redirect), r)
+		http.Redirect(w, r, redirect, http.StatusFound)
+		return
+	}
+
+	x := struct {
+		Lang         string
+		Redirect     string
+		Frontchannel []string
+	}{
+		lang,
+		redirect,
+		frontchannel,
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := loggedOutTemplate.Execute(w, x); err != nil {
+		utils.ELog(err, r)
+	}
+}
+
+// frontchannelLogoutURIs returns the frontchannel_logout_uri of all clients of
+// the SSO session, with `iss` and `sid` added
+// Ref OpenID Connect Front-Channel Logout 1.0, 2.  RP Logout
+func (op *OpenID) frontchannelLogoutURIs(ses SSOSession) []string {
+	var uris []string
+	for _, clientID := range ses.Clients {
+		clt, err := op.Clientsrc.GetClient(clientID)
+		if err != nil || clt.FrontchannelLogoutURI == "" {
+			continue
+		}
+		u, err := url.Parse(clt.FrontchannelLogoutURI)
+		if err != nil {
+			continue
+		}
+		query := u.Query()
+		query.Set("iss", op.Issuer)
+		query.Set("sid", ses.Sid)
+		u.RawQuery = query.Encode()
+		uris = append(uris, u.String())
+	}
+	return uris
+}
+
+func (op *OpenID) renderLogoutConfirm(w http.ResponseWriter, r *http.Request, params url.Values, token, lang string) {
+	vals := make(map[string][]string)
+	for k, v := range params {
+		if !strings.HasPrefix(k, "_") {
+			vals[k] = v
+		}
+	}
+
+	x := struct {
+		Lang    string
+		Baseurl string
+		Values  map[string][]string
+		Token   string
+	}{
+		lang,
+		r.URL.Path,
+		vals,
+		token,
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := logoutConfirmTemplate.Execute(w, x); err != nil {
+		utils.ELog(err, r)
+	}
+}
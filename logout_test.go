@@ -0,0 +1,128 @@
+package openid
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func endSession(op *OpenID, params string, cookies []*http.Cookie) *httptest.ResponseRecorder {
+	mux := http.NewServeMux()
+	op.AddServer(mux)
+
+	r, _ := http.NewRequest("GET", "/logout?"+params, nil)
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	return w
+}
+
+func TestEndSession(t *testing.T) {
+	src := newTestSource()
+	op := newTestProvider(t, src)
+
+	_, w := authorize(op, "_login=1", nil)
+	cookies := w.Result().Cookies()
+
+	// Unregistered redirect
+	w = endSession(op, "client_id=clt1&post_logout_redirect_uri=https%3A%2F%2Fevil.example.com%2F", cookies)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", w.Code)
+	}
+
+	// Not tied to a client, ask the End-User
+	w = endSession(op, "", cookies)
+	if !strings.Contains(w.Body.String(), "Do you want to log out?") {
+		t.Fatalf("expected confirmation page, got %s", w.Body.String())
+	}
+	if vals, _ := authorize(op, "prompt=none", cookies); vals.Get("code") == "" {
+		t.Fatalf("session ended without confirmation")
+	}
+
+	// A client_id or a hint of another End-User isn't enough
+	for _, params := range []string{
+		"client_id=clt1",
+		"id_token_hint=" + idTokenHint(t, op, "bob", "clt1", time.Hour),
+	} {
+		w = endSession(op, params, cookies)
+		if !strings.Contains(w.Body.String(), "Do you want to log out?") {
+			t.Fatalf("%s: expected confirmation page, got %s", params, w.Body.String())
+		}
+		if vals, _ := authorize(op, "prompt=none", cookies); vals.Get("code") == "" {
+			t.Fatalf("%s: session ended without confirmation", params)
+		}
+	}
+
+	// Confirmed
+	m := regexp.MustCompile(`name="_logout" value="([^"]*)"`).FindStringSubmatch(w.Body.String())
+	if m == nil {
+		t.Fatalf("expected token, got %s", w.Body.String())
+	}
+	endSession(op, "client_id=clt1&_logout="+m[1], cookies)
+	if vals, _ := authorize(op, "prompt=none", cookies); vals.Get("error") != "login_required" {
+		t.Fatalf("expected login_required after logout, got %v", vals)
+	}
+
+	// Logout with id_token_hint and redirect
+	_, w = authorize(op, "_login=1", nil)
+	cookies = w.Result().Cookies()
+	hint := idTokenHint(t, op, "alice", "clt1", time.Hour)
+	w = endSession(op, "id_token_hint="+hint+"&state=abc&post_logout_redirect_uri=https%3A%2F%2Frp.example.com%2Floggedout", cookies)
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "https://rp.example.com/loggedout?state=abc" {
+		t.Fatalf("expected redirect, got %d %s", w.Code, w.Header().Get("Location"))
+	}
+	if vals, _ := authorize(op, "prompt=none", cookies); vals.Get("error") != "login_required" {
+		t.Fatalf("expected login_required after logout, got %v", vals)
+	}
+}
+
+func TestFrontchannelLogout(t *testing.T) {
+	src := newTestSource()
+	clt := src.clients["clt1"]
+	clt.FrontchannelLogoutURI = "https://rp.example.com/fc?x=1"
+	src.clients["clt1"] = clt
+	op := newTestProvider(t, src)
+
+	_, w := authorize(op, "_login=1", nil)
+	var sid string
+	for _, ses := range src.sessions {
+		sid = ses.Sid
+	}
+
+	hint := idTokenHint(t, op, "alice", "clt1", time.Hour)
+	w = endSession(op, "id_token_hint="+hint+"&state=abc&post_logout_redirect_uri=https%3A%2F%2Frp.example.com%2Floggedout", w.Result().Cookies())
+	body := w.Body.String()
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected logout page, got %d", w.Code)
+	}
+	iframe := `src="https://rp.example.com/fc?iss=https%3A%2F%2Fop.example.com&amp;sid=` + url.QueryEscape(sid) + `&amp;x=1"`
+	if !strings.Contains(body, iframe) {
+		t.Errorf("expected iframe %s, got %s", iframe, body)
+	}
+	if !strings.Contains(body, `content="0; url=https://rp.example.com/loggedout?state=abc"`) {
+		t.Errorf("expected redirect, got %s", body)
+	}
+}
+
+// Only http(s) redirects are followed, even if registered
+func TestPostLogoutRedirectScheme(t *testing.T) {
+	src := newTestSource()
+	clt := src.clients["clt1"]
+	clt.PostLogoutRedirectURIs = append(clt.PostLogoutRedirectURIs, "javascript:alert(1)")
+	clt.FrontchannelLogoutURI = "https://rp.example.com/fc"
+	src.clients["clt1"] = clt
+	op := newTestProvider(t, src)
+
+	_, w := authorize(op, "_login=1", nil)
+	hint := idTokenHint(t, op, "alice", "clt1", time.Hour)
+	w = endSession(op, "id_token_hint="+hint+"&post_logout_redirect_uri=javascript%3Aalert%281%29", w.Result().Cookies())
+	if w.Code != http.StatusBadRequest || strings.Contains(w.Body.String(), "alert") {
+		t.Fatalf("expected 400, got %d %s", w.Code, w.Body.String())
+	}
+}
@@ -3,22 +3,91 @@
 package openid
 
 import (
+	"context"
 	"crypto/ecdsa"
+	"crypto/rand"
 	"errors"
 	"io/ioutil"
 	"net/http"
+	"sync"
+	"time"
 
 	"github.com/openbolt/openid/utils"
 )
 
 // OpenID implements the OpenID Provider (OP)
 type OpenID struct {
+	// Issuer is the Issuer Identifier of this provider, e.g. https://op.example.com
+	Issuer string
+
 	// Datasources
 	Claimsrc  Claimsource
 	Clientsrc Clientsource
 	Enduser   EnduserIf
 	Cache     Cacher
 
+	// Codes must be redeemed within this time
+	CodeLifetime time.Duration
+
+	// If set, codes are stateless: the Session is sealed into the code with
+	// CodeKeys, instead of being stored in Cache. Only the `jti` of redeemed
+	// codes is kept in CodeReplay, which must be shared by all instances.
+	// Keys must be kept in CodeKeys for at least CodeLifetime after rotation.
+	StatelessCodes bool
+	CodeKeys       *Keyring
+	CodeReplay     ReplayCache
+
+	// Optional, if not set, no consent is asked for
+	Consent     ConsentStore
+	Consentpage ConsentIf
+
+	// Optional, if set clients can register dynamically. Without open
+	// registration, an initial access token is required.
+	Clients             ClientStore
+	OpenRegistration    bool
+	InitialAccessTokens InitialAccessTokenSource
+
+	// Optional, if set tokens of deleted clients and of reused codes are
+	// revoked
+	Revocations RevocationStore
+
+	// Supported Authentication Context Class References, ordered from weakest
+	// to strongest. Optional, if empty acr values must match exactly.
+	AcrValuesSupported []string
+
+	// Secret salt for pairwise subject identifiers. If empty, only public
+	// subjects are supported. Must not change, or all pairwise subjects change.
+	PairwiseSalt []byte
+
+	// Used for outgoing requests to URIs chosen by clients, e.g. fetching a
+	// sector_identifier_uri. If not set, a client is used, which only connects
+	// to public addresses and follows only https redirects.
+	HTTPClient *http.Client
+
+	// Optional, if set End-Users stay logged in across clients
+	Sessions           SessionStore
+	SessionCookieName  string
+	SessionIdleTimeout time.Duration
+	SessionMaxAge      time.Duration
+	// Key for the session cookie signature and the CSRF tokens of the
+	// consent and logout dialogs. If empty, a random key is generated on
+	// OpenID.Serve(), so sessions don't survive a restart.
+	SessionKey []byte
+
+	// Delivery of back-channel logout notifications. The backchannel_logout_uri
+	// is chosen by clients, so the default client only connects to public
+	// addresses and doesn't follow redirects.
+	BackchannelClient     *http.Client
+	BackchannelQueueSize  int
+	BackchannelWorkers    int
+	BackchannelRetries    int
+	BackchannelRetryDelay time.Duration
+	backchannel           chan logoutNotification
+	backchannelMu         sync.RWMutex
+	backchannelWorkers    sync.WaitGroup
+	backchannelCtx        context.Context
+	backchannelCancel     context.CancelFunc
+
 	// Initialized on OpenID.Serve()
 	AccessTokenSignKeyFile string
 	accessTokenSignKey     *ecdsa.PrivateKey
@@ -27,16 +96,30 @@ type OpenID struct {
 	serving bool
 }
 
+// DefaultHTTPTimeout is the timeout of OpenID.HTTPClient, if not set
+const DefaultHTTPTimeout = 10 * time.Second
+
 // NewProvider returns an blank OpenID Provider instance
 func NewProvider() *OpenID {
 	op := new(OpenID)
 	op.serving = false
+	op.CodeLifetime = DefaultCodeLifetime
+	op.SessionCookieName = DefaultSessionCookieName
+	op.SessionIdleTimeout = DefaultSessionIdleTimeout
+	op.SessionMaxAge = DefaultSessionMaxAge
+	op.BackchannelQueueSize = DefaultBackchannelQueueSize
+	op.BackchannelWorkers = DefaultBackchannelWorkers
+	op.BackchannelRetries = DefaultBackchannelRetries
+	op.BackchannelRetryDelay = DefaultBackchannelRetryDelay
 
 	return op
 }
 
 // Serve starts the OpenID Provider
 func (op *OpenID) Serve() error {
+	if op.Issuer == "" {
+		return errors.New("No Issuer defined")
+	}
 	if op.Claimsrc == nil {
 		return errors.New("No Claimsource defined")
 	}
@@ -46,10 +129,21 @@ func (op *OpenID) Serve() error {
 	if op.Enduser == nil {
 		return errors.New("No EnduserIf defined")
 	}
-	if op.Cache == nil {
+	if op.StatelessCodes {
+		if op.CodeKeys == nil {
+			return errors.New("No CodeKeys defined")
+		}
+		if op.CodeReplay == nil {
+			return errors.New("No CodeReplay defined")
+		}
+	} else if op.Cache == nil {
 		return errors.New("No Cache defined")
 	}
 
+	if len(op.PairwiseSalt) != 0 && len(op.PairwiseSalt) < MinPairwiseSaltSize {
+		return errors.New("PairwiseSalt too short")
+	}
+
 	// Load AccessToken Sign Key
 	raw, err := ioutil.ReadFile(op.AccessTokenSignKeyFile)
 	if err != nil {
@@ -61,12 +155,32 @@ func (op *OpenID) Serve() error {
 	}
 	op.accessTokenSignKey = key
 
+	// Generate session key, if needed
+	if len(op.SessionKey) == 0 {
+		op.SessionKey = make([]byte, 32)
+		if _, err := rand.Read(op.SessionKey); err != nil {
+			return err
+		}
+	}
+
+	if op.HTTPClient == nil {
+		op.HTTPClient = newHTTPClient(DefaultHTTPTimeout)
+	}
+	op.startBackchannel()
+
 	// Activate
 	op.serving = true
 
 	return nil
 }
 
+// Shutdown stops the OpenID Provider. Pending back-channel logout
+// notifications are delivered until `ctx` is done, then they are dropped.
+func (op *OpenID) Shutdown(ctx context.Context) error {
+	op.serving = false
+	return op.stopBackchannel(ctx)
+}
+
 // AddServer takes an mux and adds basic http endpoints for OpenID Connect
 func (op *OpenID) AddServer(mux *http.ServeMux) error {
 	api, err := newAPI(op)
@@ -77,5 +191,10 @@ func (op *OpenID) AddServer(mux *http.ServeMux) error {
 
 	mux.HandleFunc("/authorize", api.Authorize)
 	mux.HandleFunc("/token", api.Token)
+	mux.HandleFunc("/logout", api.EndSession)
+	mux.HandleFunc("/check_session", api.CheckSession)
+	mux.HandleFunc("/register", api.Register)
+	mux.HandleFunc("/register/", api.ClientConfiguration)
+	mux.HandleFunc("/.well-known/openid-configuration", api.Discovery)
 	return nil
 }
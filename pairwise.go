@@ -0,0 +1,144 @@
+package openid
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"time"
+)
+
+// maxSectorIdentifierSize limits the size of a fetched sector_identifier_uri
+const maxSectorIdentifierSize = 64 * 1024
+
+// MinPairwiseSaltSize is the minimum length of OpenID.PairwiseSalt
+const MinPairwiseSaltSize = 16
+
+// ErrNoPairwiseSalt is returned for pairwise clients, if OpenID.PairwiseSalt
+// isn't set. Without salt, pairwise subjects could be computed by anyone.
+var ErrNoPairwiseSalt = errors.New("Pairwise subjects require a PairwiseSalt")
+
+// subjectFor returns the `sub` value of `localSub` as seen by the client. For
+// pairwise clients, it's derived from the sector identifier, so clients of
+// different sectors can't correlate End-Users. The parts of the hash are
+// separated by NUL, so e.g. the sector "a.example.co" with the subject
+// "malice" can't collide with "a.example.com" and "alice".
+//
+// The sub is only issued in ID Tokens: this provider has no UserInfo or
+// introspection endpoint, which would have to map it the same way.
+// Ref 8.1.  Pairwise Identifier Algorithm
+func (op *OpenID) subjectFor(clt Client, localSub string) (string, error) {
+	if clt.SubjectType != "pairwise" || localSub == "" {
+		return localSub, nil
+	}
+	if len(op.PairwiseSalt) == 0 {
+		return "", ErrNoPairwiseSalt
+	}
+	h := sha256.New()
+	io.WriteString(h, sectorIdentifier(clt)+"\x00"+localSub+"\x00")
+	h.Write(op.PairwiseSalt)
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil)), nil
+}
+
+// sectorIdentifier returns the host of the sector_identifier_uri, or of the
+// redirect_uri if none is registered
+// Ref 8.1.  Pairwise Identifier Algorithm
+func sectorIdentifier(clt Client) string {
+	uri := clt.SectorIdentifierURI
+	if uri == "" && len(clt.RedirectURIs) != 0 {
+		uri = clt.RedirectURIs[0]
+	}
+	u, err := url.Parse(uri)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+// validateSectorIdentifier checks the sector of a pairwise client. Without
+// sector_identifier_uri, all redirect_uris must share one host. Otherwise the
+// sector_identifier_uri must list all redirect_uris.
+// Ref OpenID Connect Dynamic Client Registration 1.0, 5.  "sector_identifier_uri" Validation
+func (op *OpenID) validateSectorIdentifier(clt Client) error {
+	if clt.SectorIdentifierURI == "" {
+		host := sectorIdentifier(clt)
+		for _, uri := range clt.RedirectURIs {
+			if u, err := url.Parse(uri); err != nil || u.Host != host {
+				return errors.New("redirect_uris with different hosts require a sector_identifier_uri")
+			}
+		}
+		return nil
+	}
+
+	u, err := url.Parse(clt.SectorIdentifierURI)
+	if err != nil || u.Scheme != "https" {
+		return errors.New("sector_identifier_uri must use https")
+	}
+
+	// The URI is chosen by the client, see newHTTPClient
+	resp, err := op.HTTPClient.Get(clt.SectorIdentifierURI)
+	if err != nil {
+		return fmt.Errorf("Cannot fetch sector_identifier_uri: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return errors.New("Cannot fetch sector_identifier_uri: " + resp.Status)
+	}
+
+	var uris []string
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxSectorIdentifierSize)).Decode(&uris); err != nil {
+		return errors.New("sector_identifier_uri must contain a JSON array of URIs")
+	}
+	if !containsAll(uris, clt.RedirectURIs) {
+		return errors.New("redirect_uris not included in sector_identifier_uri")
+	}
+	return nil
+}
+
+// newHTTPClient returns the default OpenID.HTTPClient. Its URIs are chosen by
+// clients, so it only follows https URIs and only connects to public
+// addresses, to keep clients from probing the provider's network.
+func newHTTPClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+				return errors.New("Refusing to connect to " + host)
+			}
+			return nil
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if req.URL.Scheme != "https" {
+				return errors.New("Refusing to follow a redirect to " + req.URL.Scheme)
+			}
+			if len(via) >= 5 {
+				return errors.New("Too many redirects")
+			}
+			return nil
+		},
+	}
+}
+
+// isPublicIP returns false for loopback, private, link-local and other
+// special purpose addresses
+func isPublicIP(ip net.IP) bool {
+	return ip.IsGlobalUnicast() && !ip.IsPrivate() && !ip.IsLoopback() &&
+		!ip.IsLinkLocalUnicast() && !ip.IsUnspecified()
+}
@@ -0,0 +1,108 @@
+package openid
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSubjectFor(t *testing.T) {
+	op := NewProvider()
+	op.PairwiseSalt = []byte("salt")
+	subjectFor := func(clt Client, localSub string) string {
+		sub, err := op.subjectFor(clt, localSub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sub
+	}
+
+	a := Client{SubjectType: "pairwise", RedirectURIs: []string{"https://a.example.com/cb"}}
+	a2 := Client{SubjectType: "pairwise", RedirectURIs: []string{"https://a.example.com/other"}}
+	b := Client{SubjectType: "pairwise", RedirectURIs: []string{"https://b.example.com/cb"}}
+	sector := Client{SubjectType: "pairwise", RedirectURIs: []string{"https://b.example.com/cb"}, SectorIdentifierURI: "https://a.example.com/sector.json"}
+
+	if subjectFor(Client{}, "alice") != "alice" {
+		t.Error("public subject changed")
+	}
+	if subjectFor(a, "alice") == "alice" || subjectFor(a, "alice") != subjectFor(a2, "alice") {
+		t.Error("expected the same pairwise subject within a sector")
+	}
+	if subjectFor(a, "alice") == subjectFor(b, "alice") || subjectFor(a, "alice") == subjectFor(a, "bob") {
+		t.Error("expected different pairwise subjects")
+	}
+	if subjectFor(sector, "alice") != subjectFor(a, "alice") {
+		t.Error("sector_identifier_uri not used")
+	}
+	co := Client{SubjectType: "pairwise", RedirectURIs: []string{"https://a.example.co/cb"}}
+	if subjectFor(co, "malice") == subjectFor(a, "alice") {
+		t.Error("sector and subject not separated")
+	}
+
+	op.PairwiseSalt = nil
+	if _, err := op.subjectFor(a, "alice"); err != ErrNoPairwiseSalt {
+		t.Errorf("expected ErrNoPairwiseSalt, got %v", err)
+	}
+}
+
+func TestValidateSectorIdentifier(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`["https://a.example.com/cb","https://b.example.com/cb"]`))
+	}))
+	defer srv.Close()
+
+	op := NewProvider()
+	op.HTTPClient = srv.Client()
+
+	tests := []struct {
+		clt Client
+		ok  bool
+	}{
+		{Client{RedirectURIs: []string{"https://a.example.com/cb", "https://a.example.com/cb2"}}, true},
+		{Client{RedirectURIs: []string{"https://a.example.com/cb", "https://b.example.com/cb"}}, false},
+		{Client{RedirectURIs: []string{"https://a.example.com/cb", "https://b.example.com/cb"}, SectorIdentifierURI: srv.URL}, true},
+		{Client{RedirectURIs: []string{"https://c.example.com/cb"}, SectorIdentifierURI: srv.URL}, false},
+		{Client{RedirectURIs: []string{"https://a.example.com/cb"}, SectorIdentifierURI: "http://a.example.com/"}, false},
+	}
+	for i, test := range tests {
+		if err := op.validateSectorIdentifier(test.clt); (err == nil) != test.ok {
+			t.Errorf("%d: expected %v, got %v", i, test.ok, err)
+		}
+	}
+
+	// The default client doesn't connect to internal addresses
+	op.HTTPClient = newHTTPClient(DefaultHTTPTimeout)
+	if err := op.validateSectorIdentifier(tests[2].clt); err == nil || !strings.Contains(err.Error(), "Refusing") {
+		t.Errorf("expected refused connection, got %v", err)
+	}
+}
+
+func TestPairwiseSession(t *testing.T) {
+	src := newTestSource()
+	clt := src.clients["clt1"]
+	clt.SubjectType = "pairwise"
+	src.clients["clt1"] = clt
+	op := newTestProvider(t, src)
+	op.PairwiseSalt = []byte("salt")
+
+	vals, _ := authorize(op, "_login=1", nil)
+	ses := src.codes[vals.Get("code")]
+	if sub, _ := op.subjectFor(clt, "alice"); ses.Sub != sub || ses.Sub == "alice" || ses.LocalSub != "alice" {
+		t.Errorf("expected pairwise subject, got %s", ses.Sub)
+	}
+}
+
+// Statically configured pairwise clients don't work without salt
+func TestPairwiseWithoutSalt(t *testing.T) {
+	src := newTestSource()
+	clt := src.clients["clt1"]
+	clt.SubjectType = "pairwise"
+	src.clients["clt1"] = clt
+	op := newTestProvider(t, src)
+
+	vals, _ := authorize(op, "_login=1", nil)
+	if vals.Get("error") != "server_error" || len(src.codes) != 0 {
+		t.Errorf("expected server_error, got %v", vals)
+	}
+}
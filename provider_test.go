@@ -0,0 +1,320 @@
+package openid
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testSource is a minimal in-memory datasource for provider tests
+type testSource struct {
+	mu       sync.Mutex
+	codes    map[string]Session
+	redeemed map[string]bool
+	sessions map[string]SSOSession
+	clients  map[string]Client
+	revoked  map[string]time.Time
+	// Revoked code hashes
+	revokedCodes map[string]time.Time
+	// Used jti values of stateless codes
+	jtis map[string]time.Time
+	// Grants by sub and client_id
+	grants map[string]Grant
+	// Authpage returns AuthOk for this subject, if `_login` is set
+	sub       string
+	acr       string
+	authpages int
+	// Returned by Authpage for prompt=none
+	silent AuthState
+}
+
+func newTestSource() *testSource {
+	return &testSource{
+		codes:    make(map[string]Session),
+		redeemed: make(map[string]bool),
+		sessions: make(map[string]SSOSession),
+		clients: map[string]Client{
+			"clt1": {
+				ClientID:                "clt1",
+				RedirectURIs:            []string{"https://rp.example.com/cb"},
+				PostLogoutRedirectURIs:  []string{"https://rp.example.com/loggedout"},
+				TokenEndpointAuthMethod: "none",
+				Trusted:                 true,
+			},
+		},
+		revoked:      make(map[string]time.Time),
+		revokedCodes: make(map[string]time.Time),
+		jtis:         make(map[string]time.Time),
+		grants:       make(map[string]Grant),
+		sub:          "alice",
+		acr:          "0",
+	}
+}
+
+func (s *testSource) Get(id, claim, def string) (string, bool) { return def, false }
+
+func (s *testSource) Authpage(w http.ResponseWriter, r *http.Request, hints AuthHints) AuthState {
+	s.mu.Lock()
+	s.authpages++
+	s.mu.Unlock()
+
+	if hints.Prompt.None {
+		// Must be discarded by the provider
+		w.Write([]byte("login form"))
+		return s.silent
+	}
+	if GetParam(r, "_login") != "" {
+		return AuthState{AuthOk: true, Sub: s.sub, AuthTime: time.Now(), Acr: s.acr}
+	}
+	if GetParam(r, "_reload") != "" {
+		return AuthState{}
+	}
+	w.Write([]byte("login form"))
+	return AuthState{AuthPrompting: true}
+}
+
+func (s *testSource) Cache(val Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.codes[val.Code] = val
+	return nil
+}
+
+func (s *testSource) Redeem(code string) (Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ses, ok := s.codes[code]
+	if s.redeemed[code] {
+		return ses, ErrCodeRedeemed
+	}
+	if !ok {
+		return Session{}, errors.New("Invalid code")
+	}
+	s.redeemed[code] = true
+	return ses, nil
+}
+
+func (s *testSource) Use(id string, exp time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if old, ok := s.jtis[id]; ok && time.Now().Before(old) {
+		return false, nil
+	}
+	s.jtis[id] = exp
+	return true, nil
+}
+
+func (s *testSource) SaveSSOSession(ses SSOSession) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions[ses.ID] = ses
+	return nil
+}
+
+func (s *testSource) GetSSOSession(id string) (SSOSession, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ses, ok := s.sessions[id]
+	if !ok {
+		return SSOSession{}, errors.New("No such session")
+	}
+	return ses, nil
+}
+
+func (s *testSource) DeleteSSOSession(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, id)
+	return nil
+}
+
+func (s *testSource) GetGrant(sub, clientID string) (Grant, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	g, ok := s.grants[sub+" "+clientID]
+	if !ok {
+		return Grant{}, errors.New("No such grant")
+	}
+	return g, nil
+}
+
+func (s *testSource) SaveGrant(g Grant) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.grants[g.Sub+" "+g.ClientID] = g
+	return nil
+}
+
+func (s *testSource) DeleteGrants(clientID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, g := range s.grants {
+		if g.ClientID == clientID {
+			delete(s.grants, k)
+		}
+	}
+	return nil
+}
+
+func (s *testSource) GetClient(id string) (Client, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.clients[id]
+	if !ok {
+		return Client{}, errors.New("No such client")
+	}
+	return c, nil
+}
+
+func (s *testSource) SaveClient(c Client) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clients[c.ClientID] = c
+	return nil
+}
+
+func (s *testSource) DeleteClient(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.clients, id)
+	return nil
+}
+
+func (s *testSource) Revoke(clientID string, t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.revoked[clientID] = t
+	return nil
+}
+
+func (s *testSource) RevokedBefore(clientID string) time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.revoked[clientID]
+}
+
+func (s *testSource) RevokeCode(codeHash string, exp time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.revokedCodes[codeHash] = exp
+	return nil
+}
+
+func (s *testSource) CodeRevoked(codeHash string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return time.Now().Before(s.revokedCodes[codeHash])
+}
+
+// newTestProvider returns a started provider, which uses `src` for everything
+func newTestProvider(t *testing.T, src *testSource) *OpenID {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalECPrivateKey(key)
+	f, err := ioutil.TempFile("", "openid-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	pem.Encode(f, &pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	f.Close()
+
+	op := NewProvider()
+	op.Issuer = "https://op.example.com"
+	op.Claimsrc = src
+	op.Clientsrc = src
+	op.Enduser = src
+	op.Cache = src
+	op.Sessions = src
+	op.AccessTokenSignKeyFile = f.Name()
+	if err := op.Serve(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { op.Shutdown(context.Background()) })
+	return op
+}
+
+// authorize runs an authorization request with `params` against op and
+// returns the redirect parameters and the recorded response
+func authorize(op *OpenID, params string, cookies []*http.Cookie) (url.Values, *httptest.ResponseRecorder) {
+	mux := http.NewServeMux()
+	op.AddServer(mux)
+
+	r, _ := http.NewRequest("GET", "/authorize?scope=openid&response_type=code&client_id=clt1"+
+		"&redirect_uri=https%3A%2F%2Frp.example.com%2Fcb&state=xyz&"+params, nil)
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+
+	u, err := url.Parse(w.Header().Get("Location"))
+	if err != nil || u.Host != "rp.example.com" {
+		return nil, w
+	}
+	vals, _ := url.ParseQuery(u.RawQuery)
+	return vals, w
+}
+
+func TestSSOSession(t *testing.T) {
+	src := newTestSource()
+	op := newTestProvider(t, src)
+
+	// Without session, prompt=none fails
+	vals, _ := authorize(op, "prompt=none", nil)
+	if vals.Get("error") != "login_required" || vals.Get("iss") != op.Issuer {
+		t.Fatalf("expected login_required, got %v", vals)
+	}
+
+	// Log in, this sets the session cookie
+	vals, w := authorize(op, "_login=1", nil)
+	if vals.Get("code") == "" {
+		t.Fatalf("expected code, got %v", vals)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 2 || !cookies[0].HttpOnly {
+		t.Fatalf("expected session cookie, got %v", cookies)
+	}
+
+	// Silent authentication, without asking the EnduserIf
+	before := src.authpages
+	vals, _ = authorize(op, "prompt=none", cookies)
+	if vals.Get("code") == "" || src.authpages != before {
+		t.Fatalf("expected silent authentication, got %v", vals)
+	}
+
+	// prompt=login forces the login form
+	vals, w = authorize(op, "prompt=login", cookies)
+	if vals != nil || w.Body.String() != "login form" {
+		t.Fatalf("expected login form, got %v", vals)
+	}
+
+	// Forged cookies are ignored
+	cookies[0].Value = "x" + cookies[0].Value
+	vals, _ = authorize(op, "prompt=none", cookies)
+	if vals.Get("error") != "login_required" {
+		t.Fatalf("expected login_required, got %v", vals)
+	}
+
+	// Idle timeout
+	op.SessionIdleTimeout = 0
+	_, w = authorize(op, "_login=1", nil)
+	vals, _ = authorize(op, "prompt=none", w.Result().Cookies())
+	if vals.Get("error") != "login_required" {
+		t.Fatalf("expected login_required after timeout, got %v", vals)
+	}
+}
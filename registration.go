@@ -0,0 +1,524 @@
+package openid
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/openbolt/openid/utils"
+	"github.com/pborman/uuid"
+)
+
+const (
+	// ClientSecretOctetsRand has the number of random bytes used for client secrets
+	ClientSecretOctetsRand = 32
+	// RegistrationTokenOctetsRand has the number of random bytes used for
+	// registration access tokens
+	RegistrationTokenOctetsRand = 32
+
+	// maxClientMetadataSize limits the body of registration requests
+	maxClientMetadataSize = 64 * 1024
+)
+
+// RegistrationErrResp is returned if a registration request fails
+// Ref RFC 7591, 3.2.2.  Client Registration Error Response
+type RegistrationErrResp struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description,omitempty"`
+	StatusCode       int    `json:"-"`
+}
+
+// RegistrationResp is returned on successful registration
+// Ref RFC 7591, 3.2.1.  Client Information Response
+type RegistrationResp struct {
+	Client
+	ClientSecret            string `json:"client_secret,omitempty"`
+	ClientSecretExpiresAt   int64  `json:"client_secret_expires_at"`
+	RegistrationAccessToken string `json:"registration_access_token,omitempty"`
+	RegistrationClientURI   string `json:"registration_client_uri,omitempty"`
+}
+
+// Register processes a client registration request and stores the client
+// Ref OpenID Connect Dynamic Client Registration 1.0, 3.  Client Registration Endpoint
+func (op *OpenID) Register(r *http.Request) (RegistrationResp, RegistrationErrResp) {
+	if op.Clients == nil {
+		return RegistrationResp{}, RegistrationErrResp{
+			Error:            "invalid_request",
+			ErrorDescription: "Registration is disabled",
+			StatusCode:       http.StatusNotFound,
+		}
+	}
+
+	// Ref RFC 7591, 3.  Client Registration Endpoint
+	if !op.OpenRegistration {
+		token := bearerToken(r)
+		if token == "" || op.InitialAccessTokens == nil || !op.InitialAccessTokens.ValidateInitialAccessToken(token) {
+			utils.EInfo(errors.New("Invalid initial access token"), r)
+			return RegistrationResp{}, RegistrationErrResp{
+				Error:            "invalid_token",
+				ErrorDescription: "A valid initial access token is required",
+				StatusCode:       http.StatusUnauthorized,
+			}
+		}
+	}
+
+	var clt Client
+	if err := json.NewDecoder(http.MaxBytesReader(nil, r.Body, maxClientMetadataSize)).Decode(&clt); err != nil {
+		utils.EDebug(err, r)
+		return RegistrationResp{}, RegistrationErrResp{
+			Error:            "invalid_client_metadata",
+			ErrorDescription: "Invalid JSON",
+		}
+	}
+	if err := op.validateClientMetadata(&clt); err.Error != "" {
+		utils.EDebug(errors.New("Invalid client metadata: "+err.ErrorDescription), r)
+		return RegistrationResp{}, err
+	}
+
+	resp, err := op.issueClientCredentials(&clt)
+	if err != nil {
+		utils.ELog(err, r)
+		return RegistrationResp{}, RegistrationErrResp{
+			Error:      "server_error",
+			StatusCode: http.StatusInternalServerError,
+		}
+	}
+	clt.ClientID = uuid.New()
+	clt.ClientIDIssuedAt = time.Now().Unix()
+	if err := op.Clients.SaveClient(clt); err != nil {
+		utils.ELog(err, r)
+		return RegistrationResp{}, RegistrationErrResp{
+			Error:      "server_error",
+			StatusCode: http.StatusInternalServerError,
+		}
+	}
+
+	utils.EInfo(errors.New("Registered client "+clt.ClientID), r)
+	resp.Client = clt.public()
+	resp.RegistrationClientURI = op.registrationClientURI(clt.ClientID)
+	return resp, RegistrationErrResp{}
+}
+
+// ReadClient returns the configuration of a registered client
+// Ref RFC 7592, 2.1.  Client Read Request
+func (op *OpenID) ReadClient(r *http.Request, id string) (RegistrationResp, RegistrationErrResp) {
+	clt, err := op.authorizeClientConfiguration(r, id)
+	if err.Error != "" {
+		return RegistrationResp{}, err
+	}
+	return RegistrationResp{
+		Client:                clt.public(),
+		RegistrationClientURI: op.registrationClientURI(id),
+	}, RegistrationErrResp{}
+}
+
+// UpdateClient replaces the metadata of a registered client. The new metadata
+// is validated like on registration.
+//
+// Provider extension: RFC 7592 leaves the rotation of the client_secret to the
+// server. Clients can request it with the query parameter `rotate_secret=true`,
+// the new client_secret is returned once, the old one stops working
+// immediately. Without it, the client_secret is kept.
+// Ref RFC 7592, 2.2.  Client Update Request
+func (op *OpenID) UpdateClient(r *http.Request, id string) (RegistrationResp, RegistrationErrResp) {
+	old, err := op.authorizeClientConfiguration(r, id)
+	if err.Error != "" {
+		return RegistrationResp{}, err
+	}
+
+	var req struct {
+		Client
+		ClientSecret string `json:"client_secret"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(nil, r.Body, maxClientMetadataSize)).Decode(&req); err != nil {
+		utils.EDebug(err, r)
+		return RegistrationResp{}, RegistrationErrResp{
+			Error:            "invalid_client_metadata",
+			ErrorDescription: "Invalid JSON",
+		}
+	}
+
+	// The client_id and client_secret, if sent, must match the current ones
+	if req.ClientID != id {
+		return RegistrationResp{}, RegistrationErrResp{
+			Error:            "invalid_request",
+			ErrorDescription: "client_id doesn't match",
+		}
+	}
+	if req.ClientSecret != "" && !hmac.Equal([]byte(hashSecret(req.ClientSecret)), []byte(old.SecretHash)) {
+		return RegistrationResp{}, RegistrationErrResp{
+			Error:            "invalid_request",
+			ErrorDescription: "client_secret doesn't match",
+		}
+	}
+
+	clt := req.Client
+	if err := op.validateClientMetadata(&clt); err.Error != "" {
+		utils.EDebug(errors.New("Invalid client metadata: "+err.ErrorDescription), r)
+		return RegistrationResp{}, err
+	}
+	clt.ClientID = old.ClientID
+	clt.ClientIDIssuedAt = old.ClientIDIssuedAt
+	clt.RegistrationTokenHash = old.RegistrationTokenHash
+	clt.AccessTokenLifetime = old.AccessTokenLifetime
+	clt.IDTokenLifetime = old.IDTokenLifetime
+	clt.Trusted = old.Trusted
+	clt.RequirePKCE = old.RequirePKCE
+
+	resp := RegistrationResp{}
+	switch {
+	case clt.TokenEndpointAuthMethod == "none":
+	// Not part of RFC 7592, see above
+	case old.SecretHash == "" || r.URL.Query().Get("rotate_secret") == "true":
+		secret, err := GetRandomString(ClientSecretOctetsRand)
+		if err != nil {
+			utils.ELog(err, r)
+			return RegistrationResp{}, RegistrationErrResp{
+				Error:      "server_error",
+				StatusCode: http.StatusInternalServerError,
+			}
+		}
+		resp.ClientSecret = secret
+		clt.SecretHash = hashSecret(secret)
+		utils.EInfo(errors.New("Rotated client_secret of "+id), r)
+	default:
+		clt.SecretHash = old.SecretHash
+	}
+
+	if err := op.Clients.SaveClient(clt); err != nil {
+		utils.ELog(err, r)
+		return RegistrationResp{}, RegistrationErrResp{
+			Error:      "server_error",
+			StatusCode: http.StatusInternalServerError,
+		}
+	}
+
+	utils.EInfo(errors.New("Updated client "+id), r)
+	resp.Client = clt.public()
+	resp.RegistrationClientURI = op.registrationClientURI(id)
+	return resp, RegistrationErrResp{}
+}
+
+// DeleteClient deregisters a client. All tokens and grants of the client are
+// revoked.
+// Ref RFC 7592, 2.3.  Client Delete Request
+func (op *OpenID) DeleteClient(r *http.Request, id string) RegistrationErrResp {
+	if _, err := op.authorizeClientConfiguration(r, id); err.Error != "" {
+		return err
+	}
+
+	if err := op.Clients.DeleteClient(id); err != nil {
+		utils.ELog(err, r)
+		return RegistrationErrResp{
+			Error:      "server_error",
+			StatusCode: http.StatusInternalServerError,
+		}
+	}
+	if op.Revocations != nil {
+		if err := op.Revocations.Revoke(id, time.Now()); err != nil {
+			utils.ELog(err, r)
+		}
+	}
+	if op.Consent != nil {
+		if err := op.Consent.DeleteGrants(id); err != nil {
+			utils.ELog(err, r)
+		}
+	}
+
+	utils.EInfo(errors.New("Deleted client "+id), r)
+	return RegistrationErrResp{}
+}
+
+// authorizeClientConfiguration returns the client, if `r` carries its
+// registration_access_token
+// Ref RFC 7592, 2.  Client Configuration Endpoint
+func (op *OpenID) authorizeClientConfiguration(r *http.Request, id string) (Client, RegistrationErrResp) {
+	unauthorized := RegistrationErrResp{
+		Error:      "invalid_token",
+		StatusCode: http.StatusUnauthorized,
+	}
+	if op.Clients == nil {
+		return Client{}, RegistrationErrResp{
+			Error:      "invalid_request",
+			StatusCode: http.StatusNotFound,
+		}
+	}
+
+	token := bearerToken(r)
+	if token == "" {
+		return Client{}, unauthorized
+	}
+	// An unknown client is reported like an invalid token, so clients can't
+	// be probed
+	clt, err := op.Clients.GetClient(id)
+	if err != nil {
+		utils.EDebug(err, r)
+		return Client{}, unauthorized
+	}
+	if !hmac.Equal([]byte(hashSecret(token)), []byte(clt.RegistrationTokenHash)) {
+		utils.EInfo(errors.New("Invalid registration_access_token for "+id), r)
+		return Client{}, unauthorized
+	}
+	return clt, RegistrationErrResp{}
+}
+
+// issueClientCredentials generates a client_secret and a
+// registration_access_token, only their hashes are kept in `clt`
+func (op *OpenID) issueClientCredentials(clt *Client) (RegistrationResp, error) {
+	resp := RegistrationResp{}
+	if clt.TokenEndpointAuthMethod != "none" {
+		secret, err := GetRandomString(ClientSecretOctetsRand)
+		if err != nil {
+			return resp, err
+		}
+		resp.ClientSecret = secret
+		clt.SecretHash = hashSecret(secret)
+	}
+
+	token, err := GetRandomString(RegistrationTokenOctetsRand)
+	if err != nil {
+		return resp, err
+	}
+	resp.RegistrationAccessToken = token
+	clt.RegistrationTokenHash = hashSecret(token)
+	return resp, nil
+}
+
+func (op *OpenID) registrationClientURI(id string) string {
+	return strings.TrimSuffix(op.Issuer, "/") + "/register/" + url.PathEscape(id)
+}
+
+// public returns the client without the stored secrets
+func (c Client) public() Client {
+	c.SecretHash = ""
+	c.RegistrationTokenHash = ""
+	return c
+}
+
+// validateClientMetadata checks the requested metadata against the provider
+// configuration
+func (op *OpenID) validateClientMetadata(c *Client) RegistrationErrResp {
+	if err := validateClientMetadata(c); err.Error != "" {
+		return err
+	}
+
+	if c.SubjectType == "pairwise" {
+		if len(op.PairwiseSalt) == 0 {
+			return RegistrationErrResp{Error: "invalid_client_metadata", ErrorDescription: "Unsupported subject_type"}
+		}
+		if err := op.validateSectorIdentifier(*c); err != nil {
+			return RegistrationErrResp{Error: "invalid_client_metadata", ErrorDescription: err.Error()}
+		}
+	}
+	return RegistrationErrResp{}
+}
+
+// validateClientMetadata checks the requested metadata and sets defaults
+// Ref OpenID Connect Dynamic Client Registration 1.0, 2.  Client Metadata
+func validateClientMetadata(c *Client) RegistrationErrResp {
+	// Never taken from the request
+	c.ClientID = ""
+	c.ClientIDIssuedAt = 0
+	c.SecretHash = ""
+	c.RegistrationTokenHash = ""
+	c.AccessTokenLifetime = 0
+	c.IDTokenLifetime = 0
+	c.Trusted = false
+	c.RequirePKCE = false
+
+	invalid := func(desc string) RegistrationErrResp {
+		return RegistrationErrResp{Error: "invalid_client_metadata", ErrorDescription: desc}
+	}
+
+	if c.ApplicationType == "" {
+		c.ApplicationType = "web"
+	}
+	if c.ApplicationType != "web" && c.ApplicationType != "native" {
+		return invalid("Unsupported application_type")
+	}
+	if len(c.ResponseTypes) == 0 {
+		c.ResponseTypes = []string{"code"}
+	}
+	if len(c.GrantTypes) == 0 {
+		c.GrantTypes = []string{"authorization_code"}
+	}
+	if c.TokenEndpointAuthMethod == "" {
+		c.TokenEndpointAuthMethod = "client_secret_basic"
+	}
+	if c.SubjectType == "" {
+		c.SubjectType = "public"
+	}
+
+	// Ref 2.  Client Metadata, response_types and grant_types
+	var code, implicit bool
+	for _, rt := range c.ResponseTypes {
+		switch getFlow(rt) {
+		case "authorization_code":
+			code = true
+		case "implicit":
+			implicit = true
+		case "hybrid":
+			code, implicit = true, true
+		default:
+			return invalid("Unsupported response_type " + rt)
+		}
+	}
+	for _, gt := range c.GrantTypes {
+		if gt != "authorization_code" && gt != "implicit" {
+			return invalid("Unsupported grant_type " + gt)
+		}
+	}
+	if code && !containsAll(c.GrantTypes, []string{"authorization_code"}) {
+		return invalid("response_type code requires grant_type authorization_code")
+	}
+	if implicit && !containsAll(c.GrantTypes, []string{"implicit"}) {
+		return invalid("response_type id_token requires grant_type implicit")
+	}
+
+	switch c.TokenEndpointAuthMethod {
+	case "client_secret_basic", "client_secret_post", "none":
+	default:
+		return invalid("Unsupported token_endpoint_auth_method")
+	}
+	if c.SubjectType != "public" && c.SubjectType != "pairwise" {
+		return invalid("Unsupported subject_type")
+	}
+	if c.IDTokenSignedAlg != "" && c.IDTokenSignedAlg != "ES256" {
+		return invalid("Unsupported id_token_signed_response_alg")
+	}
+	if c.UserinfoSignedAlg != "" && c.UserinfoSignedAlg != "ES256" {
+		return invalid("Unsupported userinfo_signed_response_alg")
+	}
+	// Encryption, request objects and JWT client authentication aren't
+	// supported
+	if c.IDTokenEncryptedAlg != "" || c.IDTokenEncryptedEnc != "" ||
+		c.UserinfoEncryptedAlg != "" || c.UserinfoEncryptedEnc != "" {
+		return invalid("Encryption is not supported")
+	}
+	if c.RequestObjectSigningAlg != "" {
+		return invalid("Unsupported request_object_signing_alg")
+	}
+	if c.TokenEndpointAuthAlg != "" {
+		return invalid("Unsupported token_endpoint_auth_signing_alg")
+	}
+
+	// Ref 2.  Client Metadata, redirect_uris
+	if len(c.RedirectURIs) == 0 {
+		return RegistrationErrResp{Error: "invalid_redirect_uri", ErrorDescription: "redirect_uris is required"}
+	}
+	for _, uri := range c.RedirectURIs {
+		if desc := checkRegisteredRedirectURI(uri, c.ApplicationType, implicit); desc != "" {
+			return RegistrationErrResp{Error: "invalid_redirect_uri", ErrorDescription: desc}
+		}
+	}
+	for _, uri := range c.PostLogoutRedirectURIs {
+		if !checkLogoutURI(uri, c.ApplicationType) {
+			return invalid("post_logout_redirect_uri must use https, or http://localhost for native clients")
+		}
+	}
+	// The provider sends requests to it, so don't allow plain http
+	if c.BackchannelLogoutURI != "" &&
+		(!isAbsoluteURI(c.BackchannelLogoutURI) || !strings.HasPrefix(c.BackchannelLogoutURI, "https://")) {
+		return invalid("backchannel_logout_uri must be an absolute https URI")
+	}
+	if c.FrontchannelLogoutURI != "" && !checkLogoutURI(c.FrontchannelLogoutURI, c.ApplicationType) {
+		return invalid("frontchannel_logout_uri must use https, or http://localhost for native clients")
+	}
+
+	// Ref 2.  Client Metadata, jwks_uri and jwks
+	if c.JWKSURI != "" && len(c.JWKS) != 0 {
+		return invalid("jwks_uri and jwks must not both be present")
+	}
+	if c.JWKSURI != "" && !strings.HasPrefix(c.JWKSURI, "https://") {
+		return invalid("jwks_uri must use https")
+	}
+	if len(c.JWKS) != 0 {
+		var set struct {
+			Keys []map[string]interface{} `json:"keys"`
+		}
+		if err := json.Unmarshal(c.JWKS, &set); err != nil || len(set.Keys) == 0 {
+			return invalid("Invalid jwks")
+		}
+		for _, k := range set.Keys {
+			if kty, _ := k["kty"].(string); kty == "" {
+				return invalid("Invalid jwks, kty is missing")
+			}
+		}
+	}
+
+	return RegistrationErrResp{}
+}
+
+// checkRegisteredRedirectURI returns a description, if `uri` can't be
+// registered
+func checkRegisteredRedirectURI(uri, applType string, implicit bool) string {
+	u, err := url.Parse(uri)
+	if err != nil || !u.IsAbs() {
+		return "redirect_uri must be an absolute URI"
+	}
+	if u.Fragment != "" {
+		return "redirect_uri must not contain a fragment"
+	}
+
+	localhost := u.Hostname() == "localhost" || u.Hostname() == "127.0.0.1"
+	switch applType {
+	case "web":
+		// Web Clients using the OAuth Implicit Grant Type MUST only register
+		// URLs using the https scheme as redirect_uris; they MUST NOT use
+		// localhost as the hostname.
+		if implicit && (u.Scheme != "https" || localhost) {
+			return "Implicit web clients must use https and must not use localhost"
+		}
+		// Other schemes, like javascript: or data:, would run in the
+		// End-User's browser
+		if u.Scheme != "https" && (u.Scheme != "http" || !localhost) {
+			return "Web clients must use https, or http with localhost"
+		}
+	case "native":
+		// Native Clients MUST only register redirect_uris using custom URI
+		// schemes or URLs using the http: scheme with localhost as the
+		// hostname.
+		if (u.Scheme == "http" && !localhost) || u.Scheme == "https" {
+			return "Native clients must use a custom scheme or http://localhost"
+		}
+	}
+	return ""
+}
+
+// checkLogoutURI returns true, if `uri` can be registered as
+// post_logout_redirect_uri or frontchannel_logout_uri. The End-User's browser
+// is sent there, so the rules of implicit redirect_uris apply.
+func checkLogoutURI(uri, applType string) bool {
+	if !isAbsoluteURI(uri) {
+		return false
+	}
+	u, _ := url.Parse(uri)
+	localhost := u.Hostname() == "localhost" || u.Hostname() == "127.0.0.1"
+	return u.Scheme == "https" || (u.Scheme == "http" && localhost && applType == "native")
+}
+
+func isAbsoluteURI(uri string) bool {
+	u, err := url.Parse(uri)
+	return err == nil && u.IsAbs() && u.Fragment == ""
+}
+
+// bearerToken returns the token of an `Authorization: Bearer` header
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(auth[7:])
+}
+
+// hashSecret returns the hash of a high-entropy secret, for storage
+func hashSecret(secret string) string {
+	h := sha256.Sum256([]byte(secret))
+	return base64.RawURLEncoding.EncodeToString(h[:])
+}
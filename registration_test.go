@@ -0,0 +1,210 @@
+package openid
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type testInitialTokens string
+
+func (t testInitialTokens) ValidateInitialAccessToken(token string) bool {
+	return token == string(t)
+}
+
+func register(op *OpenID, body, token string) *httptest.ResponseRecorder {
+	mux := http.NewServeMux()
+	op.AddServer(mux)
+
+	r, _ := http.NewRequest("POST", "/register", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	return w
+}
+
+func TestValidateClientMetadata(t *testing.T) {
+	tests := []struct {
+		meta string
+		err  string
+	}{
+		{`{"redirect_uris":["https://rp.example.com/cb"]}`, ""},
+		{`{}`, "invalid_redirect_uri"},
+		{`{"redirect_uris":["/cb"]}`, "invalid_redirect_uri"},
+		{`{"redirect_uris":["https://rp.example.com/cb#x"]}`, "invalid_redirect_uri"},
+		{`{"redirect_uris":["http://localhost/cb"],"response_types":["id_token"],"grant_types":["implicit"]}`, "invalid_redirect_uri"},
+		{`{"redirect_uris":["http://localhost/cb"]}`, ""},
+		{`{"redirect_uris":["http://rp.example.com/cb"]}`, "invalid_redirect_uri"},
+		{`{"redirect_uris":["javascript:alert(1)"]}`, "invalid_redirect_uri"},
+		{`{"redirect_uris":["data:text/html,x"]}`, "invalid_redirect_uri"},
+		{`{"redirect_uris":["file:///etc/passwd"]}`, "invalid_redirect_uri"},
+		{`{"redirect_uris":["com.example.app:/cb"],"application_type":"native"}`, ""},
+		{`{"redirect_uris":["https://rp.example.com/cb"],"application_type":"native"}`, "invalid_redirect_uri"},
+		{`{"redirect_uris":["https://rp.example.com/cb"],"response_types":["code id_token"]}`, "invalid_client_metadata"},
+		{`{"redirect_uris":["https://rp.example.com/cb"],"response_types":["code id_token"],"grant_types":["authorization_code","implicit"]}`, ""},
+		{`{"redirect_uris":["https://rp.example.com/cb"],"response_types":["foo"]}`, "invalid_client_metadata"},
+		{`{"redirect_uris":["https://rp.example.com/cb"],"grant_types":["password"]}`, "invalid_client_metadata"},
+		{`{"redirect_uris":["https://rp.example.com/cb"],"token_endpoint_auth_method":"private_key_jwt"}`, "invalid_client_metadata"},
+		{`{"redirect_uris":["https://rp.example.com/cb"],"jwks":{"keys":[{"kty":"EC"}]}}`, ""},
+		{`{"redirect_uris":["https://rp.example.com/cb"],"jwks":{"keys":[{}]}}`, "invalid_client_metadata"},
+		{`{"redirect_uris":["https://rp.example.com/cb"],"jwks_uri":"http://rp.example.com/jwks"}`, "invalid_client_metadata"},
+		{`{"redirect_uris":["https://rp.example.com/cb"],"jwks_uri":"https://rp.example.com/jwks","jwks":{"keys":[{"kty":"EC"}]}}`, "invalid_client_metadata"},
+		{`{"redirect_uris":["https://rp.example.com/cb"],"backchannel_logout_uri":"https://rp.example.com/bc"}`, ""},
+		{`{"redirect_uris":["https://rp.example.com/cb"],"backchannel_logout_uri":"http://10.0.0.1/bc"}`, "invalid_client_metadata"},
+		{`{"redirect_uris":["https://rp.example.com/cb"],"post_logout_redirect_uris":["https://rp.example.com/bye"],"frontchannel_logout_uri":"https://rp.example.com/fc"}`, ""},
+		{`{"redirect_uris":["https://rp.example.com/cb"],"post_logout_redirect_uris":["javascript:alert(1)"]}`, "invalid_client_metadata"},
+		{`{"redirect_uris":["https://rp.example.com/cb"],"post_logout_redirect_uris":["http://localhost/bye"]}`, "invalid_client_metadata"},
+		{`{"redirect_uris":["com.example.app:/cb"],"application_type":"native","post_logout_redirect_uris":["http://localhost/bye"]}`, ""},
+		{`{"redirect_uris":["https://rp.example.com/cb"],"frontchannel_logout_uri":"data:text/html,x"}`, "invalid_client_metadata"},
+	}
+
+	for _, test := range tests {
+		var c Client
+		if err := json.Unmarshal([]byte(test.meta), &c); err != nil {
+			t.Fatal(err)
+		}
+		if err := validateClientMetadata(&c); err.Error != test.err {
+			t.Errorf("%s: expected %q, got %q (%s)", test.meta, test.err, err.Error, err.ErrorDescription)
+		}
+	}
+}
+
+func TestRegister(t *testing.T) {
+	src := newTestSource()
+	op := newTestProvider(t, src)
+	op.Clients = src
+	op.InitialAccessTokens = testInitialTokens("initial")
+
+	meta := `{"redirect_uris":["https://rp.example.com/cb"],"client_name":"RP","secret_hash":"x"}`
+
+	// Without open registration, an initial access token is needed
+	if w := register(op, meta, ""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d", w.Code)
+	}
+	if w := register(op, meta, "wrong"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d", w.Code)
+	}
+
+	w := register(op, meta, "initial")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	id, _ := resp["client_id"].(string)
+	secret, _ := resp["client_secret"].(string)
+	token, _ := resp["registration_access_token"].(string)
+	if id == "" || secret == "" || token == "" || resp["registration_client_uri"] != op.Issuer+"/register/"+id {
+		t.Fatalf("unexpected response %v", resp)
+	}
+	if _, ok := resp["secret_hash"]; ok {
+		t.Error("secret hash must not be returned")
+	}
+
+	clt, err := src.GetClient(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clt.SecretHash != hashSecret(secret) || clt.RegistrationTokenHash != hashSecret(token) {
+		t.Error("secrets not stored as hash")
+	}
+
+	// Open registration
+	op.OpenRegistration = true
+	if w := register(op, meta, ""); w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", w.Code)
+	}
+	if w := register(op, `{"redirect_uris":[]}`, ""); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", w.Code)
+	}
+
+	// Oversized bodies are rejected
+	big := `{"redirect_uris":["https://rp.example.com/cb"],"client_name":"` + strings.Repeat("x", maxClientMetadataSize) + `"}`
+	if w := register(op, big, ""); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", w.Code)
+	}
+}
+
+func manageClient(op *OpenID, method, id, query, body, token string) *httptest.ResponseRecorder {
+	mux := http.NewServeMux()
+	op.AddServer(mux)
+
+	r, _ := http.NewRequest(method, "/register/"+id+query, strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	return w
+}
+
+func TestClientConfiguration(t *testing.T) {
+	src := newTestSource()
+	op := newTestProvider(t, src)
+	op.Clients = src
+	op.Revocations = src
+	op.OpenRegistration = true
+
+	var reg RegistrationResp
+	w := register(op, `{"redirect_uris":["https://rp.example.com/cb"]}`, "")
+	json.Unmarshal(w.Body.Bytes(), &reg)
+	id, token := reg.ClientID, reg.RegistrationAccessToken
+
+	// Read
+	if w := manageClient(op, "GET", id, "", "", "wrong"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d", w.Code)
+	}
+	if w := manageClient(op, "GET", "unknown", "", "", token); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d", w.Code)
+	}
+	w = manageClient(op, "GET", id, "", "", token)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"client_id":"`+id+`"`) {
+		t.Fatalf("expected client, got %d %s", w.Code, w.Body.String())
+	}
+
+	// Update is validated
+	if w := manageClient(op, "PUT", id, "", `{"client_id":"`+id+`","redirect_uris":["/cb"]}`, token); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", w.Code)
+	}
+	if w := manageClient(op, "PUT", id, "", `{"client_id":"`+id+`","client_secret":"wrong","redirect_uris":["https://rp.example.com/cb"]}`, token); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", w.Code)
+	}
+	w = manageClient(op, "PUT", id, "", `{"client_id":"`+id+`","redirect_uris":["https://rp.example.com/new"]}`, token)
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "client_secret\"") {
+		t.Fatalf("expected update, got %d %s", w.Code, w.Body.String())
+	}
+	if clt, _ := src.GetClient(id); clt.RedirectURIs[0] != "https://rp.example.com/new" || clt.SecretHash != hashSecret(reg.ClientSecret) {
+		t.Fatalf("unexpected client %v", clt)
+	}
+
+	// Rotate secret
+	var upd RegistrationResp
+	w = manageClient(op, "PUT", id, "?rotate_secret=true", `{"client_id":"`+id+`","redirect_uris":["https://rp.example.com/cb"]}`, token)
+	json.Unmarshal(w.Body.Bytes(), &upd)
+	if upd.ClientSecret == "" || upd.ClientSecret == reg.ClientSecret {
+		t.Fatalf("expected new secret, got %s", w.Body.String())
+	}
+
+	// Delete revokes tokens
+	atok := AccessToken{}
+	atok.Load(Session{ClientID: "clt1"}, op.accessTokenSignKey)
+	if _, err := op.ValidateAccessToken(atok.Token); err != nil {
+		t.Fatal(err)
+	}
+	atok.Load(Session{ClientID: id}, op.accessTokenSignKey)
+	if w := manageClient(op, "DELETE", id, "", "", token); w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", w.Code)
+	}
+	if _, err := src.GetClient(id); err == nil {
+		t.Error("client not deleted")
+	}
+	if _, err := op.ValidateAccessToken(atok.Token); err == nil {
+		t.Error("access_token of deleted client still valid")
+	}
+	if src.RevokedBefore(id).IsZero() {
+		t.Error("tokens not revoked")
+	}
+}
@@ -0,0 +1,82 @@
+// Package rp contains helpers for OpenID Connect Relying Parties (RP) using an
+// openbolt/openid provider
+
+package rp
+
+import (
+	"errors"
+	"net/url"
+)
+
+var (
+	// ErrIssuerMismatch is returned when an authorization response was not
+	// issued by the expected provider (mix-up attack, RFC 9207)
+	ErrIssuerMismatch = errors.New("Authorization response issued by another provider")
+
+	// ErrStateMismatch is returned when the state doesn't match the request
+	ErrStateMismatch = errors.New("Authorization response state mismatch")
+)
+
+// Provider describes the OpenID Provider an RP is talking to
+type Provider struct {
+	// Issuer Identifier, as published in the provider metadata
+	Issuer string
+
+	// Copy of `authorization_response_iss_parameter_supported` from the
+	// provider metadata. If true, responses without `iss` are rejected.
+	IssParameterSupported bool
+}
+
+// AuthError is returned when the provider responded with an error
+// Ref 3.1.2.6.  Authentication Error Response
+type AuthError struct {
+	Code        string
+	Description string
+}
+
+func (e AuthError) Error() string {
+	if e.Description == "" {
+		return e.Code
+	}
+	return e.Code + ": " + e.Description
+}
+
+// ParseAuthResponse extracts the parameters of an authorization response from
+// the redirect URI `u` the user agent was sent to. The issuer and `state` are
+// verified for success and error responses.
+// Ref RFC 9207, 2.4.  Validating the Issuer Identifier
+func (p Provider) ParseAuthResponse(u *url.URL, state string) (url.Values, error) {
+	var vals url.Values
+	var err error
+	if u.Fragment != "" {
+		vals, err = url.ParseQuery(u.Fragment)
+	} else {
+		vals, err = url.ParseQuery(u.RawQuery)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Check `iss` first, even an error response could be injected by
+	// another provider
+	if iss, ok := vals["iss"]; ok {
+		if len(iss) != 1 || iss[0] != p.Issuer {
+			return nil, ErrIssuerMismatch
+		}
+	} else if p.IssParameterSupported {
+		return nil, ErrIssuerMismatch
+	}
+
+	if vals.Get("state") != state {
+		return nil, ErrStateMismatch
+	}
+
+	if vals.Get("error") != "" {
+		return nil, AuthError{
+			Code:        vals.Get("error"),
+			Description: vals.Get("error_description"),
+		}
+	}
+
+	return vals, nil
+}
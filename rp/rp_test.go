@@ -0,0 +1,35 @@
+package rp
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestParseAuthResponse(t *testing.T) {
+	p := Provider{Issuer: "https://op.example.com", IssParameterSupported: true}
+
+	tests := []struct {
+		uri string
+		err error
+	}{
+		{"https://rp.example.com/cb?code=abc&state=xyz&iss=https%3A%2F%2Fop.example.com", nil},
+		{"https://rp.example.com/cb#code=abc&state=xyz&iss=https%3A%2F%2Fop.example.com", nil},
+		{"https://rp.example.com/cb?code=abc&state=xyz&iss=https%3A%2F%2Fevil.example.com", ErrIssuerMismatch},
+		{"https://rp.example.com/cb?code=abc&state=xyz", ErrIssuerMismatch},
+		{"https://rp.example.com/cb?code=abc&state=foo&iss=https%3A%2F%2Fop.example.com", ErrStateMismatch},
+		{"https://rp.example.com/cb?error=access_denied&state=xyz&iss=https%3A%2F%2Fevil.example.com", ErrIssuerMismatch},
+	}
+
+	for _, tc := range tests {
+		u, _ := url.Parse(tc.uri)
+		_, err := p.ParseAuthResponse(u, "xyz")
+		if err != tc.err {
+			t.Errorf("%s: got %v, want %v", tc.uri, err, tc.err)
+		}
+	}
+
+	u, _ := url.Parse("https://rp.example.com/cb?error=access_denied&state=xyz&iss=https%3A%2F%2Fop.example.com")
+	if _, err := p.ParseAuthResponse(u, "xyz"); err == nil || err.(AuthError).Code != "access_denied" {
+		t.Errorf("expected access_denied, got %v", err)
+	}
+}
@@ -0,0 +1,135 @@
+package openid
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/openbolt/openid/utils"
+)
+
+const (
+	// BrowserStateCookieSuffix is appended to OpenID.SessionCookieName for the
+	// cookie, which is read by the check_session_iframe
+	BrowserStateCookieSuffix = "_bs"
+	// SessionStateSaltOctetsRand has the number of random bytes used as salt
+	// for session_state
+	SessionStateSaltOctetsRand = 8
+)
+
+// The check_session_iframe recalculates session_state with the browser state
+// cookie and compares it with the one sent by the RP.
+// Ref OpenID Connect Session Management 1.0, 4.2.  OP iframe
+var checkSessionTemplate = template.Must(template.New("check_session.html").Parse(`<!DOCTYPE html>
+<html>
+	<head>
+		<title>Check session</title>
+		<script>
+		var cookieName = {{ .Cookie }};
+
+		function browserState() {
+			var cookies = document.cookie.split(";");
+			for (var i = 0; i < cookies.length; i++) {
+				var c = cookies[i].trim();
+				if (c.indexOf(cookieName + "=") === 0) {
+					return c.substring(cookieName.length + 1);
+				}
+			}
+			return "";
+		}
+
+		function b64url(buf) {
+			var s = String.fromCharCode.apply(null, new Uint8Array(buf));
+			return btoa(s).replace(/\+/g, "-").replace(/\//g, "_").replace(/=+$/, "");
+		}
+
+		window.addEventListener("message", function(e) {
+			var parts = String(e.data).split(" ");
+			if (parts.length !== 2 || parts[1].lastIndexOf(".") < 0) {
+				e.source.postMessage("error", e.origin);
+				return;
+			}
+			var clientId = parts[0];
+			var i = parts[1].lastIndexOf(".");
+			var salt = parts[1].substring(i + 1);
+			var data = new TextEncoder().encode([clientId, e.origin, browserState(), salt].join(" "));
+			crypto.subtle.digest("SHA-256", data).then(function(hash) {
+				var state = b64url(hash) + "." + salt;
+				e.source.postMessage(state === parts[1] ? "unchanged" : "changed", e.origin);
+			}, function() {
+				e.source.postMessage("error", e.origin);
+			});
+		}, false);
+		</script>
+	</head>
+	<body></body>
+</html>
+`))
+
+// CheckSession renders the check_session_iframe
+// Ref OpenID Connect Session Management 1.0, 3.3.  OP iframe
+func (op *OpenID) CheckSession(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := checkSessionTemplate.Execute(w, struct{ Cookie string }{op.browserStateCookieName()})
+	if err != nil {
+		utils.ELog(err, r)
+	}
+}
+
+// sessionState returns the session_state for an authorization response
+// Ref OpenID Connect Session Management 1.0, 3.  Creating and Updating Sessions
+func (op *OpenID) sessionState(ar *AuthenticationRequest, ses *SSOSession) string {
+	salt, err := GetRandomString(SessionStateSaltOctetsRand)
+	if err != nil {
+		return ""
+	}
+	return computeSessionState(ar.ClientID, origin(ar.RedirectURI), op.browserState(ses.ID), salt)
+}
+
+func computeSessionState(clientID, origin, browserState, salt string) string {
+	h := sha256.Sum256([]byte(strings.Join([]string{clientID, origin, browserState, salt}, " ")))
+	return base64.RawURLEncoding.EncodeToString(h[:]) + "." + salt
+}
+
+// browserState is the value of the browser state cookie. It is derived from
+// the session id, but doesn't disclose it.
+func (op *OpenID) browserState(sessionID string) string {
+	return op.sessionMAC("browser-state", sessionID)
+}
+
+func (op *OpenID) browserStateCookieName() string {
+	return op.SessionCookieName + BrowserStateCookieSuffix
+}
+
+// setBrowserStateCookie sets the cookie, which is readable by the
+// check_session_iframe. Unlike the session cookie, it must not be HttpOnly.
+func (op *OpenID) setBrowserStateCookie(w http.ResponseWriter, val string, expires time.Time) {
+	cookie := &http.Cookie{
+		Name:    op.browserStateCookieName(),
+		Value:   val,
+		Path:    "/",
+		Expires: expires,
+		Secure:  strings.HasPrefix(op.Issuer, "https:"),
+	}
+	// The iframe is embedded by the RP, so the cookie is sent cross-site
+	if cookie.Secure {
+		cookie.SameSite = http.SameSiteNoneMode
+	}
+	if !expires.IsZero() {
+		cookie.MaxAge = -1
+	}
+	http.SetCookie(w, cookie)
+}
+
+// origin returns scheme://host of uri
+func origin(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return ""
+	}
+	return u.Scheme + "://" + u.Host
+}
@@ -0,0 +1,37 @@
+package openid
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSessionState(t *testing.T) {
+	src := newTestSource()
+	op := newTestProvider(t, src)
+
+	vals, w := authorize(op, "_login=1", nil)
+	state := vals.Get("session_state")
+	i := strings.LastIndex(state, ".")
+	if i < 0 {
+		t.Fatalf("expected session_state, got %v", vals)
+	}
+
+	var bs string
+	for _, c := range w.Result().Cookies() {
+		if c.Name == op.browserStateCookieName() {
+			bs = c.Value
+			if c.HttpOnly {
+				t.Error("browser state cookie must be readable by the iframe")
+			}
+		}
+	}
+	if bs == "" {
+		t.Fatal("browser state cookie not set")
+	}
+	if state != computeSessionState("clt1", "https://rp.example.com", bs, state[i+1:]) {
+		t.Errorf("session_state doesn't match browser state")
+	}
+	if state == computeSessionState("clt1", "https://rp.example.com", "", state[i+1:]) {
+		t.Errorf("session_state doesn't change on logout")
+	}
+}
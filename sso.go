@@ -0,0 +1,198 @@
+package openid
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/openbolt/openid/utils"
+)
+
+const (
+	// DefaultSessionCookieName is used, if OpenID.SessionCookieName isn't set
+	DefaultSessionCookieName = "openid_session"
+	// DefaultSessionIdleTimeout ends SSO sessions, which weren't used for this time
+	DefaultSessionIdleTimeout = 30 * time.Minute
+	// DefaultSessionMaxAge ends SSO sessions after this time, even if used
+	DefaultSessionMaxAge = 12 * time.Hour
+
+	// SessionIDOctetsRand has the number of random bytes used for session ids
+	SessionIDOctetsRand = 32
+	// SidOctetsRand has the number of random bytes used for the public `sid`
+	SidOctetsRand = 16
+)
+
+// SSOSession is the provider-managed browser session of an End-User. It ties
+// authentications together across clients.
+type SSOSession struct {
+	// Secret, referenced by the session cookie
+	ID string
+	// Public session identifier, used as `sid` Claim
+	// Ref OpenID Connect Back-Channel Logout 1.0, 2.1.  Indicating OP Support for Back-Channel Logout
+	Sid string
+
+	Sub      string
+	AuthTime time.Time
+	Acr      string
+	Amr      string
+
+	// Used for idle and absolute timeouts
+	Created  time.Time
+	LastSeen time.Time
+
+	// Clients which got tokens during this session, notified on logout
+	Clients []string
+}
+
+// SessionStore persists SSO sessions
+type SessionStore interface {
+	SaveSSOSession(s SSOSession) error
+	// Returns an error, if there is no session with this id
+	GetSSOSession(id string) (SSOSession, error)
+	DeleteSSOSession(id string) error
+}
+
+// loadSSOSession returns the valid SSO session referenced by the session
+// cookie of r, if any
+func (op *OpenID) loadSSOSession(r *http.Request) (SSOSession, bool) {
+	if op.Sessions == nil {
+		return SSOSession{}, false
+	}
+
+	cookie, err := r.Cookie(op.SessionCookieName)
+	if err != nil {
+		return SSOSession{}, false
+	}
+	id, ok := op.verifySessionCookie(cookie.Value)
+	if !ok {
+		utils.EInfo(errors.New("Invalid session cookie"), r)
+		return SSOSession{}, false
+	}
+
+	ses, err := op.Sessions.GetSSOSession(id)
+	if err != nil {
+		utils.EDebug(err, r)
+		return SSOSession{}, false
+	}
+
+	now := time.Now()
+	if now.Sub(ses.LastSeen) > op.SessionIdleTimeout || now.Sub(ses.Created) > op.SessionMaxAge {
+		utils.EDebug(errors.New("SSO session expired"), r)
+		op.Sessions.DeleteSSOSession(id)
+		return SSOSession{}, false
+	}
+	return ses, true
+}
+
+// startSSOSession creates a new SSO session after the End-User authenticated.
+// The session id is always renewed, to prevent session fixation.
+func (op *OpenID) startSSOSession(w http.ResponseWriter, r *http.Request, state AuthState) (SSOSession, error) {
+	if old, ok := op.loadSSOSession(r); ok {
+		op.Sessions.DeleteSSOSession(old.ID)
+	}
+
+	id, err := GetRandomString(SessionIDOctetsRand)
+	if err != nil {
+		return SSOSession{}, err
+	}
+	sid, err := GetRandomString(SidOctetsRand)
+	if err != nil {
+		return SSOSession{}, err
+	}
+
+	now := time.Now()
+	ses := SSOSession{
+		ID:       id,
+		Sid:      sid,
+		Sub:      state.Sub,
+		AuthTime: state.AuthTime,
+		Acr:      state.Acr,
+		Amr:      state.Amr,
+		Created:  now,
+		LastSeen: now,
+	}
+	if err := op.Sessions.SaveSSOSession(ses); err != nil {
+		return SSOSession{}, err
+	}
+
+	op.setSessionCookie(w, op.signSessionCookie(id), time.Time{})
+	op.setBrowserStateCookie(w, op.browserState(id), time.Time{})
+	return ses, nil
+}
+
+// touchSSOSession extends the idle timeout of a used SSO session
+func (op *OpenID) touchSSOSession(r *http.Request, ses SSOSession) SSOSession {
+	ses.LastSeen = time.Now()
+	if err := op.Sessions.SaveSSOSession(ses); err != nil {
+		utils.ELog(err, r)
+	}
+	return ses
+}
+
+// addSSOClient remembers that `clientID` got tokens during the SSO session
+func (op *OpenID) addSSOClient(r *http.Request, ses *SSOSession, clientID string) {
+	for _, c := range ses.Clients {
+		if c == clientID {
+			return
+		}
+	}
+	ses.Clients = append(ses.Clients, clientID)
+	if err := op.Sessions.SaveSSOSession(*ses); err != nil {
+		utils.ELog(err, r)
+	}
+}
+
+// endSSOSession deletes the SSO session of r, removes the cookie and notifies
+// the clients of the session
+func (op *OpenID) endSSOSession(w http.ResponseWriter, r *http.Request) {
+	if ses, ok := op.loadSSOSession(r); ok {
+		if err := op.Sessions.DeleteSSOSession(ses.ID); err != nil {
+			utils.ELog(err, r)
+		}
+		op.backchannelLogout(r, ses)
+	}
+	op.setSessionCookie(w, "", time.Unix(1, 0))
+	op.setBrowserStateCookie(w, "", time.Unix(1, 0))
+}
+
+func (op *OpenID) setSessionCookie(w http.ResponseWriter, val string, expires time.Time) {
+	cookie := &http.Cookie{
+		Name:     op.SessionCookieName,
+		Value:    val,
+		Path:     "/",
+		Expires:  expires,
+		Secure:   strings.HasPrefix(op.Issuer, "https:"),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if !expires.IsZero() {
+		cookie.MaxAge = -1
+	}
+	http.SetCookie(w, cookie)
+}
+
+// signSessionCookie returns the cookie value for session `id`: id.mac
+func (op *OpenID) signSessionCookie(id string) string {
+	return id + "." + op.sessionMAC("cookie", id)
+}
+
+// verifySessionCookie returns the session id of a cookie value
+func (op *OpenID) verifySessionCookie(val string) (string, bool) {
+	i := strings.LastIndex(val, ".")
+	if i < 0 {
+		return "", false
+	}
+	id, mac := val[:i], val[i+1:]
+	return id, hmac.Equal([]byte(mac), []byte(op.sessionMAC("cookie", id)))
+}
+
+// sessionMAC returns an HMAC over `vals`, keyed with OpenID.SessionKey
+func (op *OpenID) sessionMAC(vals ...string) string {
+	h := hmac.New(sha256.New, op.SessionKey)
+	h.Write([]byte(strings.Join(vals, " ")))
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
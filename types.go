@@ -1,6 +1,7 @@
 package openid
 
 import (
+	"errors"
 	"net/http"
 	"time"
 )
@@ -24,6 +25,10 @@ type AuthSuccessResp struct {
 	AccessToken string        `url:"access_token,omitempty" json:"access_token,omitempty"`
 	TokenType   string        `url:"token_type,omitempty" json:"token_type,omitempty"`
 	ExpiresIn   time.Duration `url:"expires_in,omitempty" json:"expires_in,omitempty"`
+	// Ref RFC 9207, only used in authorization responses
+	Iss string `url:"iss,omitempty" json:"-"`
+	// Ref OpenID Connect Session Management 1.0, 3.  Creating and Updating Sessions
+	SessionState string `url:"session_state,omitempty" json:"-"`
 }
 
 // AuthErrResp holds all parameters which can be returned to the user in error case
@@ -33,6 +38,7 @@ type AuthErrResp struct {
 	ErrorDescription string      `url:"error_description,omitempty"`
 	ErrorURI         string      `url:"error_uri,omitempty"`
 	State            string      `url:"state,omitempty"`
+	Iss              string      `url:"iss,omitempty" json:"-"`
 	StatusCode       int         `json:"omitted"`
 	Headers          http.Header `json:"ommited"`
 }
@@ -43,9 +49,24 @@ type AuthErrResp struct {
 
 // Cacher is used to cache sessions between code request and id_token retrieval
 type Cacher interface {
+	// Returns an error, if the code is already cached
 	Cache(val Session) error
-	GetSession(code string) (Session, error)
-	Retire(code string)
+	// Redeem returns the session of `code` and invalidates the code in one
+	// atomic step, so concurrent requests can't both succeed. Returns
+	// ErrCodeRedeemed, if the code was redeemed before, along with the
+	// session if it is still known, so its tokens can be revoked for their
+	// whole lifetime.
+	Redeem(code string) (Session, error)
+}
+
+// ErrCodeRedeemed is returned by Cacher.Redeem on reuse of a code
+var ErrCodeRedeemed = errors.New("Code already redeemed")
+
+// ReplayCache remembers one-time identifiers, like the `jti` of assertions,
+// until they expire
+type ReplayCache interface {
+	// Use returns false, if `id` was used before and hasn't expired yet
+	Use(id string, exp time.Time) (bool, error)
 }
 
 // Claimsource returns claims according to `id`
@@ -56,23 +77,58 @@ type Claimsource interface {
 
 // Clientsource is the databinding for OAuth 2.0 clients
 type Clientsource interface {
-	IsClient(id string) bool
-	// returns "confidential", "public"
-	GetApplType(id string) string
-	// returns "web", "user-agent-based", "native"
-	ValidateRedirectURI(id, uri string) bool
+	// Returns an error, if there is no client with this id
+	GetClient(id string) (Client, error)
 }
 
 // EnduserIf is used for rendering enduser dialogs
-// Authpage must comply with `3.1.2.1.  Authentication Request`
-// In short, it should implement the following:
-//   - Claims: display, prompt, max_age, ui_locales, id_token_hint, login_hint, acr_values
+// Authpage must comply with `3.1.2.1.  Authentication Request`
+// In short, it should implement the following:
+//   - Claims: display, max_age, ui_locales, id_token_hint, login_hint, acr_values
 type EnduserIf interface {
-	// Q: Is user already authenticated/able to authN automaticaly?
+	// Q: Is user already authenticated/able to authN automaticaly?
 	//   Y: Return AuthState:AuthOk=true
 	//   N: Prompt for creds, set session
-	// The redirect will be handled outside
-	Authpage(w http.ResponseWriter, r *http.Request) AuthState
+	// The redirect will be handled outside
+	// `prompt` is evaluated by the provider and passed as hints.Prompt.
+	// With hints.Prompt.None no dialog may be shown, output is discarded.
+	Authpage(w http.ResponseWriter, r *http.Request, hints AuthHints) AuthState
+}
+
+// AuthHints tells the EnduserIf what the provider expects from Authpage
+type AuthHints struct {
+	// The request which is processed
+	Request *AuthenticationRequest
+
+	Prompt Prompt
+
+	// Reauthenticate the End-User, even if a session exists. Set on
+	// prompt=login or if the last authentication is older than max_age.
+	ForceLogin bool
+
+	// If set, the End-User must be authenticated as this subject. Taken
+	// from id_token_hint or a `sub` claims request.
+	Sub string
+
+	// Requested Authentication Context Class References, in order of
+	// preference. If AcrEssential, the request fails unless AuthState.Acr
+	// satisfies one of them.
+	// Ref 5.5.1.1.  Requesting the "acr" Claim
+	AcrValues    []string
+	AcrEssential bool
+}
+
+// Prompt holds the parsed `prompt` parameter
+// Ref 3.1.2.1.  Authentication Request
+type Prompt struct {
+	// Don't display any authentication or consent user interface pages
+	None bool
+	// Reauthenticate the End-User
+	Login bool
+	// Ask the End-User for consent before returning information to the Client
+	Consent bool
+	// Prompt the End-User to select a user account
+	SelectAccount bool
 }
 
 // AuthState is used as the return value of EnduserIf
@@ -86,6 +142,11 @@ type AuthState struct {
 	AuthTime      time.Time
 	Acr           string
 	Amr           string
+
+	// Only evaluated with prompt=none, if AuthOk is not set
+	// Ref 3.1.2.6.  Authentication Error Response
+	AuthInteractionRequired      bool
+	AuthAccountSelectionRequired bool
 }
 
 // Session stores information about pending "code" requests, and data used for
@@ -93,17 +154,40 @@ type AuthState struct {
 type Session struct {
 	Code     string
 	ClientID string
+	// As seen by the client, see LocalSub for the Claimsource
+	Sub      string
+	LocalSub string
 	Nonce    string
+	// Granted scopes, checked against the client registration
 	Scope    string
 	AuthTime time.Time
 
 	// When max_age is used, the ID Token returned MUST
 	// include an auth_time Claim Value.
 	MaxAge time.Duration
+	// Set if max_age was requested or the client registered require_auth_time
+	RequireAuthTime bool
 
 	Acr           string
 	ClaimsLocales string
 	Claims        ClaimsRequest
+
+	// `sid` of the SSO session, empty if sessions are disabled
+	Sid string
+
+	// Taken from the client, if 0 the defaults are used
+	AccessTokenLifetime time.Duration
+	IDTokenLifetime     time.Duration
+
+	// The code can't be redeemed after this time
+	ExpiresAt time.Time
+
+	// The code is bound to these values of the authorization request, they
+	// are checked on redemption
+	RedirectURI         string
+	CodeChallenge       string
+	CodeChallengeMethod string
+	Resources           []string
 }
 
 // ClaimsRequest is used to deserialize the `claims` request for future processing
@@ -121,5 +205,6 @@ type ClaimRequest struct {
 
 	// If !Default, then these are used
 	Essential bool     `json:"essential,omitempty"`
+	Value     string   `json:"value,omitempty"`
 	Values    []string `json:"values,omitempty"`
 }
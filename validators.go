@@ -73,6 +73,10 @@ var (
 	// code       = 1*VSCHAR
 	reCode = regexp.MustCompile(VSCHAR + "+")
 
+	// Ref RFC 7636, 4.1.
+	// code-verifier = 43*128unreserved, also used for the code challenge
+	reCodeVerifier = regexp.MustCompile("^[A-Za-z0-9\\-._~]{43,128}$")
+
 	// access-token = 1*VSCHAR
 	reAccessToken = regexp.MustCompile(VSCHAR + "+")
 
@@ -106,9 +110,9 @@ var (
 // The Authorization Server MUST validate all the OAuth 2.0 parameters according
 // to the OAuth 2.0 specification.
 // Ref rfc6749 appendix-A
-func validateOAuthParams(r *http.Request) AuthErrResp {
+func validateOAuthParams(r *http.Request, vals url.Values) AuthErrResp {
 	test := func(parm string, re *regexp.Regexp, cont *string) bool {
-		if GetParam(r, parm) != "" && !re.MatchString(GetParam(r, parm)) {
+		if vals.Get(parm) != "" && !re.MatchString(vals.Get(parm)) {
 			utils.EDebug(errors.New(parm+" malformed"), r)
 			*cont = *cont + parm + ";"
 			return false
@@ -142,7 +146,7 @@ func validateOAuthParams(r *http.Request) AuthErrResp {
 	} else {
 		resp.Error = "invalid_request"
 		resp.ErrorDescription = "One or more malformed request parameters: " + *errParm
-		resp.State = GetParam(r, "state")
+		resp.State = vals.Get("state")
 
 		utils.EDebug(errors.New("returning invalid_request"), r)
 	}
@@ -151,8 +155,8 @@ func validateOAuthParams(r *http.Request) AuthErrResp {
 
 // Rule 2:
 // Verify that a scope parameter is present and contains the openid scope value.
-func validateScopeParam(r *http.Request) AuthErrResp {
-	args := strings.Split(GetParam(r, "scope"), " ")
+func validateScopeParam(r *http.Request, ar *AuthenticationRequest) AuthErrResp {
+	args := strings.Split(ar.Scope, " ")
 
 	// Check if openid value in scope
 	var ok = false
@@ -168,7 +172,7 @@ func validateScopeParam(r *http.Request) AuthErrResp {
 	} else {
 		resp.Error = "invalid_request"
 		resp.ErrorDescription = "Scope doesn't contain openid"
-		resp.State = GetParam(r, "state")
+		resp.State = ar.State
 
 		utils.EDebug(errors.New("returning invalid_request"), r)
 	}
@@ -181,24 +185,24 @@ func validateScopeParam(r *http.Request) AuthErrResp {
 //   Scope  will not be tested as it is already done in validate_scope_param
 //   Required params: scope, response_type, client_id, redirect_uri
 //   For Implicit: + nonce
-func validateReqParams(r *http.Request, clt Clientsource) AuthErrResp {
+func validateReqParams(r *http.Request, ar *AuthenticationRequest, src Clientsource) (Client, AuthErrResp) {
 	var ok = true
 	var errs string
 
 	// Check existence of parameters
-	if GetParam(r, "scope") == "" {
+	if ar.Scope == "" {
 		errs += "scope missing"
 		ok = false
 	}
-	if GetParam(r, "response_type") == "" {
+	if ar.ResponseType == "" {
 		errs += "response_type missing"
 		ok = false
 	}
-	if GetParam(r, "client_id") == "" {
+	if ar.ClientID == "" {
 		errs += "client_id missing"
 		ok = false
 	}
-	if GetParam(r, "redirect_uri") == "" {
+	if ar.RedirectURI == "" {
 		errs += "redirect_uri missing"
 		ok = false
 	}
@@ -207,7 +211,7 @@ func validateReqParams(r *http.Request, clt Clientsource) AuthErrResp {
 	// OAuth 2.0 Response Type value that determines the authorization
 	// processing flow to be used, including what parameters are returned
 	// from the endpoints used.
-	flow := getFlow(GetParam(r, "response_type"))
+	flow := getFlow(ar.ResponseType)
 	if flow == "" {
 		s := "invalid response_type"
 		utils.EDebug(errors.New(s), r)
@@ -217,7 +221,8 @@ func validateReqParams(r *http.Request, clt Clientsource) AuthErrResp {
 
 	// client_id
 	// OAuth 2.0 Client Identifier valid at the Authorization Server.
-	t := clt.IsClient(GetParam(r, "client_id"))
+	clt, err := src.GetClient(ar.ClientID)
+	t := err == nil
 	if !t {
 		errs += "no client with this id;"
 	}
@@ -233,9 +238,8 @@ func validateReqParams(r *http.Request, clt Clientsource) AuthErrResp {
 	// and provided the OP allows the use of http Redirection URIs in this case.
 	// The Redirection URI MAY use an alternate scheme, such as one that is
 	// intended to identify a callback into a native application.
-	clientID := GetParam(r, "client_id")
-	redirectURI := GetParam(r, "redirect_uri")
-	t = checkRedirectURI(redirectURI, clientID, flow, clt)
+	redirectURI := ar.RedirectURI
+	t = t && checkRedirectURI(redirectURI, flow, clt)
 	if !t {
 		errs += "invalid or not allowed redirect_uri;"
 	}
@@ -246,7 +250,7 @@ func validateReqParams(r *http.Request, clt Clientsource) AuthErrResp {
 	// and to mitigate replay attacks. The value is passed through unmodified
 	// from the Authentication Request to the ID Token. Sufficient entropy
 	// MUST be present in the nonce values used to prevent attackers from guessing values
-	if flow == "implicit" && len(GetParam(r, "nonce")) == 0 {
+	if flow == "implicit" && len(ar.Nonce) == 0 {
 		s := "nonce not present in implicit flow"
 		utils.EDebug(errors.New(s), r)
 		errs += s + ";"
@@ -255,16 +259,44 @@ func validateReqParams(r *http.Request, clt Clientsource) AuthErrResp {
 
 	// Return
 	resp := AuthErrResp{}
-	if ok {
-		utils.EDebug(errors.New("returning ok"), r)
-	} else {
+	if !ok {
 		resp.Error = "invalid_request"
 		resp.ErrorDescription = "One or more not valid parameters: " + errs
-		resp.State = GetParam(r, "state")
+		resp.State = ar.State
 
 		utils.EDebug(errors.New("returning invalid_request"), r)
+		return clt, resp
 	}
-	return resp
+
+	// The client must have registered the response_type and scopes
+	// Ref OAuth 2.0 rfc6749#section-4.1.2.1
+	if !clt.AllowsResponseType(ar.ResponseType) {
+		resp.Error = "unauthorized_client"
+		resp.ErrorDescription = "response_type not registered for this client"
+		resp.State = ar.State
+
+		utils.EDebug(errors.New("returning unauthorized_client"), r)
+		return clt, resp
+	}
+	if !clt.AllowsScopes(strings.Fields(ar.Scope)) {
+		resp.Error = "invalid_scope"
+		resp.ErrorDescription = "scope not allowed for this client"
+		resp.State = ar.State
+
+		utils.EDebug(errors.New("returning invalid_scope"), r)
+		return clt, resp
+	}
+	if clt.RequirePKCE && flow != "implicit" && ar.CodeChallenge == "" {
+		resp.Error = "invalid_request"
+		resp.ErrorDescription = "code_challenge required for this client"
+		resp.State = ar.State
+
+		utils.EDebug(errors.New("returning invalid_request"), r)
+		return clt, resp
+	}
+
+	utils.EDebug(errors.New("returning ok"), r)
+	return clt, resp
 }
 
 // Rule 4
@@ -277,14 +309,70 @@ func validateReqParams(r *http.Request, clt Clientsource) AuthErrResp {
 // Authorization Server. Such a request can be made either using an
 // id_token_hint parameter or by requesting a specific Claim Value as described
 // in Section 5.5.1, if the claims parameter is supported by the implementation.
-func validateSubParam(r *http.Request, sub string) AuthErrResp {
-	// BUG(djboris) Implement
-	utils.EInfo(errors.New("returning ok, as Not Implemented"), r)
-	return AuthErrResp{}
+func validateSubParam(r *http.Request, ar *AuthenticationRequest, hint string, sub string) AuthErrResp {
+	ok := hint == "" || hint == sub
+
+	if c, found := ar.Claims.IDToken["sub"]; found && !c.Default {
+		ok = ok && (c.Value == "" || c.Value == sub)
+		if len(c.Values) != 0 {
+			var t bool
+			for _, v := range c.Values {
+				t = t || v == sub
+			}
+			ok = ok && t
+		}
+	}
+
+	resp := AuthErrResp{}
+	if ok {
+		utils.EDebug(errors.New("returning ok"), r)
+	} else {
+		resp.Error = "login_required"
+		resp.ErrorDescription = "End-User is not authenticated as the requested subject"
+		resp.State = ar.State
+
+		utils.EDebug(errors.New("returning login_required"), r)
+	}
+	return resp
 }
 
-// checkRedirectURI validates an redirect_uri according to flow type
-func checkRedirectURI(redirectURI, clientID, flow string, clt Clientsource) bool {
+// subjectHint returns the subject requested by id_token_hint or a `sub`
+// claims request
+// Ref 3.1.2.1. id_token_hint
+func (op *OpenID) subjectHint(r *http.Request, ar *AuthenticationRequest) (string, AuthErrResp) {
+	var sub string
+	if ar.IDTokenHint != "" {
+		tok, err := op.verifyIDTokenHint(ar.IDTokenHint)
+		// A token of another client must not steer the authentication
+		if err == nil && !hasAudience(tok, ar.ClientID) {
+			err = errors.New("id_token_hint issued to another client")
+		}
+		if err != nil {
+			utils.EDebug(err, r)
+			resp := AuthErrResp{}
+			resp.Error = "invalid_request"
+			resp.ErrorDescription = "Invalid id_token_hint"
+			resp.State = ar.State
+
+			utils.EDebug(errors.New("returning invalid_request"), r)
+			return "", resp
+		}
+		sub, _ = tok.Claims["sub"].(string)
+	} else if c, ok := ar.Claims.IDToken["sub"]; ok {
+		sub = c.Value
+	}
+
+	utils.EDebug(errors.New("returning ok"), r)
+	return sub, AuthErrResp{}
+}
+
+// checkRedirectURI validates an redirect_uri according to flow type
+func checkRedirectURI(redirectURI, flow string, clt Client) bool {
+	if !clt.ValidRedirectURI(redirectURI) {
+		utils.EDebug(errors.New("Client hasn't registered this redirect_uri"), nil)
+		return false
+	}
+
 	if flow == "implicit" {
 		// ...the Redirection URI MUST NOT use the http scheme unless
 		// the Client is a native application, in which case it
@@ -295,16 +383,10 @@ func checkRedirectURI(redirectURI, clientID, flow string, clt Clientsource) bool
 			return false
 		}
 		if uri.Scheme == "http" &&
-			(clt.GetApplType(clientID) != "native" || uri.Host != "localhost") {
+			(clt.ApplicationType != "native" || uri.Host != "localhost") {
 			utils.EDebug(errors.New("Not compatible redirect_uri"), nil)
 			return false
 		}
-
-	} else {
-		if !clt.ValidateRedirectURI(clientID, redirectURI) {
-			utils.EDebug(errors.New("Client hasn't registered this redirect_uri"), nil)
-			return false
-		}
 	}
 	return true
 }